@@ -18,7 +18,7 @@ export GOFLAGS="-ldflags=-X=main.BuildID=$VERSION"
 export SOURCE_DATE_EPOCH=$(date +%s)
 
 # shellcheck disable=SC2086
-for NAME in honeyalb honeycloudfront honeycloudtrail honeyelb;
+for NAME in honeyalb honeycloudfront honeycloudtrail honeyelb honeyvpcflow honeys3 honeywaf honeyapigateway honeycloudwatchlogs honeyresolver honeynetworkfirewall honeyglobalaccelerator;
 do
   ko publish \
     --tags "${TAGS}" \
@@ -33,6 +33,14 @@ fpm -s dir -n honeyaws \
     $GOPATH/bin/honeycloudfront=/usr/bin/honeycloudfront \
     $GOPATH/bin/honeycloudtrail=/usr/bin/honeycloudtrail \
     $GOPATH/bin/honeyalb=/usr/bin/honeyalb \
+    $GOPATH/bin/honeyglobalaccelerator=/usr/bin/honeyglobalaccelerator \
+    $GOPATH/bin/honeynetworkfirewall=/usr/bin/honeynetworkfirewall \
+    $GOPATH/bin/honeyresolver=/usr/bin/honeyresolver \
+    $GOPATH/bin/honeycloudwatchlogs=/usr/bin/honeycloudwatchlogs \
+    $GOPATH/bin/honeyapigateway=/usr/bin/honeyapigateway \
+    $GOPATH/bin/honeywaf=/usr/bin/honeywaf \
+    $GOPATH/bin/honeys3=/usr/bin/honeys3 \
+    $GOPATH/bin/honeyvpcflow=/usr/bin/honeyvpcflow \
     ./service/honeycloudfront.upstart=/etc/init/honeycloudfront.conf \
     ./service/honeycloudfront.service=/lib/systemd/system/honeycloudfront.service \
     ./service/honeyelb.upstart=/etc/init/honeyelb.conf \
@@ -40,4 +48,20 @@ fpm -s dir -n honeyaws \
     ./service/honeycloudtrail.upstart=/etc/init/honeycloudtrail.conf \
     ./service/honeycloudtrail.service=/lib/systemd/system/honeycloudtrail.service \
     ./service/honeyalb.upstart=/etc/init/honeyalb.conf \
-    ./service/honeyalb.service=/lib/systemd/system/honeyalb.service
+    ./service/honeyalb.service=/lib/systemd/system/honeyalb.service \
+    ./service/honeyvpcflow.upstart=/etc/init/honeyvpcflow.conf \
+    ./service/honeyvpcflow.service=/lib/systemd/system/honeyvpcflow.service \
+    ./service/honeys3.upstart=/etc/init/honeys3.conf \
+    ./service/honeys3.service=/lib/systemd/system/honeys3.service \
+    ./service/honeywaf.upstart=/etc/init/honeywaf.conf \
+    ./service/honeywaf.service=/lib/systemd/system/honeywaf.service \
+    ./service/honeyapigateway.upstart=/etc/init/honeyapigateway.conf \
+    ./service/honeyapigateway.service=/lib/systemd/system/honeyapigateway.service \
+    ./service/honeycloudwatchlogs.upstart=/etc/init/honeycloudwatchlogs.conf \
+    ./service/honeycloudwatchlogs.service=/lib/systemd/system/honeycloudwatchlogs.service \
+    ./service/honeyresolver.upstart=/etc/init/honeyresolver.conf \
+    ./service/honeyresolver.service=/lib/systemd/system/honeyresolver.service \
+    ./service/honeynetworkfirewall.upstart=/etc/init/honeynetworkfirewall.conf \
+    ./service/honeynetworkfirewall.service=/lib/systemd/system/honeynetworkfirewall.service \
+    ./service/honeyglobalaccelerator.upstart=/etc/init/honeyglobalaccelerator.conf \
+    ./service/honeyglobalaccelerator.service=/lib/systemd/system/honeyglobalaccelerator.service
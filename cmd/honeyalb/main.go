@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,8 +11,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
 	"github.com/honeycombio/honeyaws/state"
 	libhoney "github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
@@ -36,7 +38,36 @@ func init() {
 	libhoney.UserAgentAddition = "honeyalb/" + versionStr
 }
 
+// supportedLB reports whether honeyalb knows how to ingest access logs for
+// the load balancer. Gateway load balancers don't write access logs.
+func supportedLB(lb *elbv2.LoadBalancer) bool {
+	switch aws.StringValue(lb.Type) {
+	case elbv2.LoadBalancerTypeEnumApplication, elbv2.LoadBalancerTypeEnumNetwork:
+		return true
+	}
+	return false
+}
+
 func cmdALB(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewALBEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
 	// TODO: Would be nice to have this more highly configurable.
 	//
 	// Will just use environment config right now, e.g., default profile.
@@ -44,6 +75,14 @@ func cmdALB(args []string) error {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSElasticLoadBalancingV2, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
 	elbSvc := elbv2.New(sess, nil)
 
 	describeLBResp, err := elbSvc.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{})
@@ -55,7 +94,9 @@ func cmdALB(args []string) error {
 		switch args[0] {
 		case "ls", "list":
 			for _, lb := range describeLBResp.LoadBalancers {
-				fmt.Println(*lb.LoadBalancerName)
+				if supportedLB(lb) {
+					fmt.Println(*lb.LoadBalancerName)
+				}
 			}
 
 			return nil
@@ -72,7 +113,9 @@ Your write key is available at https://ui.honeycomb.io/account`)
 			// are provided.
 			if len(lbNames) == 0 {
 				for _, lb := range describeLBResp.LoadBalancers {
-					lbNames = append(lbNames, *lb.LoadBalancerName)
+					if supportedLB(lb) {
+						lbNames = append(lbNames, *lb.LoadBalancerName)
+					}
 				}
 			}
 
@@ -82,26 +125,45 @@ Your write key is available at https://ui.honeycomb.io/account`)
 				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
 			}
 
-			if opt.HighAvail {
-				stater, err = state.NewDynamoDBStater(sess, opt.BackfillHr)
-				if err != nil {
-					logrus.WithField("tableName", state.DynamoTableName).Fatal("--highavail requires an existing DynamoDB table named appropriately, please refer to the README.")
-				}
-				logrus.Info("State tracking with high availability enabled - using DynamoDB")
-			} else {
-				stater = state.NewFileStater(opt.StateDir, logbucket.AWSElasticLoadBalancingV2, opt.BackfillHr)
-				logrus.Info("State tracking enabled - using local file system.")
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSElasticLoadBalancingV2)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
 			}
 			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
 
+			sd := shutdown.New(opt)
 			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewALBEventParser(opt))
 			downloadsCh := make(chan state.DownloadedObject)
 
+			// NLB access logs have their own format, so they get
+			// their own publisher. It's only created if there is an
+			// NLB to ingest.
+			var nlbPublisher *publisher.HoneycombPublisher
+			nlbDownloadsCh := make(chan state.DownloadedObject)
+
+			// Connection logs are parsed and sampled separately from
+			// access logs, but sent to the same dataset so that the
+			// two can be correlated using conn_trace_id.
+			var connPublisher *publisher.HoneycombPublisher
+			var connDownloadsCh chan state.DownloadedObject
+			if opt.ConnectionLogs {
+				connPublisher = publisher.NewHoneycombPublisher(opt, stater, publisher.NewALBConnectionEventParser(opt))
+				connDownloadsCh = make(chan state.DownloadedObject)
+			}
+
 			// For now, just run one goroutine per-LB
 			for _, lbName := range lbNames {
 				logrus.WithFields(logrus.Fields{
 					"lbName": lbName,
-				}).Info("Attempting to ingest ALB")
+				}).Info("Attempting to ingest load balancer")
 
 				elbSvc := elbv2.New(sess, nil)
 
@@ -115,7 +177,14 @@ Your write key is available at https://ui.honeycomb.io/account`)
 					os.Exit(1)
 				}
 
-				lbArn := lbNameResp.LoadBalancers[0].LoadBalancerArn
+				lb := lbNameResp.LoadBalancers[0]
+				if !supportedLB(lb) {
+					fmt.Fprintf(os.Stderr, "Load balancer %q is of type %q, only application and network load balancers are supported.\n", lbName, aws.StringValue(lb.Type))
+					os.Exit(1)
+				}
+				isNLB := aws.StringValue(lb.Type) == elbv2.LoadBalancerTypeEnumNetwork
+
+				lbArn := lb.LoadBalancerArn
 				lbArnResp, err := elbSvc.DescribeLoadBalancerAttributes(&elbv2.DescribeLoadBalancerAttributesInput{
 					LoadBalancerArn: lbArn,
 				})
@@ -127,6 +196,9 @@ Your write key is available at https://ui.honeycomb.io/account`)
 				enabled := false
 				bucketName := ""
 				bucketPrefix := ""
+				connEnabled := false
+				connBucketName := ""
+				connBucketPrefix := ""
 
 				for _, element := range lbArnResp.Attributes {
 					if *element.Key == "access_logs.s3.enabled" && *element.Value == "true" {
@@ -138,6 +210,44 @@ Your write key is available at https://ui.honeycomb.io/account`)
 					if *element.Key == "access_logs.s3.prefix" {
 						bucketPrefix = *element.Value
 					}
+					if *element.Key == "connection_logs.s3.enabled" && *element.Value == "true" {
+						connEnabled = true
+					}
+					if *element.Key == "connection_logs.s3.bucket" {
+						connBucketName = *element.Value
+					}
+					if *element.Key == "connection_logs.s3.prefix" {
+						connBucketPrefix = *element.Value
+					}
+				}
+
+				if isNLB {
+					if !enabled {
+						fmt.Fprintf(os.Stderr, `Access logs are not configured for NLB %q. Please enable them to use the ingest tool.
+
+Note that NLBs only write access logs for TLS listeners. For reference see this link:
+
+https://docs.aws.amazon.com/elasticloadbalancing/latest/network/load-balancer-access-logs.html
+`, lbName)
+						os.Exit(1)
+					}
+					logrus.WithFields(logrus.Fields{
+						"bucket": bucketName,
+						"lbName": lbName,
+					}).Info("Access logs are enabled for NLB ♥")
+
+					if nlbPublisher == nil {
+						nlbPublisher = publisher.NewHoneycombPublisher(opt, stater, publisher.NewNLBEventParser(opt))
+						sd.Publish(nlbPublisher, nlbDownloadsCh)
+					}
+
+					nlbDownloader := logbucket.NewDownloader(sess, stater, logbucket.NewNLBDownloader(sess, bucketName, bucketPrefix, lbName), opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						nlbDownloader.Download(ctx, nlbDownloadsCh)
+					})
+
+					// Connection logs are an ALB-only feature.
+					continue
 				}
 
 				if !enabled {
@@ -155,30 +265,43 @@ http://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer
 				}).Info("Access logs are enabled for ALB ♥")
 
 				albDownloader := logbucket.NewALBDownloader(sess, bucketName, bucketPrefix, lbName)
-				downloader := logbucket.NewDownloader(sess, stater, albDownloader, opt.BackfillHr)
+				downloader := logbucket.NewDownloader(sess, stater, albDownloader, opt, election, shard)
 
 				// TODO: One-goroutine-per-LB feels a bit
 				// silly.
-				go downloader.Download(downloadsCh)
-			}
-
-			signalCh := make(chan os.Signal)
-			signal.Notify(signalCh, os.Interrupt)
-
-			go func() {
-				<-signalCh
-				logrus.Fatal("Exiting due to interrupt.")
-			}()
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
 
-			for {
-				download := <-downloadsCh
-				if err := defaultPublisher.Publish(download); err != nil {
+				if opt.ConnectionLogs {
+					// Other ALBs' connection logs are still
+					// ingested, so don't give up on them.
+					if !connEnabled {
+						logrus.WithField("lbName", lbName).Warn("Connection logs are not configured for ALB, skipping them. See https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-connection-logs.html")
+						continue
+					}
 					logrus.WithFields(logrus.Fields{
-						"object": download,
-						"error":  err,
-					}).Error("Cannot properly publish downloaded object")
+						"bucket": connBucketName,
+						"lbName": lbName,
+					}).Info("Connection logs are enabled for ALB ♥")
+
+					connDownloader := logbucket.NewDownloader(sess, stater, logbucket.NewALBConnectionDownloader(sess, connBucketName, connBucketPrefix, lbName), opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						connDownloader.Download(ctx, connDownloadsCh)
+					})
 				}
 			}
+
+			if opt.ConnectionLogs {
+				sd.Publish(connPublisher, connDownloadsCh)
+			}
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher, nlbPublisher, connPublisher)
+			return nil
 		}
 	}
 
@@ -217,7 +340,7 @@ func main() {
 	}
 
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest] [ALB names...]
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [ALB/NLB names...]
 
 Use '`+os.Args[0]+` --help' to see available flags.`)
 		os.Exit(1)
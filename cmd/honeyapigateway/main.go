@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeyapigateway/" + versionStr
+}
+
+// stage is an API Gateway stage, named "<api id>/<stage name>", along with
+// its access log settings.
+type stage struct {
+	Name           string
+	DestinationArn string
+	Format         string
+}
+
+// listStages returns the stages of REST APIs as well as HTTP and WebSocket
+// APIs, which are managed through different services.
+func listStages(sess *session.Session) ([]stage, error) {
+	var stages []stage
+
+	restSvc := apigateway.New(sess, nil)
+	var restAPIs []*apigateway.RestApi
+	err := restSvc.GetRestApisPages(&apigateway.GetRestApisInput{}, func(page *apigateway.GetRestApisOutput, lastPage bool) bool {
+		restAPIs = append(restAPIs, page.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, api := range restAPIs {
+		resp, err := restSvc.GetStages(&apigateway.GetStagesInput{
+			RestApiId: api.Id,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Item {
+			st := stage{Name: aws.StringValue(api.Id) + "/" + aws.StringValue(s.StageName)}
+			if s.AccessLogSettings != nil {
+				st.DestinationArn = aws.StringValue(s.AccessLogSettings.DestinationArn)
+				st.Format = aws.StringValue(s.AccessLogSettings.Format)
+			}
+			stages = append(stages, st)
+		}
+	}
+
+	v2Svc := apigatewayv2.New(sess, nil)
+	apisInput := &apigatewayv2.GetApisInput{}
+	for {
+		apisResp, err := v2Svc.GetApis(apisInput)
+		if err != nil {
+			return nil, err
+		}
+		for _, api := range apisResp.Items {
+			stagesInput := &apigatewayv2.GetStagesInput{ApiId: api.ApiId}
+			for {
+				resp, err := v2Svc.GetStages(stagesInput)
+				if err != nil {
+					return nil, err
+				}
+				for _, s := range resp.Items {
+					st := stage{Name: aws.StringValue(api.ApiId) + "/" + aws.StringValue(s.StageName)}
+					if s.AccessLogSettings != nil {
+						st.DestinationArn = aws.StringValue(s.AccessLogSettings.DestinationArn)
+						st.Format = aws.StringValue(s.AccessLogSettings.Format)
+					}
+					stages = append(stages, st)
+				}
+				if resp.NextToken == nil {
+					break
+				}
+				stagesInput.NextToken = resp.NextToken
+			}
+		}
+		if apisResp.NextToken == nil {
+			break
+		}
+		apisInput.NextToken = apisResp.NextToken
+	}
+
+	return stages, nil
+}
+
+// logGroupNameFromARN returns the name of the CloudWatch Logs log group in a
+// log destination ARN, e.g.
+// arn:aws:logs:us-east-1:123456789012:log-group:API-Gateway-Access-Logs_a1b2c3/prod
+func logGroupNameFromARN(arn string) (string, bool) {
+	if !strings.HasPrefix(arn, "arn:aws:logs:") {
+		return "", false
+	}
+	i := strings.Index(arn, ":log-group:")
+	if i < 0 {
+		return "", false
+	}
+	return strings.TrimSuffix(arn[i+len(":log-group:"):], ":*"), true
+}
+
+// subscriptionDestinations returns the destination ARN of each subscription
+// filter of a log group.
+func subscriptionDestinations(logsSvc *cloudwatchlogs.CloudWatchLogs, group string) ([]string, error) {
+	var destinations []string
+	input := &cloudwatchlogs.DescribeSubscriptionFiltersInput{
+		LogGroupName: aws.String(group),
+	}
+	for {
+		resp, err := logsSvc.DescribeSubscriptionFilters(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, filter := range resp.SubscriptionFilters {
+			destinations = append(destinations, aws.StringValue(filter.DestinationArn))
+		}
+		if resp.NextToken == nil {
+			return destinations, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// parserKey identifies the parser of a stage's access logs, which depends on
+// their format and on whether they're wrapped in CloudWatch Logs payloads.
+type parserKey struct {
+	format         string
+	cloudWatchLogs bool
+}
+
+func cmdAPIGateway(args []string) error {
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSAPIGateway, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	stages, err := listStages(sess)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, s := range stages {
+				fmt.Println(s.Name)
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			stageNames := args[1:]
+
+			// Use all stages with access logging by default if none
+			// are provided.
+			if len(stageNames) == 0 {
+				for _, s := range stages {
+					if s.DestinationArn != "" {
+						stageNames = append(stageNames, s.Name)
+					}
+				}
+			}
+
+			stagesByName := make(map[string]stage, len(stages))
+			for _, s := range stages {
+				stagesByName[s.Name] = s
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSAPIGateway)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			sd := shutdown.New(opt)
+
+			// Each access log format needs its own parser, so stages
+			// are published by format. Stages can also share a
+			// delivery stream, which only needs to be read once.
+			downloadsChByParser := make(map[parserKey]chan state.DownloadedObject)
+			var publishers []*publisher.HoneycombPublisher
+			formatByDestination := make(map[string]string)
+			logsSvc := cloudwatchlogs.New(sess, nil)
+
+			for _, name := range stageNames {
+				logrus.WithFields(logrus.Fields{
+					"stage": name,
+				}).Info("Attempting to ingest stage")
+
+				s, ok := stagesByName[name]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Stage %q was not found. Try using ls to list available stages.\n", name)
+					os.Exit(1)
+				}
+
+				if s.DestinationArn == "" {
+					fmt.Fprintf(os.Stderr, `Access logging is not configured for stage %q. Please enable it to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/apigateway/latest/developerguide/set-up-logging.html
+`, name)
+					os.Exit(1)
+				}
+
+				// Access logs sent to CloudWatch Logs are read
+				// from where the log group's subscription filters
+				// send them.
+				key := parserKey{format: s.Format}
+				destinations := []string{s.DestinationArn}
+				if group, ok := logGroupNameFromARN(s.DestinationArn); ok {
+					key.cloudWatchLogs = true
+					destinations, err = subscriptionDestinations(logsSvc, group)
+					if err != nil {
+						return err
+					}
+					if len(destinations) == 0 {
+						logrus.WithFields(logrus.Fields{
+							"stage":    name,
+							"logGroup": group,
+						}).Warn("Stage sends access logs to a CloudWatch Logs log group without a subscription filter, skipping it. Add one with a Kinesis or Firehose destination to ingest them: https://docs.aws.amazon.com/AmazonCloudWatch/latest/logs/SubscriptionFilters.html")
+						continue
+					}
+				}
+				if opt.APIGatewayLogFormat != "" {
+					key.format = opt.APIGatewayLogFormat
+				}
+
+				for _, arn := range destinations {
+					if destinationFormat, ok := formatByDestination[arn]; ok {
+						if destinationFormat != key.format {
+							logrus.WithFields(logrus.Fields{
+								"stage":       name,
+								"destination": arn,
+							}).Warn("Stage shares a destination with a stage using a different access log format, parsing with the first format")
+						}
+						continue
+					}
+
+					streamName, isFirehose := logbucket.DeliveryStreamNameFromARN(arn)
+					var kinesisStream, region string
+					if !isFirehose && key.cloudWatchLogs {
+						kinesisStream, region, err = logstream.StreamNameFromARN(arn)
+					}
+					if !isFirehose && kinesisStream == "" {
+						logrus.WithFields(logrus.Fields{
+							"stage":       name,
+							"destination": arn,
+						}).Warn("Stage sends access logs to an unsupported destination, skipping it. Kinesis Data Firehose and CloudWatch Logs (with a Kinesis or Firehose subscription) are supported: https://docs.aws.amazon.com/apigateway/latest/developerguide/set-up-logging.html")
+						continue
+					}
+					formatByDestination[arn] = key.format
+
+					downloadsCh, ok := downloadsChByParser[key]
+					if !ok {
+						downloadsCh = make(chan state.DownloadedObject)
+						downloadsChByParser[key] = downloadsCh
+						parser := publisher.NewAPIGatewayEventParser(opt, key.format)
+						parser.CloudWatchLogs = key.cloudWatchLogs
+						p := publisher.NewHoneycombPublisher(opt, stater, parser)
+						publishers = append(publishers, p)
+						sd.Publish(p, downloadsCh)
+					}
+
+					if !isFirehose {
+						logrus.WithFields(logrus.Fields{
+							"stage":  name,
+							"stream": kinesisStream,
+						}).Info("Access logs are enabled for stage ♥")
+
+						consumer := logstream.NewKinesisConsumer(sess, stater, kinesisStream, region, opt.KinesisEndpoint, opt.BackfillHr)
+						sd.Go(func(ctx context.Context) {
+							consumer.Consume(ctx, downloadsCh)
+						})
+						continue
+					}
+
+					bucket, prefix, err := logbucket.DeliveryStreamBucket(sess, streamName)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						os.Exit(1)
+					}
+
+					logrus.WithFields(logrus.Fields{
+						"bucket": bucket,
+						"stage":  name,
+						"stream": streamName,
+					}).Info("Access logs are enabled for stage ♥")
+
+					firehoseDownloader := logbucket.NewFirehoseDownloader(bucket, prefix, streamName)
+					downloader := logbucket.NewDownloader(sess, stater, firehoseDownloader, opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						downloader.Download(ctx, downloadsCh)
+					})
+				}
+			}
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, publishers...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-apigateway-access"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeyapigateway version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|state] [API ID/stage names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdAPIGateway(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
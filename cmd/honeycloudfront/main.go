@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"strings"
 	"time"
 
@@ -12,8 +12,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
 	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
 	"github.com/honeycombio/honeyaws/state"
 	libhoney "github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
@@ -37,7 +39,137 @@ func init() {
 	libhoney.UserAgentAddition = "honeycloudfront/" + versionStr
 }
 
+// realtimeLogConfigArns returns the real-time log configurations used by the
+// cache behaviors of a distribution.
+func realtimeLogConfigArns(config *cloudfront.DistributionConfig) []string {
+	var arns []string
+	seen := make(map[string]bool)
+
+	add := func(arn *string) {
+		if arn != nil && *arn != "" && !seen[*arn] {
+			seen[*arn] = true
+			arns = append(arns, *arn)
+		}
+	}
+
+	if config.DefaultCacheBehavior != nil {
+		add(config.DefaultCacheBehavior.RealtimeLogConfigArn)
+	}
+	if config.CacheBehaviors != nil {
+		for _, behavior := range config.CacheBehaviors.Items {
+			add(behavior.RealtimeLogConfigArn)
+		}
+	}
+
+	return arns
+}
+
+// ingestRealtimeLogs reads the Kinesis data streams of the real-time log
+// configurations used by the distributions until shutdown, returning their
+// publishers. Each configuration has its own field list, and so its own
+// publisher.
+func ingestRealtimeLogs(sd *shutdown.Shutdown, sess *session.Session, stater state.Stater, distIds []string) []*publisher.HoneycombPublisher {
+	var publishers []*publisher.HoneycombPublisher
+	cloudfrontSvc := cloudfront.New(sess, nil)
+
+	// Distributions can share a real-time log configuration, which only
+	// needs to be read once.
+	seenConfigs := make(map[string]bool)
+
+	for _, id := range distIds {
+		logrus.WithFields(logrus.Fields{
+			"id": id,
+		}).Info("Attempting to ingest CloudFront distribution real-time logs")
+
+		distConfigResp, err := cloudfrontSvc.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
+			Id: aws.String(id),
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting distribution config: ", err)
+			os.Exit(1)
+		}
+
+		configArns := realtimeLogConfigArns(distConfigResp.DistributionConfig)
+		if len(configArns) == 0 {
+			fmt.Fprintf(os.Stderr, `Real-time logs are not configured for CloudFront distribution ID %q. Please attach a real-time log configuration to use the ingest tool with --realtime_logs.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/real-time-logs.html
+`, id)
+			os.Exit(1)
+		}
+
+		for _, arn := range configArns {
+			if seenConfigs[arn] {
+				continue
+			}
+			seenConfigs[arn] = true
+
+			configResp, err := cloudfrontSvc.GetRealtimeLogConfig(&cloudfront.GetRealtimeLogConfigInput{
+				ARN: aws.String(arn),
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error getting real-time log config: ", err)
+				os.Exit(1)
+			}
+
+			realtimeConfig := configResp.RealtimeLogConfig
+			fields := aws.StringValueSlice(realtimeConfig.Fields)
+
+			downloadsCh := make(chan state.DownloadedObject)
+			realtimePublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewCloudFrontRealtimeEventParser(opt, fields))
+			publishers = append(publishers, realtimePublisher)
+			sd.Publish(realtimePublisher, downloadsCh)
+
+			for _, endpoint := range realtimeConfig.EndPoints {
+				if endpoint.KinesisStreamConfig == nil {
+					continue
+				}
+
+				streamName, region, err := logstream.StreamNameFromARN(aws.StringValue(endpoint.KinesisStreamConfig.StreamARN))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+
+				logrus.WithFields(logrus.Fields{
+					"config": aws.StringValue(realtimeConfig.Name),
+					"stream": streamName,
+					"id":     id,
+				}).Info("Real-time logs are enabled for CloudFront distribution ♥")
+
+				consumer := logstream.NewKinesisConsumer(sess, stater, streamName, region, opt.KinesisEndpoint, opt.BackfillHr)
+				sd.Go(func(ctx context.Context) {
+					consumer.Consume(ctx, downloadsCh)
+				})
+			}
+		}
+	}
+
+	return publishers
+}
+
 func cmdCloudFront(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewCloudFrontEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
 	// TODO: Would be nice to have this more highly configurable.
 	//
 	// Will just use environment config right now, e.g., default profile.
@@ -45,6 +177,18 @@ func cmdCloudFront(args []string) error {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	if len(args) > 0 && args[0] == "state" {
+		service := logbucket.AWSCloudFront
+		if opt.RealtimeLogs {
+			service = logstream.AWSCloudFrontRealtime
+		}
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, service, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
 	cloudfrontSvc := cloudfront.New(sess, nil)
 
 	listDistributionsResp, err := cloudfrontSvc.ListDistributions(&cloudfront.ListDistributionsInput{})
@@ -83,19 +227,32 @@ Your write key is available at https://ui.honeycomb.io/account`)
 				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
 			}
 
-			if opt.HighAvail {
-				stater, err = state.NewDynamoDBStater(sess, opt.BackfillHr)
+			service := logbucket.AWSCloudFront
+			if opt.RealtimeLogs {
+				service = logstream.AWSCloudFrontRealtime
+			}
+			stater, err = state.NewStaterFromOptions(opt, sess, service)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
 
-				if err != nil {
-					logrus.WithField("tableName", state.DynamoTableName).Fatal("--highavail requires an existing DynamoDB table named appropriately, please refer to the README.")
-				}
-				logrus.Info("High availability enabled - using DynamoDB")
+			sd := shutdown.New(opt)
 
-			} else {
-				stater = state.NewFileStater(opt.StateDir, logbucket.AWSCloudFront, opt.BackfillHr)
-				logrus.Info("State tracking enabled - using local file system.")
+			if opt.RealtimeLogs {
+				publishers := ingestRealtimeLogs(sd, sess, stater, distIds)
+				sd.Wait()
+				sd.Finish(stater, shard, publishers...)
+				return nil
 			}
-			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
 
 			downloadsCh := make(chan state.DownloadedObject)
 			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewCloudFrontEventParser(opt))
@@ -143,26 +300,18 @@ https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/AccessLogs.ht
 				}).Info("Access logs are enabled for CloudFront distribution ♥")
 
 				cloudfrontDownloader := logbucket.NewCloudFrontDownloader(bucket, *loggingConfig.Prefix, id)
-				downloader := logbucket.NewDownloader(sess, stater, cloudfrontDownloader, opt.BackfillHr)
-				go downloader.Download(downloadsCh)
+				downloader := logbucket.NewDownloader(sess, stater, cloudfrontDownloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
 			}
+			sd.Publish(defaultPublisher, downloadsCh)
 
-			signalCh := make(chan os.Signal)
-			signal.Notify(signalCh, os.Interrupt)
-			go func() {
-				<-signalCh
-				logrus.Fatal("Exiting due to interrupt.")
-			}()
-
-			for {
-				download := <-downloadsCh
-				if err := defaultPublisher.Publish(download); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"object": download,
-						"error":  err,
-					}).Error("Cannot properly publish downloaded object")
-				}
-			}
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
 		}
 	}
 
@@ -201,7 +350,7 @@ func main() {
 	}
 
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest] [CloudFront distribution IDs...]
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [CloudFront distribution IDs...]
 
 Use '`+os.Args[0]+` --help' to see available flags.`)
 		os.Exit(1)
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,8 +11,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudtrail"
 	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
 	"github.com/honeycombio/honeyaws/state"
 	libhoney "github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
@@ -37,6 +39,25 @@ func init() {
 }
 
 func cmdCloudTrail(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewCloudTrailEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
 	// TODO: Would be nice to have this more highly configurable.
 	//
 	// Will just use environment config right now, e.g., default profile.
@@ -44,6 +65,14 @@ func cmdCloudTrail(args []string) error {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSCloudTrail, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
 	cloudtrailSvc := cloudtrail.New(sess, nil)
 
 	listTrailsResp, err := cloudtrailSvc.DescribeTrails(&cloudtrail.DescribeTrailsInput{})
@@ -93,20 +122,22 @@ Your write key is available at https://ui.honeycomb.io/account`)
 				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
 			}
 
-			if opt.HighAvail {
-				stater, err = state.NewDynamoDBStater(sess, opt.BackfillHr)
-				if err != nil {
-					logrus.WithField("tableName", state.DynamoTableName).Fatal("--highavail requires an existing DynamoDB table named appropriately, please refer to the README.")
-				}
-				logrus.Info("High availability enabled - using DynamoDB")
-
-			} else {
-				stater = state.NewFileStater(opt.StateDir, logbucket.AWSCloudTrail, opt.BackfillHr)
-				logrus.Info("State tracking enabled - using local file system.")
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSCloudTrail)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
 			}
 			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
 
 			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
 			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewCloudTrailEventParser(opt))
 
 			for _, trail := range trailListResp.TrailList {
@@ -135,27 +166,19 @@ https://docs.aws.amazon.com/awscloudtrail/latest/userguide/cloudtrail-create-and
 				}).Info("Access logs are enabled for CloudTrail trails")
 
 				cloudtrailDownloader := logbucket.NewCloudTrailDownloader(sess, *s3Bucket, prefix, *trail.TrailARN)
-				downloader := logbucket.NewDownloader(sess, stater, cloudtrailDownloader, opt.BackfillHr)
-				go downloader.Download(downloadsCh)
+				downloader := logbucket.NewDownloader(sess, stater, cloudtrailDownloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
 			}
 
-			signalCh := make(chan os.Signal)
-			signal.Notify(signalCh, os.Interrupt)
-			go func() {
-				<-signalCh
-				logrus.Fatal("Exiting due to interrupt.")
-			}()
-
-			for {
-				download := <-downloadsCh
-				if err := defaultPublisher.Publish(download); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"object": download,
-						"error":  err,
-					}).Error("Cannot properly publish downloaded object")
-				}
-			}
+			sd.Publish(defaultPublisher, downloadsCh)
 
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
 		}
 
 	}
@@ -195,7 +218,7 @@ func main() {
 	}
 
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest] [CloudTrail distribution IDs...]
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [CloudTrail distribution IDs...]
 
 Use '`+os.Args[0]+` --help' to see available flags.`)
 		os.Exit(1)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeycloudwatchlogs/" + versionStr
+}
+
+// subscriptionDestinations returns the destination ARN of each subscription
+// filter of the log groups which have any.
+func subscriptionDestinations(logsSvc *cloudwatchlogs.CloudWatchLogs) (map[string][]string, error) {
+	var groups []string
+	err := logsSvc.DescribeLogGroupsPages(&cloudwatchlogs.DescribeLogGroupsInput{}, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, group := range page.LogGroups {
+			groups = append(groups, aws.StringValue(group.LogGroupName))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	destinations := make(map[string][]string)
+	for _, group := range groups {
+		resp, err := logsSvc.DescribeSubscriptionFilters(&cloudwatchlogs.DescribeSubscriptionFiltersInput{
+			LogGroupName: aws.String(group),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, filter := range resp.SubscriptionFilters {
+			destinations[group] = append(destinations[group], aws.StringValue(filter.DestinationArn))
+		}
+	}
+
+	return destinations, nil
+}
+
+// completedExportTasks returns the completed export tasks of the log groups.
+func completedExportTasks(logsSvc *cloudwatchlogs.CloudWatchLogs, groups map[string]bool) ([]*cloudwatchlogs.ExportTask, error) {
+	var tasks []*cloudwatchlogs.ExportTask
+	input := &cloudwatchlogs.DescribeExportTasksInput{
+		StatusCode: aws.String(cloudwatchlogs.ExportTaskStatusCodeCompleted),
+	}
+	for {
+		resp, err := logsSvc.DescribeExportTasks(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range resp.ExportTasks {
+			if groups[aws.StringValue(task.LogGroupName)] {
+				tasks = append(tasks, task)
+			}
+		}
+		if resp.NextToken == nil {
+			return tasks, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+func cmdCloudWatchLogs(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewCloudWatchLogsEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, false); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSCloudWatchLogs, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	logsSvc := cloudwatchlogs.New(sess, nil)
+
+	destinations, err := subscriptionDestinations(logsSvc)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for group, arns := range destinations {
+				fmt.Printf("%s\t%s\n", group, strings.Join(arns, ","))
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			groupNames := args[1:]
+
+			// Use all log groups with a subscription filter by
+			// default if none are provided.
+			if len(groupNames) == 0 {
+				for group := range destinations {
+					groupNames = append(groupNames, group)
+				}
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSCloudWatchLogs)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewCloudWatchLogsEventParser(opt))
+
+			var exportTasks map[string][]*cloudwatchlogs.ExportTask
+			if opt.ExportTasks {
+				groups := make(map[string]bool, len(groupNames))
+				for _, group := range groupNames {
+					groups[group] = true
+				}
+				tasks, err := completedExportTasks(logsSvc, groups)
+				if err != nil {
+					return err
+				}
+				exportTasks = make(map[string][]*cloudwatchlogs.ExportTask)
+				for _, task := range tasks {
+					group := aws.StringValue(task.LogGroupName)
+					exportTasks[group] = append(exportTasks[group], task)
+				}
+			}
+
+			// Log groups can share a destination, which only needs
+			// to be read once.
+			seenDestinations := make(map[string]bool)
+
+			for _, group := range groupNames {
+				logrus.WithFields(logrus.Fields{
+					"logGroup": group,
+				}).Info("Attempting to ingest log group")
+
+				if len(destinations[group]) == 0 && len(exportTasks[group]) == 0 {
+					fmt.Fprintf(os.Stderr, `No subscription filter is configured for log group %q. Please add one with a Kinesis or Firehose destination to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/AmazonCloudWatch/latest/logs/SubscriptionFilters.html
+`, group)
+					os.Exit(1)
+				}
+
+				for _, arn := range destinations[group] {
+					if seenDestinations[arn] {
+						continue
+					}
+					seenDestinations[arn] = true
+
+					if streamName, ok := logbucket.DeliveryStreamNameFromARN(arn); ok {
+						bucket, prefix, err := logbucket.DeliveryStreamBucket(sess, streamName)
+						if err != nil {
+							fmt.Fprintln(os.Stderr, err)
+							os.Exit(1)
+						}
+
+						logrus.WithFields(logrus.Fields{
+							"bucket":   bucket,
+							"logGroup": group,
+							"stream":   streamName,
+						}).Info("Subscription to Firehose is enabled for log group ♥")
+
+						firehoseDownloader := logbucket.NewDownloader(sess, stater, logbucket.NewFirehoseDownloader(bucket, prefix, streamName), opt, election, shard)
+						sd.Go(func(ctx context.Context) {
+							firehoseDownloader.Download(ctx, downloadsCh)
+						})
+						continue
+					}
+
+					streamName, region, err := logstream.StreamNameFromARN(arn)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Log group %q is subscribed to %s. Only Kinesis and Firehose destinations are supported.\n", group, arn)
+						os.Exit(1)
+					}
+
+					logrus.WithFields(logrus.Fields{
+						"logGroup": group,
+						"stream":   streamName,
+					}).Info("Subscription to Kinesis is enabled for log group ♥")
+
+					consumer := logstream.NewKinesisConsumer(sess, stater, streamName, region, opt.KinesisEndpoint, opt.BackfillHr)
+					sd.Go(func(ctx context.Context) {
+						consumer.Consume(ctx, downloadsCh)
+					})
+				}
+
+				for _, task := range exportTasks[group] {
+					prefix := aws.StringValue(task.DestinationPrefix)
+					if prefix == "" {
+						prefix = "exportedlogs"
+					}
+
+					logrus.WithFields(logrus.Fields{
+						"bucket":   aws.StringValue(task.Destination),
+						"logGroup": group,
+						"task":     aws.StringValue(task.TaskId),
+					}).Info("Ingesting export task for log group")
+
+					exportDownloader := logbucket.NewDownloader(sess, stater, logbucket.NewCloudWatchLogsExportDownloader(aws.StringValue(task.Destination), prefix, aws.StringValue(task.TaskId)), opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						exportDownloader.Download(ctx, downloadsCh)
+					})
+				}
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-cloudwatch-logs"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeycloudwatchlogs version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [log group names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdCloudWatchLogs(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
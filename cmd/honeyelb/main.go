@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,8 +11,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
 	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
 	"github.com/honeycombio/honeyaws/state"
 	libhoney "github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
@@ -37,6 +39,25 @@ func init() {
 }
 
 func cmdELB(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewELBEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, false); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
 	// TODO: Would be nice to have this more highly configurable.
 	//
 	// Will just use environment config right now, e.g., default profile.
@@ -44,6 +65,14 @@ func cmdELB(args []string) error {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSElasticLoadBalancing, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
 	elbSvc := elb.New(sess, nil)
 
 	describeLBResp, err := elbSvc.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{})
@@ -82,19 +111,21 @@ Your write key is available at https://ui.honeycomb.io/account`)
 				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
 			}
 
-			if opt.HighAvail {
-				stater, err = state.NewDynamoDBStater(sess, opt.BackfillHr)
-				if err != nil {
-					logrus.WithField("tableName", state.DynamoTableName).Fatal("--highavail requires an existing DynamoDB table named appropriately, please refer to the README.")
-				}
-				logrus.Info("High availability enabled - using DynamoDB")
-
-			} else {
-				stater = state.NewFileStater(opt.StateDir, logbucket.AWSElasticLoadBalancing, opt.BackfillHr)
-				logrus.Info("State tracking enabled - using local file system.")
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSElasticLoadBalancing)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
 			}
 			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
 
+			sd := shutdown.New(opt)
 			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewELBEventParser(opt))
 			downloadsCh := make(chan state.DownloadedObject)
 
@@ -131,39 +162,22 @@ http://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer
 				}).Info("Access logs are enabled for ELB ♥")
 
 				elbDownloader := logbucket.NewELBDownloader(sess, *accessLog.S3BucketName, *accessLog.S3BucketPrefix, lbName)
-				downloader := logbucket.NewDownloader(sess, stater, elbDownloader, opt.BackfillHr)
+				downloader := logbucket.NewDownloader(sess, stater, elbDownloader, opt, election, shard)
 
 				// TODO: One-goroutine-per-LB feels a bit
 				// silly.
-				go downloader.Download(downloadsCh)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
 			}
 
-			signalCh := make(chan os.Signal)
-			signal.Notify(signalCh, os.Interrupt)
-
-			go func() {
-				<-signalCh
-				logrus.Fatal("Exiting due to interrupt.")
-				// TODO(nathanleclaire): Cleanup before
-				// exiting.
-				//
-				// 1. Delete format file, even
-				//    though it's in /tmp.
-				// 2. Also, wait for existing in-flight object
-				//    parsing / sending to finish so that state of
-				//    parsing "cursor" can be written to the JSON
-				//    file.
-			}()
-
-			for {
-				download := <-downloadsCh
-				if err := defaultPublisher.Publish(download); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"object": download,
-						"error":  err,
-					}).Error("Cannot properly publish downloaded object")
-				}
-			}
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
 		}
 	}
 
@@ -202,7 +216,7 @@ func main() {
 	}
 
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest] [ELB names...]
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [ELB names...]
 
 Use '`+os.Args[0]+` --help' to see available flags.`)
 		os.Exit(1)
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeyglobalaccelerator/" + versionStr
+}
+
+// acceleratorID returns the ID of an accelerator from its ARN, e.g.
+// arn:aws:globalaccelerator::123456789012:accelerator/1234abcd-abcd-1234-abcd-1234abcdefgh,
+// which is what flow log object names use.
+func acceleratorID(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+func cmdGlobalAccelerator(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewGlobalAcceleratorEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSGlobalAccelerator, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	// The Global Accelerator API is only available in us-west-2,
+	// regardless of where the accelerator's endpoints are.
+	gaSvc := globalaccelerator.New(sess, aws.NewConfig().WithRegion("us-west-2"))
+
+	var accelerators []*globalaccelerator.Accelerator
+	err := gaSvc.ListAcceleratorsPages(&globalaccelerator.ListAcceleratorsInput{},
+		func(resp *globalaccelerator.ListAcceleratorsOutput, lastPage bool) bool {
+			accelerators = append(accelerators, resp.Accelerators...)
+			return true
+		})
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, accelerator := range accelerators {
+				fmt.Printf("%s\t%s\n", acceleratorID(*accelerator.AcceleratorArn), aws.StringValue(accelerator.Name))
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			acceleratorIDs := args[1:]
+
+			// Use all available accelerators by default if none are
+			// provided.
+			if len(acceleratorIDs) == 0 {
+				for _, accelerator := range accelerators {
+					acceleratorIDs = append(acceleratorIDs, acceleratorID(*accelerator.AcceleratorArn))
+				}
+			}
+
+			acceleratorsByID := make(map[string]*globalaccelerator.Accelerator, len(accelerators))
+			for _, accelerator := range accelerators {
+				acceleratorsByID[acceleratorID(*accelerator.AcceleratorArn)] = accelerator
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSGlobalAccelerator)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewGlobalAcceleratorEventParser(opt))
+
+			// For now, just run one goroutine per-accelerator
+			for _, id := range acceleratorIDs {
+				logrus.WithFields(logrus.Fields{
+					"id": id,
+				}).Info("Attempting to ingest accelerator")
+
+				accelerator, ok := acceleratorsByID[id]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Accelerator %q was not found. Try using ls to list available accelerators.\n", id)
+					os.Exit(1)
+				}
+
+				attrsResp, err := gaSvc.DescribeAcceleratorAttributes(&globalaccelerator.DescribeAcceleratorAttributesInput{
+					AcceleratorArn: accelerator.AcceleratorArn,
+				})
+				if err != nil {
+					return err
+				}
+
+				attrs := attrsResp.AcceleratorAttributes
+				if attrs == nil || !aws.BoolValue(attrs.FlowLogsEnabled) {
+					fmt.Fprintf(os.Stderr, `Flow logs are not enabled for accelerator %q. Please enable them to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/global-accelerator/latest/dg/monitoring-global-accelerator.flow-logs.html
+`, id)
+					os.Exit(1)
+				}
+
+				bucket := aws.StringValue(attrs.FlowLogsS3Bucket)
+				prefix := aws.StringValue(attrs.FlowLogsS3Prefix)
+
+				logrus.WithFields(logrus.Fields{
+					"bucket": bucket,
+					"id":     id,
+				}).Info("Flow logs are enabled for accelerator ♥")
+
+				acceleratorDownloader := logbucket.NewGlobalAcceleratorDownloader(sess, bucket, prefix, id)
+				downloader := logbucket.NewDownloader(sess, stater, acceleratorDownloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-globalaccelerator-access"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeyglobalaccelerator version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [accelerator IDs...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdGlobalAccelerator(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
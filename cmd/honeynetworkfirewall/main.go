@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/networkfirewall"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeynetworkfirewall/" + versionStr
+}
+
+func listFirewalls(firewallSvc *networkfirewall.NetworkFirewall) ([]*networkfirewall.FirewallMetadata, error) {
+	var firewalls []*networkfirewall.FirewallMetadata
+	err := firewallSvc.ListFirewallsPages(&networkfirewall.ListFirewallsInput{},
+		func(page *networkfirewall.ListFirewallsOutput, lastPage bool) bool {
+			firewalls = append(firewalls, page.Firewalls...)
+			return true
+		})
+	return firewalls, err
+}
+
+// s3Destinations returns the logging destinations of the firewall which are S3
+// buckets, one for each log type (alert and flow) that is enabled.
+func s3Destinations(firewallSvc *networkfirewall.NetworkFirewall, firewallArn *string) ([]*networkfirewall.LogDestinationConfig, error) {
+	resp, err := firewallSvc.DescribeLoggingConfiguration(&networkfirewall.DescribeLoggingConfigurationInput{
+		FirewallArn: firewallArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.LoggingConfiguration == nil {
+		return nil, nil
+	}
+
+	var destinations []*networkfirewall.LogDestinationConfig
+	for _, destination := range resp.LoggingConfiguration.LogDestinationConfigs {
+		if aws.StringValue(destination.LogDestinationType) == networkfirewall.LogDestinationTypeS3 {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations, nil
+}
+
+func cmdNetworkFirewall(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewNetworkFirewallEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSNetworkFirewall, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	firewallSvc := networkfirewall.New(sess, nil)
+
+	firewalls, err := listFirewalls(firewallSvc)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, firewall := range firewalls {
+				fmt.Println(*firewall.FirewallName)
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			firewallNames := args[1:]
+
+			// Use all available firewalls by default if none are
+			// provided.
+			if len(firewallNames) == 0 {
+				for _, firewall := range firewalls {
+					firewallNames = append(firewallNames, *firewall.FirewallName)
+				}
+			}
+
+			firewallsByName := make(map[string]*networkfirewall.FirewallMetadata, len(firewalls))
+			for _, firewall := range firewalls {
+				firewallsByName[*firewall.FirewallName] = firewall
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSNetworkFirewall)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewNetworkFirewallEventParser(opt))
+
+			// For now, just run one goroutine per-firewall and log type
+			for _, name := range firewallNames {
+				logrus.WithFields(logrus.Fields{
+					"name": name,
+				}).Info("Attempting to ingest firewall")
+
+				firewall, ok := firewallsByName[name]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Firewall %q was not found. Try using ls to list available firewalls.\n", name)
+					os.Exit(1)
+				}
+
+				destinations, err := s3Destinations(firewallSvc, firewall.FirewallArn)
+				if err != nil {
+					return err
+				}
+
+				if len(destinations) == 0 {
+					fmt.Fprintf(os.Stderr, `Logging to S3 is not configured for firewall %q. Please enable it to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/network-firewall/latest/developerguide/firewall-logging.html
+`, name)
+					os.Exit(1)
+				}
+
+				for _, destination := range destinations {
+					bucket := aws.StringValue(destination.LogDestination["bucketName"])
+					prefix := aws.StringValue(destination.LogDestination["prefix"])
+					logType := aws.StringValue(destination.LogType)
+
+					logrus.WithFields(logrus.Fields{
+						"bucket":  bucket,
+						"name":    name,
+						"logType": logType,
+					}).Info("Logging to S3 is enabled for firewall ♥")
+
+					firewallDownloader := logbucket.NewNetworkFirewallDownloader(sess, bucket, prefix, name, logType)
+					downloader := logbucket.NewDownloader(sess, stater, firewallDownloader, opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						downloader.Download(ctx, downloadsCh)
+					})
+				}
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-network-firewall"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeynetworkfirewall version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [firewall names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdNetworkFirewall(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53resolver"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeyresolver/" + versionStr
+}
+
+// listQueryLogConfigs returns the query logging configurations which log to
+// S3, the only destination we can download from.
+func listQueryLogConfigs(resolverSvc *route53resolver.Route53Resolver) ([]*route53resolver.ResolverQueryLogConfig, error) {
+	var configs []*route53resolver.ResolverQueryLogConfig
+	err := resolverSvc.ListResolverQueryLogConfigsPages(&route53resolver.ListResolverQueryLogConfigsInput{},
+		func(page *route53resolver.ListResolverQueryLogConfigsOutput, lastPage bool) bool {
+			for _, config := range page.ResolverQueryLogConfigs {
+				if strings.HasPrefix(aws.StringValue(config.DestinationArn), "arn:aws:s3:::") {
+					configs = append(configs, config)
+				}
+			}
+			return true
+		})
+	return configs, err
+}
+
+// associatedVPCs returns the IDs of the VPCs whose queries are logged by the
+// configuration.
+func associatedVPCs(resolverSvc *route53resolver.Route53Resolver, configID string) ([]string, error) {
+	var vpcIDs []string
+	input := &route53resolver.ListResolverQueryLogConfigAssociationsInput{
+		Filters: []*route53resolver.Filter{
+			{
+				Name:   aws.String("ResolverQueryLogConfigId"),
+				Values: []*string{aws.String(configID)},
+			},
+		},
+	}
+	err := resolverSvc.ListResolverQueryLogConfigAssociationsPages(input,
+		func(page *route53resolver.ListResolverQueryLogConfigAssociationsOutput, lastPage bool) bool {
+			for _, association := range page.ResolverQueryLogConfigAssociations {
+				vpcIDs = append(vpcIDs, aws.StringValue(association.ResourceId))
+			}
+			return true
+		})
+	return vpcIDs, err
+}
+
+// bucketFromDestination splits the S3 destination ARN of a query logging
+// configuration (e.g., arn:aws:s3:::dns-logs-bucket/some/prefix) into bucket
+// name and prefix.
+func bucketFromDestination(destination string) (string, string) {
+	path := strings.TrimPrefix(destination, "arn:aws:s3:::")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func cmdResolver(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewResolverEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSResolverQueryLogs, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	resolverSvc := route53resolver.New(sess, nil)
+
+	configs, err := listQueryLogConfigs(resolverSvc)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, config := range configs {
+				fmt.Println(*config.Name)
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			configNames := args[1:]
+
+			// Use all available query logging configurations by
+			// default if none are provided.
+			if len(configNames) == 0 {
+				for _, config := range configs {
+					configNames = append(configNames, *config.Name)
+				}
+			}
+
+			configsByName := make(map[string]*route53resolver.ResolverQueryLogConfig, len(configs))
+			for _, config := range configs {
+				configsByName[*config.Name] = config
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSResolverQueryLogs)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewResolverEventParser(opt))
+
+			// For now, just run one goroutine per-VPC
+			for _, name := range configNames {
+				logrus.WithFields(logrus.Fields{
+					"name": name,
+				}).Info("Attempting to ingest query logging configuration")
+
+				config, ok := configsByName[name]
+				if !ok {
+					fmt.Fprintf(os.Stderr, `Query logging configuration %q was not found or does not log to S3. Try using ls to list available configurations.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/Route53/latest/DeveloperGuide/resolver-query-logs.html
+`, name)
+					os.Exit(1)
+				}
+
+				vpcIDs, err := associatedVPCs(resolverSvc, *config.Id)
+				if err != nil {
+					return err
+				}
+				if len(vpcIDs) == 0 {
+					logrus.WithField("name", name).Warn("No VPCs are associated with query logging configuration, skipping")
+					continue
+				}
+
+				bucket, prefix := bucketFromDestination(*config.DestinationArn)
+
+				logrus.WithFields(logrus.Fields{
+					"bucket": bucket,
+					"name":   name,
+					"vpcs":   vpcIDs,
+				}).Info("Query logging to S3 is enabled ♥")
+
+				for _, vpcID := range vpcIDs {
+					resolverDownloader := logbucket.NewResolverQueryLogDownloader(sess, bucket, prefix, vpcID)
+					downloader := logbucket.NewDownloader(sess, stater, resolverDownloader, opt, election, shard)
+					sd.Go(func(ctx context.Context) {
+						downloader.Download(ctx, downloadsCh)
+					})
+				}
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-resolver-query-logs"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeyresolver version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [query logging configuration names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdResolver(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeys3/" + versionStr
+}
+
+// loggingBuckets returns the server access logging configuration of every
+// bucket in the session's region which has logging enabled, keyed by bucket
+// name. Logs are always delivered to a bucket in the same region as the
+// source bucket, so buckets in other regions are skipped.
+func loggingBuckets(sess *session.Session, s3Svc *s3.S3) (map[string]*s3.LoggingEnabled, []string, error) {
+	listBucketsResp, err := s3Svc.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configs := make(map[string]*s3.LoggingEnabled)
+	var names []string
+	for _, bucket := range listBucketsResp.Buckets {
+		region, err := s3manager.GetBucketRegionWithClient(aws.BackgroundContext(), s3Svc, *bucket.Name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"bucket": *bucket.Name,
+				"error":  err,
+			}).Debug("Couldn't determine bucket region, skipping")
+			continue
+		}
+		if region != *sess.Config.Region {
+			continue
+		}
+
+		loggingResp, err := s3Svc.GetBucketLogging(&s3.GetBucketLoggingInput{
+			Bucket: bucket.Name,
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"bucket": *bucket.Name,
+				"error":  err,
+			}).Debug("Couldn't get bucket logging configuration, skipping")
+			continue
+		}
+		if loggingResp.LoggingEnabled == nil {
+			continue
+		}
+
+		configs[*bucket.Name] = loggingResp.LoggingEnabled
+		names = append(names, *bucket.Name)
+	}
+
+	return configs, names, nil
+}
+
+func cmdS3(args []string) error {
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSS3, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	s3Svc := s3.New(sess, nil)
+
+	loggingConfigs, bucketNames, err := loggingBuckets(sess, s3Svc)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, name := range bucketNames {
+				fmt.Println(name)
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			sourceBuckets := args[1:]
+
+			// Use all buckets with server access logging enabled by
+			// default if none are provided.
+			if len(sourceBuckets) == 0 {
+				sourceBuckets = bucketNames
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSS3)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewS3EventParser(opt))
+
+			// Several buckets commonly log to the same target bucket
+			// and prefix. With the simple key format their objects
+			// are indistinguishable by name, so only download each
+			// target location once.
+			watchedTargets := make(map[string]bool)
+
+			// For now, just run one goroutine per-bucket
+			for _, sourceBucket := range sourceBuckets {
+				logrus.WithFields(logrus.Fields{
+					"bucket": sourceBucket,
+				}).Info("Attempting to ingest S3 server access logs")
+
+				loggingConfig, ok := loggingConfigs[sourceBucket]
+				if !ok {
+					fmt.Fprintf(os.Stderr, `Server access logs are not configured for S3 bucket %q (or it is not in this region). Please enable them to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/AmazonS3/latest/userguide/enable-server-access-logging.html
+`, sourceBucket)
+					os.Exit(1)
+				}
+
+				partitioned := loggingConfig.TargetObjectKeyFormat != nil &&
+					loggingConfig.TargetObjectKeyFormat.PartitionedPrefix != nil
+				targetBucket := aws.StringValue(loggingConfig.TargetBucket)
+				targetPrefix := aws.StringValue(loggingConfig.TargetPrefix)
+
+				if !partitioned {
+					target := targetBucket + "/" + targetPrefix
+					if watchedTargets[target] {
+						logrus.WithFields(logrus.Fields{
+							"bucket": sourceBucket,
+							"target": target,
+						}).Info("Server access logs for S3 bucket are already being ingested from the same target")
+						continue
+					}
+					watchedTargets[target] = true
+				}
+
+				logrus.WithFields(logrus.Fields{
+					"bucket":       sourceBucket,
+					"targetBucket": targetBucket,
+				}).Info("Server access logs are enabled for S3 bucket ♥")
+
+				s3Downloader := logbucket.NewS3AccessLogDownloader(sess, targetBucket, targetPrefix, sourceBucket, partitioned)
+				downloader := logbucket.NewDownloader(sess, stater, s3Downloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-s3-access"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeys3 version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|state] [S3 bucket names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdS3(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeyvpcflow/" + versionStr
+}
+
+// bucketFromDestination splits the S3 destination ARN of a flow log (e.g.,
+// arn:aws:s3:::my-bucket/some/prefix) into bucket name and prefix.
+func bucketFromDestination(destination string) (string, string) {
+	path := strings.TrimPrefix(destination, "arn:aws:s3:::")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func cmdVPCFlow(args []string) error {
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSVPCFlowLogs, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	ec2Svc := ec2.New(sess, nil)
+
+	// Only flow logs delivered to S3 can be ingested, so don't bother
+	// listing the ones going to CloudWatch Logs or Kinesis Data Firehose.
+	var flowLogs []*ec2.FlowLog
+	err := ec2Svc.DescribeFlowLogsPages(&ec2.DescribeFlowLogsInput{
+		Filter: []*ec2.Filter{
+			{
+				Name:   aws.String("log-destination-type"),
+				Values: aws.StringSlice([]string{ec2.LogDestinationTypeS3}),
+			},
+		},
+	}, func(resp *ec2.DescribeFlowLogsOutput, lastPage bool) bool {
+		flowLogs = append(flowLogs, resp.FlowLogs...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, flowLog := range flowLogs {
+				fmt.Printf("%s\t%s\n", *flowLog.FlowLogId, aws.StringValue(flowLog.ResourceId))
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			flowLogIDs := args[1:]
+
+			// Use all available flow logs by default if none are
+			// provided.
+			if len(flowLogIDs) == 0 {
+				for _, flowLog := range flowLogs {
+					flowLogIDs = append(flowLogIDs, *flowLog.FlowLogId)
+				}
+			}
+
+			flowLogsByID := make(map[string]*ec2.FlowLog, len(flowLogs))
+			for _, flowLog := range flowLogs {
+				flowLogsByID[*flowLog.FlowLogId] = flowLog
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSVPCFlowLogs)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewVPCFlowLogEventParser(opt))
+
+			// For now, just run one goroutine per-flow log
+			for _, id := range flowLogIDs {
+				logrus.WithFields(logrus.Fields{
+					"id": id,
+				}).Info("Attempting to ingest VPC flow log")
+
+				flowLog, ok := flowLogsByID[id]
+				if !ok {
+					fmt.Fprintf(os.Stderr, `Flow log %q was not found or is not delivered to S3. Please deliver it to S3 to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/vpc/latest/userguide/flow-logs-s3.html
+`, id)
+					os.Exit(1)
+				}
+
+				// The downloader only knows the default layout of
+				// plain text objects.
+				if destOpts := flowLog.DestinationOptions; destOpts != nil {
+					if aws.StringValue(destOpts.FileFormat) == ec2.DestinationFileFormatParquet ||
+						aws.BoolValue(destOpts.HiveCompatiblePartitions) ||
+						aws.BoolValue(destOpts.PerHourPartition) {
+						fmt.Fprintf(os.Stderr, "Flow log %q uses Parquet, Hive-compatible or per-hour partitioned objects, which are not supported. Please use the default plain text format.\n", id)
+						os.Exit(1)
+					}
+				}
+
+				bucket, prefix := bucketFromDestination(aws.StringValue(flowLog.LogDestination))
+
+				logrus.WithFields(logrus.Fields{
+					"bucket": bucket,
+					"id":     id,
+				}).Info("Flow logs are delivered to S3 ♥")
+
+				vpcFlowLogDownloader := logbucket.NewVPCFlowLogDownloader(sess, bucket, prefix, id)
+				downloader := logbucket.NewDownloader(sess, stater, vpcFlowLogDownloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-vpcflow-access"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeyvpcflow version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|state] [flow log IDs...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdVPCFlow(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
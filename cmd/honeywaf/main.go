@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/honeycombio/honeyaws/logbucket"
+	"github.com/honeycombio/honeyaws/logstream"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/shutdown"
+	"github.com/honeycombio/honeyaws/state"
+	libhoney "github.com/honeycombio/libhoney-go"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	opt        = &options.Options{}
+	BuildID    string
+	versionStr string
+)
+
+func init() {
+	// set the version string to our desired format
+	if BuildID == "" {
+		versionStr = "dev"
+	} else {
+		versionStr = BuildID
+	}
+
+	// init libhoney user agent properly
+	libhoney.UserAgentAddition = "honeywaf/" + versionStr
+}
+
+type webACL struct {
+	*wafv2.WebACLSummary
+	Scope string
+}
+
+// listWebACLs returns the regional web ACLs of the session's region. Web ACLs
+// for CloudFront can only be managed from us-east-1, so they are included
+// when running there.
+func listWebACLs(wafSvc *wafv2.WAFV2, region string) ([]webACL, error) {
+	scopes := []string{wafv2.ScopeRegional}
+	if region == "us-east-1" {
+		scopes = append(scopes, wafv2.ScopeCloudfront)
+	}
+
+	var acls []webACL
+	for _, scope := range scopes {
+		input := &wafv2.ListWebACLsInput{
+			Scope: aws.String(scope),
+		}
+		for {
+			resp, err := wafSvc.ListWebACLs(input)
+			if err != nil {
+				return nil, err
+			}
+			for _, summary := range resp.WebACLs {
+				acls = append(acls, webACL{summary, scope})
+			}
+			if resp.NextMarker == nil {
+				break
+			}
+			input.NextMarker = resp.NextMarker
+		}
+	}
+
+	return acls, nil
+}
+
+// bucketFromDestination splits the S3 destination ARN of a logging
+// configuration (e.g., arn:aws:s3:::aws-waf-logs-bucket/some/prefix) into
+// bucket name and prefix.
+func bucketFromDestination(destination string) (string, string) {
+	path := strings.TrimPrefix(destination, "arn:aws:s3:::")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func cmdWAF(args []string) error {
+	// Logs pushed by Kinesis Data Firehose don't require looking anything
+	// up in AWS, so serve before creating a session.
+	if len(args) > 0 && args[0] == "serve" {
+		if opt.WriteKey == "" {
+			logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+		}
+
+		// Deliveries are acknowledged to Firehose rather than
+		// tracked, so there is no state to keep.
+		p := publisher.NewHoneycombPublisher(opt, nil, publisher.NewWAFEventParser(opt))
+		sd := shutdown.New(opt)
+		if err := logstream.ServeFirehose(sd.Stopping, opt, p, true); err != nil {
+			return err
+		}
+		sd.Finish(nil, nil, p)
+		return nil
+	}
+
+	// TODO: Would be nice to have this more highly configurable.
+	//
+	// Will just use environment config right now, e.g., default profile.
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if len(args) > 0 && args[0] == "state" {
+		stater, err := state.NewCommandStaterFromOptions(opt, sess, logbucket.AWSWAF, args[1:])
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+		}
+		return state.RunCommand(stater, args[1:], os.Stdin, os.Stdout)
+	}
+
+	wafSvc := wafv2.New(sess, nil)
+
+	acls, err := listWebACLs(wafSvc, *sess.Config.Region)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls", "list":
+			for _, acl := range acls {
+				fmt.Println(*acl.Name)
+			}
+
+			return nil
+
+		case "ingest":
+			if opt.WriteKey == "" {
+				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+			}
+
+			aclNames := args[1:]
+
+			// Use all available web ACLs by default if none are
+			// provided.
+			if len(aclNames) == 0 {
+				for _, acl := range acls {
+					aclNames = append(aclNames, *acl.Name)
+				}
+			}
+
+			aclsByName := make(map[string]webACL, len(acls))
+			for _, acl := range acls {
+				aclsByName[*acl.Name] = acl
+			}
+
+			var stater state.Stater
+
+			if opt.BackfillHr < 1 || opt.BackfillHr > 168 {
+				logrus.WithField("hours", opt.BackfillHr).Fatal("--backfill requires an hour input between 1 and 168")
+			}
+
+			stater, err = state.NewStaterFromOptions(opt, sess, logbucket.AWSWAF)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up state tracking")
+			}
+			election, err := state.NewElectionFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't set up leader election")
+			}
+			shard, err := state.NewShardFromOptions(opt, stater)
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Couldn't join the other replicas")
+			}
+			logrus.WithField("hours", time.Duration(opt.BackfillHr)*time.Hour).Debug("Backfill will be")
+
+			downloadsCh := make(chan state.DownloadedObject)
+			sd := shutdown.New(opt)
+			defaultPublisher := publisher.NewHoneycombPublisher(opt, stater, publisher.NewWAFEventParser(opt))
+
+			// For now, just run one goroutine per-web ACL
+			for _, name := range aclNames {
+				logrus.WithFields(logrus.Fields{
+					"name": name,
+				}).Info("Attempting to ingest web ACL")
+
+				acl, ok := aclsByName[name]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Web ACL %q was not found. Try using ls to list available web ACLs.\n", name)
+					os.Exit(1)
+				}
+
+				bucket, prefix := "", ""
+				loggingResp, err := wafSvc.GetLoggingConfiguration(&wafv2.GetLoggingConfigurationInput{
+					ResourceArn: acl.ARN,
+				})
+				if err == nil {
+					for _, destination := range loggingResp.LoggingConfiguration.LogDestinationConfigs {
+						if strings.HasPrefix(*destination, "arn:aws:s3:::") {
+							bucket, prefix = bucketFromDestination(*destination)
+						}
+					}
+				}
+
+				if bucket == "" {
+					fmt.Fprintf(os.Stderr, `Logging to S3 is not configured for web ACL %q. Please enable it to use the ingest tool.
+
+For reference see this link:
+
+https://docs.aws.amazon.com/waf/latest/developerguide/logging-s3.html
+`, name)
+					os.Exit(1)
+				}
+
+				logrus.WithFields(logrus.Fields{
+					"bucket": bucket,
+					"name":   name,
+				}).Info("Logging to S3 is enabled for web ACL ♥")
+
+				region := *sess.Config.Region
+				if acl.Scope == wafv2.ScopeCloudfront {
+					region = "cloudfront"
+				}
+
+				wafDownloader := logbucket.NewWAFDownloader(sess, bucket, prefix, name, region)
+				downloader := logbucket.NewDownloader(sess, stater, wafDownloader, opt, election, shard)
+				sd.Go(func(ctx context.Context) {
+					downloader.Download(ctx, downloadsCh)
+				})
+			}
+
+			sd.Publish(defaultPublisher, downloadsCh)
+
+			// Run until SIGINT or SIGTERM, then finish the objects
+			// in flight before exiting.
+			sd.Wait()
+			sd.Finish(stater, shard, defaultPublisher)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Subcommand %q not recognized", args[0])
+}
+
+func main() {
+	flagParser := flag.NewParser(opt, flag.Default)
+	args, err := flagParser.Parse()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if opt.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	formatter := &logrus.TextFormatter{
+		FullTimestamp: true,
+	}
+	logrus.SetFormatter(formatter)
+
+	logrus.WithField("version", BuildID).Debug("Program starting")
+
+	if opt.Dataset == "aws-$SERVICE-access" {
+		opt.Dataset = "aws-waf-access"
+	}
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
+	}
+
+	if opt.Version {
+		fmt.Println("honeywaf version", versionStr)
+		os.Exit(0)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|serve|state] [web ACL names...]
+
+Use '`+os.Args[0]+` --help' to see available flags.`)
+		os.Exit(1)
+	}
+
+	if err := cmdWAF(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+}
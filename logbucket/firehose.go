@@ -0,0 +1,51 @@
+package logbucket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+)
+
+// DeliveryStreamNameFromARN returns the name of the Firehose delivery stream
+// in a log destination ARN, e.g.
+// arn:aws:firehose:us-east-1:123456789012:deliverystream/amazon-apigateway-logs
+func DeliveryStreamNameFromARN(arn string) (string, bool) {
+	if !strings.HasPrefix(arn, "arn:aws:firehose:") {
+		return "", false
+	}
+	i := strings.Index(arn, ":deliverystream/")
+	if i < 0 {
+		return "", false
+	}
+	return arn[i+len(":deliverystream/"):], true
+}
+
+// DeliveryStreamBucket looks up the S3 bucket and prefix a Firehose delivery
+// stream writes to.
+func DeliveryStreamBucket(sess *session.Session, streamName string) (string, string, error) {
+	firehoseSvc := firehose.New(sess, nil)
+
+	resp, err := firehoseSvc.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(streamName),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, destination := range resp.DeliveryStreamDescription.Destinations {
+		var bucketARN, prefix *string
+		if d := destination.ExtendedS3DestinationDescription; d != nil {
+			bucketARN, prefix = d.BucketARN, d.Prefix
+		} else if d := destination.S3DestinationDescription; d != nil {
+			bucketARN, prefix = d.BucketARN, d.Prefix
+		}
+		if bucketARN != nil {
+			return strings.TrimPrefix(*bucketARN, "arn:aws:s3:::"), aws.StringValue(prefix), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("delivery stream %q does not deliver to S3", streamName)
+}
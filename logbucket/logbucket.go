@@ -1,10 +1,16 @@
 package logbucket
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/honeycombio/honeyaws/meta"
+	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/state"
 	"github.com/sirupsen/logrus"
 )
@@ -21,10 +28,27 @@ const (
 	AWSElasticLoadBalancingV2 = "elasticloadbalancingv2"
 	AWSCloudFront             = "cloudfront"
 	AWSCloudTrail             = "cloudtrail"
+	AWSVPCFlowLogs            = "vpcflowlogs"
+	AWSS3                     = "s3"
+	AWSWAF                    = "waf"
+	AWSAPIGateway             = "apigateway"
+	AWSCloudWatchLogs         = "cloudwatchlogs"
+	AWSResolverQueryLogs      = "vpcdnsquerylogs"
+	AWSNetworkFirewall        = "network-firewall"
+	AWSGlobalAccelerator      = "globalaccelerator"
 	alb                       = "alb"
 	elb                       = "elb"
+
+	// Load balancer types as they appear in elasticloadbalancingv2 log
+	// object names.
+	LBTypeApplication = "app"
+	LBTypeNetwork     = "net"
 )
 
+// queuePollInterval is how long a replica waits before looking at the queue of
+// an entity again when it's empty.
+const queuePollInterval = 10 * time.Second
+
 type ObjectDownloader interface {
 	fmt.Stringer
 
@@ -45,16 +69,46 @@ type Downloader struct {
 	DownloadedObjects chan state.DownloadedObject
 	ObjectsToDownload chan *s3.Object
 	BackfillInterval  time.Duration
+	// Election, if it isn't nil, elects one replica to list the bucket,
+	// which hands the objects it finds to every replica (including
+	// itself) through the queue of the entity.
+	Election *state.Election
+	// Shard, if it isn't nil, only lets the replica which owns the entity
+	// list the bucket.
+	Shard *state.Shard
+	// Checkpoints is set when the offsets of objects in progress are
+	// recorded, so that they're resumed if they're interrupted.
+	Checkpoints bool
+	// Owner identifies this replica in the offsets of objects in progress.
+	Owner string
+	// OffsetLease is how long after another replica last recorded the
+	// offset of an object in progress it's taken to have abandoned it.
+	OffsetLease time.Duration
+	// resuming holds the objects which were in progress when we started,
+	// or which other replicas have abandoned since, if the Stater is a
+	// state.OffsetStater and Checkpoints is set, until they're listed again.
+	resuming map[string]bool
+	// leading is set while this replica holds the lease of the entity.
+	leading int32
 }
 
-func NewDownloader(sess *session.Session, stater state.Stater, downloader ObjectDownloader, backfill int) *Downloader {
+func NewDownloader(sess *session.Session, stater state.Stater, downloader ObjectDownloader, opt *options.Options, election *state.Election, shard *state.Shard) *Downloader {
+	owner, err := state.ReplicaID()
+	if err != nil {
+		logrus.Error(err)
+	}
 	return &Downloader{
 		Stater:            stater,
 		ObjectDownloader:  downloader,
 		Sess:              sess,
 		DownloadedObjects: make(chan state.DownloadedObject),
 		ObjectsToDownload: make(chan *s3.Object),
-		BackfillInterval:  time.Hour * time.Duration(backfill),
+		BackfillInterval:  time.Hour * time.Duration(opt.BackfillHr),
+		Election:          election,
+		Shard:             shard,
+		Checkpoints:       opt.CheckpointInterval > 0,
+		Owner:             owner,
+		OffsetLease:       state.OffsetLease,
 	}
 }
 
@@ -66,6 +120,10 @@ type ALBDownloader struct {
 	*ELBDownloader
 }
 
+type ALBConnectionDownloader struct {
+	*ELBDownloader
+}
+
 type CloudFrontDownloader struct {
 	Prefix, BucketName, DistributionID string
 }
@@ -74,6 +132,48 @@ type CloudTrailDownloader struct {
 	Prefix, BucketName, AccountID, Region, TrailID string
 }
 
+type VPCFlowLogDownloader struct {
+	Prefix, BucketName, AccountID, Region, FlowLogID string
+}
+
+type ResolverQueryLogDownloader struct {
+	Prefix, BucketName, AccountID, VPCID string
+}
+
+type NetworkFirewallDownloader struct {
+	Prefix, BucketName, AccountID, Region, FirewallName string
+	// LogType is the lower case type of the logs, "alert" or "flow".
+	LogType string
+}
+
+type GlobalAcceleratorDownloader struct {
+	Prefix, BucketName, AccountID, Region, AcceleratorID string
+}
+
+type WAFDownloader struct {
+	Prefix, BucketName, AccountID, Region, WebACLName string
+}
+
+// FirehoseDownloader downloads objects written to S3 by a Kinesis Data
+// Firehose delivery stream, for services that can only deliver their logs
+// through Firehose.
+type FirehoseDownloader struct {
+	Prefix, BucketName, DeliveryStreamName string
+}
+
+// CloudWatchLogsExportDownloader downloads the objects written by a CloudWatch
+// Logs export task, one or more per log stream.
+type CloudWatchLogsExportDownloader struct {
+	Prefix, BucketName, TaskID string
+}
+
+type S3AccessLogDownloader struct {
+	Prefix, BucketName, AccountID, Region, SourceBucket string
+	// Partitioned is set when the source bucket uses the date-based
+	// partitioned prefix key format instead of the simple one.
+	Partitioned bool
+}
+
 func NewCloudTrailDownloader(sess *session.Session, bucketName, bucketPrefix, trailID string) *CloudTrailDownloader {
 	metadata := meta.Data(sess)
 	return &CloudTrailDownloader{
@@ -100,6 +200,205 @@ func (d *CloudTrailDownloader) Bucket() string {
 	return d.BucketName
 }
 
+func NewVPCFlowLogDownloader(sess *session.Session, bucketName, bucketPrefix, flowLogID string) *VPCFlowLogDownloader {
+	metadata := meta.Data(sess)
+	return &VPCFlowLogDownloader{
+		AccountID:  metadata.AccountID,
+		Region:     metadata.Region,
+		BucketName: bucketName,
+		Prefix:     bucketPrefix,
+		FlowLogID:  flowLogID,
+	}
+}
+
+func (d *VPCFlowLogDownloader) ObjectPrefix(day time.Time) string {
+	dayPath := day.Format("2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs", d.AccountID, AWSVPCFlowLogs, d.Region, dayPath,
+		d.AccountID+"_"+AWSVPCFlowLogs+"_"+d.Region+"_"+d.FlowLogID)
+}
+
+func (d *VPCFlowLogDownloader) String() string {
+	return d.FlowLogID
+}
+
+func (d *VPCFlowLogDownloader) Bucket() string {
+	return d.BucketName
+}
+
+func NewResolverQueryLogDownloader(sess *session.Session, bucketName, bucketPrefix, vpcID string) *ResolverQueryLogDownloader {
+	metadata := meta.Data(sess)
+	return &ResolverQueryLogDownloader{
+		AccountID:  metadata.AccountID,
+		BucketName: bucketName,
+		Prefix:     bucketPrefix,
+		VPCID:      vpcID,
+	}
+}
+
+func (d *ResolverQueryLogDownloader) ObjectPrefix(day time.Time) string {
+	dayPath := day.Format("2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs", d.AccountID, AWSResolverQueryLogs, d.VPCID, dayPath)
+}
+
+func (d *ResolverQueryLogDownloader) String() string {
+	return d.VPCID
+}
+
+func (d *ResolverQueryLogDownloader) Bucket() string {
+	return d.BucketName
+}
+
+func NewNetworkFirewallDownloader(sess *session.Session, bucketName, bucketPrefix, firewallName, logType string) *NetworkFirewallDownloader {
+	metadata := meta.Data(sess)
+	return &NetworkFirewallDownloader{
+		AccountID:    metadata.AccountID,
+		Region:       metadata.Region,
+		BucketName:   bucketName,
+		Prefix:       bucketPrefix,
+		FirewallName: firewallName,
+		LogType:      strings.ToLower(logType),
+	}
+}
+
+func (d *NetworkFirewallDownloader) ObjectPrefix(day time.Time) string {
+	dayPath := day.Format("2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs", d.AccountID, AWSNetworkFirewall, d.LogType, d.Region, d.FirewallName, dayPath)
+}
+
+func (d *NetworkFirewallDownloader) String() string {
+	return d.FirewallName + "/" + d.LogType
+}
+
+func (d *NetworkFirewallDownloader) Bucket() string {
+	return d.BucketName
+}
+
+// Global Accelerator is a global service, but its flow logs (like its API) are
+// in us-west-2.
+func NewGlobalAcceleratorDownloader(sess *session.Session, bucketName, bucketPrefix, acceleratorID string) *GlobalAcceleratorDownloader {
+	metadata := meta.Data(sess)
+	return &GlobalAcceleratorDownloader{
+		AccountID:     metadata.AccountID,
+		Region:        "us-west-2",
+		BucketName:    bucketName,
+		Prefix:        bucketPrefix,
+		AcceleratorID: acceleratorID,
+	}
+}
+
+func (d *GlobalAcceleratorDownloader) ObjectPrefix(day time.Time) string {
+	dayPath := day.Format("2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs", d.AccountID, AWSGlobalAccelerator, d.Region, dayPath,
+		d.AccountID+"_"+AWSGlobalAccelerator+"_"+d.AcceleratorID)
+}
+
+func (d *GlobalAcceleratorDownloader) String() string {
+	return d.AcceleratorID
+}
+
+func (d *GlobalAcceleratorDownloader) Bucket() string {
+	return d.BucketName
+}
+
+// Web ACLs for CloudFront are global, their logs use "cloudfront" in place of
+// the region.
+func NewWAFDownloader(sess *session.Session, bucketName, bucketPrefix, webACLName, region string) *WAFDownloader {
+	metadata := meta.Data(sess)
+	return &WAFDownloader{
+		AccountID:  metadata.AccountID,
+		Region:     region,
+		BucketName: bucketName,
+		Prefix:     bucketPrefix,
+		WebACLName: webACLName,
+	}
+}
+
+func (d *WAFDownloader) ObjectPrefix(day time.Time) string {
+	dayPath := day.Format("2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs", d.AccountID, "WAFLogs", d.Region, d.WebACLName, dayPath)
+}
+
+func (d *WAFDownloader) String() string {
+	return d.WebACLName
+}
+
+func (d *WAFDownloader) Bucket() string {
+	return d.BucketName
+}
+
+func NewFirehoseDownloader(bucketName, bucketPrefix, deliveryStreamName string) *FirehoseDownloader {
+	return &FirehoseDownloader{
+		BucketName:         bucketName,
+		Prefix:             bucketPrefix,
+		DeliveryStreamName: deliveryStreamName,
+	}
+}
+
+// Firehose appends the UTC "YYYY/MM/DD/HH/" prefix to the configured one as
+// is, without adding a separator.
+func (d *FirehoseDownloader) ObjectPrefix(day time.Time) string {
+	return d.Prefix + day.Format("2006/01/02")
+}
+
+func (d *FirehoseDownloader) String() string {
+	return d.DeliveryStreamName
+}
+
+func (d *FirehoseDownloader) Bucket() string {
+	return d.BucketName
+}
+
+func NewCloudWatchLogsExportDownloader(bucketName, bucketPrefix, taskID string) *CloudWatchLogsExportDownloader {
+	return &CloudWatchLogsExportDownloader{
+		BucketName: bucketName,
+		Prefix:     bucketPrefix,
+		TaskID:     taskID,
+	}
+}
+
+// An export task writes all of its objects at once, so the day doesn't matter.
+func (d *CloudWatchLogsExportDownloader) ObjectPrefix(day time.Time) string {
+	return path.Join(d.Prefix, d.TaskID) + "/"
+}
+
+func (d *CloudWatchLogsExportDownloader) String() string {
+	return d.TaskID
+}
+
+func (d *CloudWatchLogsExportDownloader) Bucket() string {
+	return d.BucketName
+}
+
+func NewS3AccessLogDownloader(sess *session.Session, bucketName, bucketPrefix, sourceBucket string, partitioned bool) *S3AccessLogDownloader {
+	metadata := meta.Data(sess)
+	return &S3AccessLogDownloader{
+		AccountID:    metadata.AccountID,
+		Region:       metadata.Region,
+		BucketName:   bucketName,
+		Prefix:       bucketPrefix,
+		SourceBucket: sourceBucket,
+		Partitioned:  partitioned,
+	}
+}
+
+// The target prefix of S3 server access logs is used as-is rather than as a
+// directory, e.g. a prefix of "logs-" results in objects named
+// "logs-2018-08-20-...".
+func (d *S3AccessLogDownloader) ObjectPrefix(day time.Time) string {
+	if d.Partitioned {
+		return d.Prefix + path.Join(d.AccountID, d.Region, d.SourceBucket, day.Format("2006/01/02"))
+	}
+	return d.Prefix + day.Format("2006-01-02")
+}
+
+func (d *S3AccessLogDownloader) String() string {
+	return d.SourceBucket
+}
+
+func (d *S3AccessLogDownloader) Bucket() string {
+	return d.BucketName
+}
+
 func NewCloudFrontDownloader(bucketName, bucketPrefix, distID string) *CloudFrontDownloader {
 	return &CloudFrontDownloader{
 		BucketName:     bucketName,
@@ -147,13 +446,45 @@ func (d *ELBDownloader) Bucket() string {
 }
 
 func NewALBDownloader(sess *session.Session, bucketName, bucketPrefix, lbName string) *ALBDownloader {
-	return &ALBDownloader{NewELBDownloader(sess, bucketName, bucketPrefix, lbName)}
+	d := &ALBDownloader{NewELBDownloader(sess, bucketName, bucketPrefix, lbName)}
+	d.LBType = LBTypeApplication
+	return d
+}
+
+// NLBs write their (TLS) access logs using the same layout as ALBs, only
+// with a different load balancer type in the object name.
+func NewNLBDownloader(sess *session.Session, bucketName, bucketPrefix, lbName string) *ALBDownloader {
+	d := &ALBDownloader{NewELBDownloader(sess, bucketName, bucketPrefix, lbName)}
+	d.LBType = LBTypeNetwork
+	return d
 }
 
 func (d *ALBDownloader) ObjectPrefix(day time.Time) string {
+	lbType := d.LBType
+	if lbType == "" {
+		lbType = LBTypeApplication
+	}
+	dayPath := day.Format("/2006/01/02")
+	return filepath.Join(d.Prefix, "AWSLogs/", d.AccountID, AWSElasticLoadBalancing, d.Region+dayPath,
+		d.AccountID+"_"+AWSElasticLoadBalancing+"_"+d.Region+"_"+lbType+"."+d.LBName)
+}
+
+func NewALBConnectionDownloader(sess *session.Session, bucketName, bucketPrefix, lbName string) *ALBConnectionDownloader {
+	return &ALBConnectionDownloader{NewELBDownloader(sess, bucketName, bucketPrefix, lbName)}
+}
+
+// String is distinct from the access logs of the same ALB, so that the two
+// have their own leases and work queues.
+func (d *ALBConnectionDownloader) String() string {
+	return d.LBName + "/conn"
+}
+
+// Connection logs live alongside the access logs, but their object names
+// are prefixed with "conn_log.".
+func (d *ALBConnectionDownloader) ObjectPrefix(day time.Time) string {
 	dayPath := day.Format("/2006/01/02")
 	return filepath.Join(d.Prefix, "AWSLogs/", d.AccountID, AWSElasticLoadBalancing, d.Region+dayPath,
-		d.AccountID+"_"+AWSElasticLoadBalancing+"_"+d.Region+"_app."+d.LBName)
+		"conn_log."+d.AccountID+"_"+AWSElasticLoadBalancing+"_"+d.Region+"_app."+d.LBName)
 }
 
 func (d *Downloader) downloadObject(obj *s3.Object) error {
@@ -204,28 +535,54 @@ func (d *Downloader) downloadObjects() {
 	}
 }
 
-func (d *Downloader) accessLogBucketPageCallback(processedObjects map[string]time.Time, bucketResp *s3.ListObjectsOutput, lastPage bool) bool {
+// accessLogBucketPageCallback claims and dispatches the objects of a page of
+// the objects listed under prefix.
+func (d *Downloader) accessLogBucketPageCallback(ctx context.Context, prefix string, processedObjects map[string]time.Time, bucketResp *s3.ListObjectsOutput, lastPage bool) bool {
 	logrus.WithFields(logrus.Fields{
 		"objects":   len(bucketResp.Contents),
 		"truncated": *bucketResp.IsTruncated,
 	}).Debug("Start S3 bucket page")
 	for _, obj := range bucketResp.Contents {
+		// Stop claiming objects once we're shutting down, the rest
+		// are left for the next time the bucket is listed.
+		if ctx.Err() != nil {
+			return false
+		}
+
 		_, ok := processedObjects[*obj.Key]
 
+		if ok && d.resuming[*obj.Key] {
+			// Processing of the object was interrupted, download
+			// it again so that it can pick up where it left off.
+			delete(d.resuming, *obj.Key)
+			logrus.WithField("object", *obj.Key).Info("Resuming object which was in progress")
+			d.takeOver(*obj.Key)
+			d.dispatch(obj)
+			continue
+		}
+
 		if ok {
 			logrus.WithField("object", *obj.Key).Debug("Already processed, skipping")
 			continue
 		}
 
 		if time.Since(*obj.LastModified) < d.BackfillInterval {
-			if err := d.SetProcessed(*obj.Key); err != nil {
+			if err := d.claim(prefix, *obj.Key); err != nil {
 				logrus.Debug("Error setting state of object as processed: ", *obj.Key)
 				continue
 			}
+			if offsetStater, ok := d.offsetStater(); ok {
+				if err := offsetStater.SetOffset(*obj.Key, 0); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"object": *obj.Key,
+						"error":  err,
+					}).Error("Error setting state of object as in progress")
+				}
+			}
 			// we want to set the object as processed as
 			// soon as it's ready to downloaded
 			// to avoid duplicates in downloading
-			d.ObjectsToDownload <- obj
+			d.dispatch(obj)
 		}
 	}
 
@@ -233,14 +590,261 @@ func (d *Downloader) accessLogBucketPageCallback(processedObjects map[string]tim
 
 	return true
 }
-func (d *Downloader) pollObjects() {
+
+// claim sets an object listed under prefix as processed, which fails if
+// another replica has already done so.
+func (d *Downloader) claim(prefix, object string) error {
+	if prefixStater, ok := d.Stater.(state.PrefixStater); ok {
+		return prefixStater.SetProcessedWithPrefix(prefix, object)
+	}
+	return d.SetProcessed(object)
+}
+
+// dispatch hands an object to a replica to download, which is this one unless
+// there's an election.
+func (d *Downloader) dispatch(obj *s3.Object) {
+	if d.Election != nil {
+		item, err := json.Marshal(obj)
+		if err == nil {
+			err = d.Election.Enqueue(d.String(), string(item))
+		}
+		if err == nil {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"object": *obj.Key,
+			"error":  err,
+		}).Error("Error queueing object, downloading it here instead")
+	}
+	d.ObjectsToDownload <- obj
+}
+
+// dequeueObjects downloads the objects queued by the leader of the entity, one
+// at a time so that they're spread between the replicas, until ctx is done.
+func (d *Downloader) dequeueObjects(ctx context.Context) {
+	for ctx.Err() == nil {
+		item, ok, err := d.Election.Dequeue(d.String())
+		if err != nil {
+			logrus.WithField("entity", d.String()).Error(err)
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-time.After(queuePollInterval):
+			}
+			continue
+		}
+
+		obj := &s3.Object{}
+		if err := json.Unmarshal([]byte(item), obj); err != nil || obj.Key == nil {
+			logrus.WithFields(logrus.Fields{
+				"item":  item,
+				"error": err,
+			}).Error("Skipping malformed queued object")
+			d.ack(item)
+			continue
+		}
+
+		// The object is only acknowledged once this replica has taken
+		// it over from the leader, so that it's handed to another
+		// replica if this one goes away in between.
+		d.takeOver(*obj.Key)
+		d.ack(item)
+		d.ObjectsToDownload <- obj
+	}
+}
+
+// offsetStater returns the Stater as a state.OffsetStater if it is one and
+// Checkpoints is set.
+func (d *Downloader) offsetStater() (state.OffsetStater, bool) {
+	if !d.Checkpoints {
+		return nil, false
+	}
+	offsetStater, ok := d.Stater.(state.OffsetStater)
+	return offsetStater, ok
+}
+
+// takeOver records this replica as processing an object claimed by the
+// leader, so that it's resumed by this replica if it's interrupted.
+func (d *Downloader) takeOver(object string) {
+	offsetStater, ok := d.offsetStater()
+	if !ok {
+		return
+	}
+	offset, err := offsetStater.Offset(object)
+	if err == nil {
+		err = offsetStater.SetOffset(object, offset)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"object": object,
+			"error":  err,
+		}).Error("Error setting state of object as in progress")
+	}
+}
+
+func (d *Downloader) ack(item string) {
+	if err := d.Election.Ack(d.String(), item); err != nil {
+		logrus.WithField("entity", d.String()).Error(err)
+	}
+}
+
+// holdLease keeps trying to acquire or renew the lease of the entity, well
+// before it expires, and signals elected whenever this replica becomes the
+// leader. Once ctx is done it releases the lease, so that another replica can
+// take over straight away.
+func (d *Downloader) holdLease(ctx context.Context, elected chan<- struct{}) {
+	leading := false
+	for {
+		acquired, err := d.Election.AcquireLease(d.String(), d.Election.Holder, d.Election.TTL)
+		if err != nil {
+			logrus.WithField("entity", d.String()).Error(err)
+		}
+
+		if acquired && !leading {
+			logrus.WithFields(logrus.Fields{
+				"entity": d.String(),
+				"holder": d.Election.Holder,
+			}).Info("Elected leader, listing bucket")
+			select {
+			case elected <- struct{}{}:
+			default:
+			}
+		} else if !acquired && leading {
+			logrus.WithField("entity", d.String()).Info("No longer leader, only processing objects listed by the leader")
+		}
+		leading = acquired
+		if leading {
+			atomic.StoreInt32(&d.leading, 1)
+		} else {
+			atomic.StoreInt32(&d.leading, 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			if leading {
+				if err := d.Election.ReleaseLease(d.String(), d.Election.Holder); err != nil {
+					logrus.WithField("entity", d.String()).Error(err)
+				}
+			}
+			return
+		case <-time.After(d.Election.TTL / 3):
+		}
+	}
+}
+
+// listing returns whether this replica should list the bucket.
+func (d *Downloader) listing() bool {
+	if d.Shard != nil && !d.Shard.Owns(d.String()) {
+		return false
+	}
+	return d.Election == nil || atomic.LoadInt32(&d.leading) == 1
+}
+
+// loadResuming finds the objects in progress which this replica should resume
+// when they're listed: those it was processing itself, and those of replicas
+// which haven't recorded their offsets within OffsetLease. The objects of
+// replicas which are still processing them are left alone.
+func (d *Downloader) loadResuming() {
+	offsetStater, ok := d.offsetStater()
+	if !ok {
+		return
+	}
+	inProgress, err := offsetStater.InProgressObjects()
+	if err != nil {
+		logrus.Error(err)
+	}
+	d.resuming = make(map[string]bool, len(inProgress))
+	for obj, progress := range inProgress {
+		if progress.Abandoned(d.Owner, d.OffsetLease) {
+			d.resuming[obj] = true
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"object": obj,
+				"owner":  progress.Owner,
+			}).Debug("Object in progress on another replica, not resuming")
+		}
+	}
+}
+
+// resumeLapsed adds the objects in progress on other replicas which haven't
+// recorded their offsets within OffsetLease to those to resume, as those
+// replicas have presumably gone away since we started.
+func (d *Downloader) resumeLapsed() {
+	offsetStater, ok := d.offsetStater()
+	if !ok {
+		return
+	}
+	inProgress, err := offsetStater.InProgressObjects()
+	if err != nil {
+		logrus.Error(err)
+	}
+	for obj, progress := range inProgress {
+		if progress.Lapsed(d.Owner, d.OffsetLease) && !d.resuming[obj] {
+			logrus.WithFields(logrus.Fields{
+				"object": obj,
+				"owner":  progress.Owner,
+			}).Info("Object in progress on another replica was abandoned, resuming it")
+			d.resuming[obj] = true
+		}
+	}
+}
+
+// pollObjects lists the bucket for new objects to download until ctx is done.
+func (d *Downloader) pollObjects(ctx context.Context) {
 	// get new logs every 5 minutes
-	ticker := time.NewTicker(5 * time.Minute).C
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	// A replica which becomes the leader lists straight away, rather
+	// than waiting for the next tick.
+	elected := make(chan struct{}, 1)
+	if d.Election != nil {
+		released := make(chan struct{})
+		go func() {
+			d.holdLease(ctx, elected)
+			close(released)
+		}()
+		defer func() { <-released }()
+	}
+	// Likewise when the replicas change, in case the entity has moved to
+	// this one.
+	var rebalanced <-chan struct{}
+	if d.Shard != nil {
+		rebalanced = d.Shard.Watch()
+	}
+	listing := true
 
 	s3svc := s3.New(d.Sess, nil)
 
+	d.loadResuming()
+
 	// Start the loop to continually ingest access logs.
 	for {
+		if d.listing() != listing {
+			listing = !listing
+			if d.Shard != nil {
+				logrus.WithFields(logrus.Fields{
+					"entity":  d.String(),
+					"listing": listing,
+				}).Info("Entity rebalanced between replicas")
+			}
+		}
+		if !listing {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-elected:
+			case <-rebalanced:
+			}
+			continue
+		}
+
+		// Replicas may have gone away in the meantime, leaving
+		// objects part way through.
+		d.resumeLapsed()
+
 		// For now, get objects for just today.
 		totalPrefix := d.ObjectPrefix(time.Now().UTC())
 
@@ -249,29 +853,69 @@ func (d *Downloader) pollObjects() {
 			"entity": d.String(),
 		}).Info("Getting recent objects")
 
-		processedObjects, err := d.ProcessedObjects()
+		var processedObjects map[string]time.Time
+		var err error
+		// Only the objects under the prefix are listed, so they're all
+		// that need to be looked up if the Stater can do that cheaply.
+		if prefixStater, ok := d.Stater.(state.PrefixStater); ok {
+			processedObjects, err = prefixStater.ProcessedObjectsWithPrefix(totalPrefix)
+		} else {
+			processedObjects, err = d.ProcessedObjects()
+		}
 		if err != nil {
 			logrus.Error(err)
 		}
 
 		cb := func(bucketResp *s3.ListObjectsOutput, lastPage bool) bool {
-			return d.accessLogBucketPageCallback(processedObjects, bucketResp, lastPage)
+			return d.accessLogBucketPageCallback(ctx, totalPrefix, processedObjects, bucketResp, lastPage)
 		}
 
-		if err := s3svc.ListObjectsPages(&s3.ListObjectsInput{
+		if err := s3svc.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
 			Bucket: aws.String(d.Bucket()),
 			Prefix: aws.String(totalPrefix),
 		}, cb); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			fmt.Fprintln(os.Stderr, "Error listing/paging bucket objects: ", err)
 			os.Exit(1)
 		}
 		logrus.WithField("entity", d.String()).Info("Bucket polling paused until the next set of logs are available")
-		<-ticker
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-elected:
+		case <-rebalanced:
+		}
 	}
 }
 
-func (d *Downloader) Download(downloadedObjects chan state.DownloadedObject) {
+// Download lists and downloads the objects of the entity, sending them to
+// downloadedObjects, until ctx is done. It then stops listing, and returns
+// once the objects already claimed have been downloaded and sent, and the
+// lease of the entity (if any) has been released.
+func (d *Downloader) Download(ctx context.Context, downloadedObjects chan state.DownloadedObject) {
 	d.DownloadedObjects = downloadedObjects
-	go d.pollObjects()
-	go d.downloadObjects()
+
+	var listers sync.WaitGroup
+	listers.Add(1)
+	go func() {
+		defer listers.Done()
+		d.pollObjects(ctx)
+	}()
+	if d.Election != nil {
+		listers.Add(1)
+		go func() {
+			defer listers.Done()
+			d.dequeueObjects(ctx)
+		}()
+	}
+	go func() {
+		listers.Wait()
+		close(d.ObjectsToDownload)
+	}()
+
+	d.downloadObjects()
+	logrus.WithField("entity", d.String()).Info("Stopped downloading objects")
 }
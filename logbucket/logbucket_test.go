@@ -1,9 +1,16 @@
 package logbucket
 
 import (
+	"context"
 	"log"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/honeycombio/honeyaws/state"
 )
 
 func TestObjectPrefixes(t *testing.T) {
@@ -27,6 +34,25 @@ func TestObjectPrefixes(t *testing.T) {
 				LBName:     "service1",
 			},
 		}, "noslash/AWSLogs/12345/elasticloadbalancing/us-east-1/2018/08/20/12345_elasticloadbalancing_us-east-1_app.service1"},
+		{&ALBDownloader{
+			ELBDownloader: &ELBDownloader{
+				AccountID:  "12345",
+				Region:     "us-east-1",
+				BucketName: "mylogs",
+				Prefix:     "",
+				LBName:     "service1",
+				LBType:     LBTypeNetwork,
+			},
+		}, "AWSLogs/12345/elasticloadbalancing/us-east-1/2018/08/20/12345_elasticloadbalancing_us-east-1_net.service1"},
+		{&ALBConnectionDownloader{
+			ELBDownloader: &ELBDownloader{
+				AccountID:  "12345",
+				Region:     "us-east-1",
+				BucketName: "mylogs",
+				Prefix:     "",
+				LBName:     "service1",
+			},
+		}, "AWSLogs/12345/elasticloadbalancing/us-east-1/2018/08/20/conn_log.12345_elasticloadbalancing_us-east-1_app.service1"},
 		{&CloudFrontDownloader{
 			BucketName:     "mylogs",
 			Prefix:         "trailingslash/",
@@ -39,6 +65,66 @@ func TestObjectPrefixes(t *testing.T) {
 			Prefix:     "",
 			TrailID:    "MADEUP0",
 		}, "AWSLogs/12345/CloudTrail/us-east-1/2018/08/20/12345_CloudTrail_us-east-1"},
+		{&VPCFlowLogDownloader{
+			AccountID:  "12345",
+			Region:     "us-east-1",
+			BucketName: "mylogs",
+			Prefix:     "flows",
+			FlowLogID:  "fl-1234abcd",
+		}, "flows/AWSLogs/12345/vpcflowlogs/us-east-1/2018/08/20/12345_vpcflowlogs_us-east-1_fl-1234abcd"},
+		{&S3AccessLogDownloader{
+			AccountID:    "12345",
+			Region:       "us-east-1",
+			BucketName:   "mylogs",
+			Prefix:       "s3-",
+			SourceBucket: "mybucket",
+		}, "s3-2018-08-20"},
+		{&S3AccessLogDownloader{
+			AccountID:    "12345",
+			Region:       "us-east-1",
+			BucketName:   "mylogs",
+			Prefix:       "logs/",
+			SourceBucket: "mybucket",
+			Partitioned:  true,
+		}, "logs/12345/us-east-1/mybucket/2018/08/20"},
+		{&WAFDownloader{
+			AccountID:  "12345",
+			Region:     "cloudfront",
+			BucketName: "aws-waf-logs-mylogs",
+			Prefix:     "",
+			WebACLName: "my-acl",
+		}, "AWSLogs/12345/WAFLogs/cloudfront/my-acl/2018/08/20"},
+		{&ResolverQueryLogDownloader{
+			AccountID:  "12345",
+			BucketName: "mylogs",
+			Prefix:     "dns",
+			VPCID:      "vpc-0123456789abcdef0",
+		}, "dns/AWSLogs/12345/vpcdnsquerylogs/vpc-0123456789abcdef0/2018/08/20"},
+		{&NetworkFirewallDownloader{
+			AccountID:    "12345",
+			BucketName:   "mylogs",
+			Prefix:       "nfw",
+			Region:       "us-east-1",
+			FirewallName: "test-firewall",
+			LogType:      "alert",
+		}, "nfw/AWSLogs/12345/network-firewall/alert/us-east-1/test-firewall/2018/08/20"},
+		{&GlobalAcceleratorDownloader{
+			AccountID:     "12345",
+			BucketName:    "mylogs",
+			Prefix:        "ga",
+			Region:        "us-west-2",
+			AcceleratorID: "123e4567-e89b-12d3-a456-426655440000",
+		}, "ga/AWSLogs/12345/globalaccelerator/us-west-2/2018/08/20/12345_globalaccelerator_123e4567-e89b-12d3-a456-426655440000"},
+		{&FirehoseDownloader{
+			BucketName:         "mylogs",
+			Prefix:             "apigateway/",
+			DeliveryStreamName: "amazon-apigateway-mystream",
+		}, "apigateway/2018/08/20"},
+		{&CloudWatchLogsExportDownloader{
+			BucketName: "mylogs",
+			Prefix:     "exports",
+			TaskID:     "0b4b7e8f-2a2e-4c67-9f3d-1e2a3b4c5d6e",
+		}, "exports/0b4b7e8f-2a2e-4c67-9f3d-1e2a3b4c5d6e/"},
 	}
 
 	for _, testCase := range testCases {
@@ -49,3 +135,265 @@ func TestObjectPrefixes(t *testing.T) {
 		log.Print(prefix)
 	}
 }
+
+type memoryQueue struct {
+	sync.Mutex
+	items map[string][]string
+	acked []string
+}
+
+func (q *memoryQueue) Enqueue(name string, items ...string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.items[name] = append(q.items[name], items...)
+	return nil
+}
+
+func (q *memoryQueue) Dequeue(name string) (string, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items[name]) == 0 {
+		return "", false, nil
+	}
+	item := q.items[name][0]
+	q.items[name] = q.items[name][1:]
+	return item, true, nil
+}
+
+func (q *memoryQueue) Ack(name, item string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.acked = append(q.acked, item)
+	return nil
+}
+
+func TestDownloaderQueuesObjectsWithElection(t *testing.T) {
+	queue := &memoryQueue{items: map[string][]string{}}
+	d := &Downloader{
+		ObjectDownloader:  &ELBDownloader{LBName: "service1"},
+		ObjectsToDownload: make(chan *s3.Object),
+		Election:          &state.Election{WorkQueue: queue, Holder: "a", TTL: time.Minute},
+	}
+	if d.listing() {
+		t.Error("expected a replica which isn't the leader not to list the bucket")
+	}
+
+	lastModified := time.Date(2018, 8, 20, 0, 0, 0, 0, time.UTC)
+	d.dispatch(&s3.Object{
+		Key:          aws.String("AWSLogs/foo.log"),
+		Size:         aws.Int64(42),
+		LastModified: aws.Time(lastModified),
+	})
+	if n := len(queue.items[d.String()]); n != 1 {
+		t.Fatalf("expected the object to be queued, got %d items", n)
+	}
+
+	go d.dequeueObjects(context.Background())
+	select {
+	case obj := <-d.ObjectsToDownload:
+		if *obj.Key != "AWSLogs/foo.log" || *obj.Size != 42 || !obj.LastModified.Equal(lastModified) {
+			t.Errorf("unexpected dequeued object %v", obj)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued object to be downloaded")
+	}
+	queue.Lock()
+	defer queue.Unlock()
+	if len(queue.acked) != 1 {
+		t.Errorf("expected the dequeued object to be acknowledged, got %v", queue.acked)
+	}
+}
+
+func TestDownloaderQueuesConnectionLogsSeparately(t *testing.T) {
+	queue := &memoryQueue{items: map[string][]string{}}
+	leaser := &memoryLeaser{holders: map[string]string{}}
+	election := &state.Election{Leaser: leaser, WorkQueue: queue, Holder: "a", TTL: time.Minute}
+	access := &Downloader{
+		ObjectDownloader:  &ALBDownloader{ELBDownloader: &ELBDownloader{LBName: "service1"}},
+		ObjectsToDownload: make(chan *s3.Object, 1),
+		Election:          election,
+	}
+	conn := &Downloader{
+		ObjectDownloader:  &ALBConnectionDownloader{ELBDownloader: &ELBDownloader{LBName: "service1"}},
+		ObjectsToDownload: make(chan *s3.Object, 1),
+		Election:          election,
+	}
+
+	// each is elected leader of its own logs
+	for _, d := range []*Downloader{access, conn} {
+		if ok, err := leaser.AcquireLease(d.String(), "a", time.Minute); err != nil || !ok {
+			t.Fatalf("expected %s to acquire its lease, got %v (%v)", d, ok, err)
+		}
+	}
+
+	lastModified := aws.Time(time.Now())
+	access.dispatch(&s3.Object{Key: aws.String("AWSLogs/app.service1.log.gz"), Size: aws.Int64(1), LastModified: lastModified})
+	conn.dispatch(&s3.Object{Key: aws.String("AWSLogs/conn_log.app.service1.log.gz"), Size: aws.Int64(1), LastModified: lastModified})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for d, expected := range map[*Downloader]string{
+		access: "AWSLogs/app.service1.log.gz",
+		conn:   "AWSLogs/conn_log.app.service1.log.gz",
+	} {
+		go d.dequeueObjects(ctx)
+		select {
+		case obj := <-d.ObjectsToDownload:
+			if *obj.Key != expected {
+				t.Errorf("expected %s to dequeue %s, got %s", d, expected, *obj.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to dequeue %s", d, expected)
+		}
+	}
+}
+
+type memoryLeaser struct {
+	sync.Mutex
+	holders map[string]string
+}
+
+func (l *memoryLeaser) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	if h, ok := l.holders[name]; ok && h != holder {
+		return false, nil
+	}
+	l.holders[name] = holder
+	return true, nil
+}
+
+func (l *memoryLeaser) ReleaseLease(name, holder string) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.holders[name] == holder {
+		delete(l.holders, name)
+	}
+	return nil
+}
+
+func TestDownloaderStopsWhenCancelled(t *testing.T) {
+	leaser := &memoryLeaser{holders: map[string]string{}}
+	d := &Downloader{
+		ObjectDownloader:  &ELBDownloader{LBName: "service1"},
+		ObjectsToDownload: make(chan *s3.Object),
+		Election: &state.Election{
+			Leaser:    leaser,
+			WorkQueue: &memoryQueue{items: map[string][]string{}},
+			Holder:    "a",
+			TTL:       time.Minute,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	elected := make(chan struct{}, 1)
+	leaseReleased := make(chan struct{})
+	go func() {
+		d.holdLease(ctx, elected)
+		close(leaseReleased)
+	}()
+	dequeued := make(chan struct{})
+	go func() {
+		d.dequeueObjects(ctx)
+		close(dequeued)
+	}()
+
+	select {
+	case <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("expected the only replica to be elected")
+	}
+	cancel()
+
+	for _, stopped := range []chan struct{}{leaseReleased, dequeued} {
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("expected the downloader to stop once cancelled")
+		}
+	}
+	if holder, ok := leaser.holders[d.String()]; ok {
+		t.Errorf("expected the lease to be released, held by %s", holder)
+	}
+}
+
+func TestDownloaderOnlyResumesAbandonedObjects(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	replica := func(owner string) *Downloader {
+		stater, err := state.NewRedisStater("redis://"+s.Addr(), "elb", 1)
+		if err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		stater.Owner = owner
+		return &Downloader{
+			Stater:            stater,
+			ObjectDownloader:  &ELBDownloader{LBName: "service1"},
+			ObjectsToDownload: make(chan *s3.Object, 1),
+			BackfillInterval:  time.Hour,
+			Checkpoints:       true,
+			Owner:             owner,
+			OffsetLease:       time.Minute,
+		}
+	}
+	page := &s3.ListObjectsOutput{
+		Contents: []*s3.Object{{
+			Key:          aws.String("AWSLogs/foo.log"),
+			LastModified: aws.Time(time.Now()),
+		}},
+		IsTruncated: aws.Bool(false),
+	}
+
+	// a claims the object and is part way through it
+	a := replica("a")
+	a.loadResuming()
+	a.accessLogBucketPageCallback(context.Background(), "AWSLogs/", map[string]time.Time{}, page, true)
+	<-a.ObjectsToDownload
+	if err := a.Stater.(state.OffsetStater).SetOffset("AWSLogs/foo.log", 42); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	processed, err := a.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	// b starts while a is still going, and leaves the object to a
+	b := replica("b")
+	b.loadResuming()
+	b.accessLogBucketPageCallback(context.Background(), "AWSLogs/", processed, page, true)
+	select {
+	case obj := <-b.ObjectsToDownload:
+		t.Fatalf("expected the object in progress on a not to be picked up by b, got %s", *obj.Key)
+	default:
+	}
+
+	// a restarting picks up where it left off
+	a.loadResuming()
+	a.accessLogBucketPageCallback(context.Background(), "AWSLogs/", processed, page, true)
+	select {
+	case <-a.ObjectsToDownload:
+	default:
+		t.Fatal("expected a to resume its own object")
+	}
+
+	// once a hasn't recorded an offset within the lease, b takes over
+	// without having to restart
+	b.OffsetLease = 0
+	b.resumeLapsed()
+	b.accessLogBucketPageCallback(context.Background(), "AWSLogs/", processed, page, true)
+	select {
+	case <-b.ObjectsToDownload:
+	default:
+		t.Fatal("expected b to resume the abandoned object")
+	}
+
+	// and doesn't resume it again while it's processing it
+	b.resumeLapsed()
+	b.accessLogBucketPageCallback(context.Background(), "AWSLogs/", processed, page, true)
+	select {
+	case <-b.ObjectsToDownload:
+		t.Fatal("expected b not to resume the object it took over again")
+	default:
+	}
+}
@@ -0,0 +1,189 @@
+package logstream
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	firehoseRequestIDHeader = "X-Amz-Firehose-Request-Id"
+	firehoseAccessKeyHeader = "X-Amz-Firehose-Access-Key"
+
+	// Firehose buffers at most 64 MiB before delivering.
+	maxFirehoseRequestSize = 64 << 20
+)
+
+// firehoseRequest is the body of a Firehose HTTP endpoint delivery request.
+// Record data is base64 encoded, which encoding/json decodes for []byte.
+type firehoseRequest struct {
+	RequestID string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"`
+	Records   []struct {
+		Data []byte `json:"data"`
+	} `json:"records"`
+}
+
+type firehoseResponse struct {
+	RequestID    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// FirehoseServer implements the Kinesis Data Firehose HTTP endpoint delivery
+// protocol. The records of each request are written to a temporary file and
+// published like a downloaded object, and the request is only acknowledged
+// once they have been parsed, so that Firehose retries failed deliveries.
+//
+// See https://docs.aws.amazon.com/firehose/latest/dev/httpdeliveryrequestresponse.html
+type FirehoseServer struct {
+	publisher.Publisher
+
+	// AccessKey, if set, must match the access key configured for the
+	// delivery stream's HTTP endpoint destination.
+	AccessKey string
+
+	// Compress gzips the records written for the publisher, for parsers
+	// which expect objects to be compressed.
+	Compress bool
+}
+
+func NewFirehoseServer(p publisher.Publisher, accessKey string, compress bool) *FirehoseServer {
+	return &FirehoseServer{
+		Publisher: p,
+		AccessKey: accessKey,
+		Compress:  compress,
+	}
+}
+
+func (s *FirehoseServer) respond(w http.ResponseWriter, requestID string, status int, errorMessage string) {
+	if errorMessage != "" {
+		logrus.WithFields(logrus.Fields{
+			"requestId": requestID,
+			"status":    status,
+			"error":     errorMessage,
+		}).Error("Rejecting Firehose delivery request")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(firehoseResponse{
+		RequestID:    requestID,
+		Timestamp:    time.Now().UnixNano() / int64(time.Millisecond),
+		ErrorMessage: errorMessage,
+	})
+}
+
+func (s *FirehoseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(firehoseRequestIDHeader)
+
+	if r.Method != http.MethodPost {
+		s.respond(w, requestID, http.StatusMethodNotAllowed, "Only POST requests are accepted")
+		return
+	}
+
+	if s.AccessKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(firehoseAccessKeyHeader)), []byte(s.AccessKey)) != 1 {
+		s.respond(w, requestID, http.StatusUnauthorized, "Invalid access key")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxFirehoseRequestSize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			s.respond(w, requestID, http.StatusBadRequest, fmt.Sprintf("Error decompressing request body: %s", err))
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxFirehoseRequestSize)
+	}
+
+	var req firehoseRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		s.respond(w, requestID, http.StatusBadRequest, fmt.Sprintf("Error decoding request body: %s", err))
+		return
+	}
+	if requestID == "" {
+		requestID = req.RequestID
+	}
+	if req.RequestID != requestID {
+		s.respond(w, requestID, http.StatusBadRequest, "Request ID in body does not match header")
+		return
+	}
+
+	if len(req.Records) > 0 {
+		records := make([][]byte, len(req.Records))
+		for i, record := range req.Records {
+			records[i] = record.Data
+		}
+
+		filename, err := writeRecords(records, s.Compress)
+		if err != nil {
+			s.respond(w, requestID, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if err := s.Publish(r.Context(), state.DownloadedObject{
+			Filename: filename,
+			Object:   "firehose/" + requestID,
+		}); err != nil {
+			os.Remove(filename)
+			s.respond(w, requestID, http.StatusInternalServerError, fmt.Sprintf("Error publishing records: %s", err))
+			return
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"requestId": requestID,
+		"records":   len(req.Records),
+	}).Debug("Accepted Firehose delivery request")
+
+	s.respond(w, requestID, http.StatusOK, "")
+}
+
+// ServeFirehose listens for Firehose deliveries as configured by the options,
+// publishing them with p, until ctx is done. It then stops accepting
+// deliveries and returns once those in flight have been published, or
+// --shutdown_timeout has passed.
+func ServeFirehose(ctx context.Context, opt *options.Options, p publisher.Publisher, compress bool) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", NewFirehoseServer(p, opt.FirehoseAccessKey, compress))
+
+	server := &http.Server{
+		Addr:    opt.ListenAddr,
+		Handler: mux,
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		logrus.Info("Waiting for Firehose deliveries in flight to be published")
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(opt.ShutdownTimeout)*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(timeoutCtx)
+	}()
+
+	logrus.WithField("addr", opt.ListenAddr).Info("Listening for Firehose deliveries")
+
+	var err error
+	if opt.TLSCertFile != "" || opt.TLSKeyFile != "" {
+		err = server.ListenAndServeTLS(opt.TLSCertFile, opt.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
@@ -0,0 +1,142 @@
+package logstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/honeycombio/honeyaws/state"
+)
+
+// recordingPublisher keeps the contents of each published object.
+type recordingPublisher struct {
+	objects []string
+	err     error
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, obj state.DownloadedObject) error {
+	if p.err != nil {
+		return p.err
+	}
+	data, err := ioutil.ReadFile(obj.Filename)
+	if err != nil {
+		return err
+	}
+	os.Remove(obj.Filename)
+	p.objects = append(p.objects, string(data))
+	return nil
+}
+
+const firehoseBody = `{"requestId":"ed4acda5-034f-9f42-bba1-f29aea6d7d8f","timestamp":1578090901599,"records":[{"data":"YWJj"},{"data":"ZGVmCg=="}]}`
+
+func TestFirehoseServer(t *testing.T) {
+	testCases := []struct {
+		name           string
+		accessKey      string
+		requestID      string
+		body           string
+		gzipBody       bool
+		publishErr     error
+		expectedStatus int
+		expectedObject string
+	}{
+		{"records", "", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", firehoseBody, false, nil, http.StatusOK, "abc\ndef\n"},
+		{"gzipped request", "", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", firehoseBody, true, nil, http.StatusOK, "abc\ndef\n"},
+		{"wrong access key", "secret", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", firehoseBody, false, nil, http.StatusUnauthorized, ""},
+		{"malformed body", "", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", `{"records":`, false, nil, http.StatusBadRequest, ""},
+		{"mismatched request ID", "", "other", firehoseBody, false, nil, http.StatusBadRequest, ""},
+		{"publish error", "", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", firehoseBody, false, errors.New("boom"), http.StatusInternalServerError, ""},
+	}
+
+	for _, tc := range testCases {
+		p := &recordingPublisher{err: tc.publishErr}
+		server := NewFirehoseServer(p, tc.accessKey, false)
+
+		body := []byte(tc.body)
+		if tc.gzipBody {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			body = buf.Bytes()
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set(firehoseRequestIDHeader, tc.requestID)
+		req.Header.Set(firehoseAccessKeyHeader, "not-the-secret")
+		if tc.gzipBody {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expectedStatus, rec.Code)
+		}
+
+		var resp firehoseResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: response is not JSON: %s", tc.name, err)
+		}
+		if resp.RequestID != tc.requestID {
+			t.Errorf("%s: expected request ID %q in response, got %q", tc.name, tc.requestID, resp.RequestID)
+		}
+		if resp.Timestamp == 0 {
+			t.Errorf("%s: expected timestamp in response", tc.name)
+		}
+		if (tc.expectedStatus == http.StatusOK) != (resp.ErrorMessage == "") {
+			t.Errorf("%s: unexpected error message %q", tc.name, resp.ErrorMessage)
+		}
+
+		if tc.expectedObject != "" {
+			if len(p.objects) != 1 || p.objects[0] != tc.expectedObject {
+				t.Errorf("%s: expected object %q, got %q", tc.name, tc.expectedObject, p.objects)
+			}
+		} else if len(p.objects) != 0 {
+			t.Errorf("%s: expected nothing to be published, got %q", tc.name, p.objects)
+		}
+	}
+}
+
+func TestFirehoseServerCompress(t *testing.T) {
+	var published []byte
+	p := publisherFunc(func(obj state.DownloadedObject) error {
+		f, err := os.Open(obj.Filename)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(obj.Filename)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		published, err = ioutil.ReadAll(gz)
+		return err
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(firehoseBody)))
+	req.Header.Set(firehoseRequestIDHeader, "ed4acda5-034f-9f42-bba1-f29aea6d7d8f")
+	rec := httptest.NewRecorder()
+	NewFirehoseServer(p, "", true).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if string(published) != "abc\ndef\n" {
+		t.Errorf("Unexpected published records %q", published)
+	}
+}
+
+type publisherFunc func(state.DownloadedObject) error
+
+func (f publisherFunc) Publish(ctx context.Context, obj state.DownloadedObject) error {
+	return f(obj)
+}
@@ -0,0 +1,389 @@
+// Package logstream reads logs which AWS delivers to a stream rather than to
+// an S3 bucket. Batches of records are written to temporary files and handed
+// off as state.DownloadedObjects, so that they go through the same publishing
+// pipeline as objects downloaded by logbucket.
+package logstream
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AWSCloudFrontRealtime = "cloudfront-realtime"
+
+	// checkpointShardEnd marks a closed shard as completely read.
+	checkpointShardEnd = "end"
+
+	// Kinesis allows five GetRecords calls per second per shard, which
+	// is shared with any other consumer of the stream.
+	defaultPollInterval       = time.Second
+	defaultCheckpointInterval = time.Minute
+	defaultShardListInterval  = 5 * time.Minute
+)
+
+// KinesisConsumer reads every shard of a Kinesis data stream. The position
+// in each shard is checkpointed using the Stater, as an object named
+// "kinesis/<stream>/<shard id>/<sequence number>".
+//
+// Without a checkpoint, a shard is read from the start of the backfill
+// interval.
+type KinesisConsumer struct {
+	state.Stater
+	Client             kinesisiface.KinesisAPI
+	StreamName         string
+	BackfillInterval   time.Duration
+	PollInterval       time.Duration
+	CheckpointInterval time.Duration
+	ShardListInterval  time.Duration
+
+	DownloadedObjects chan state.DownloadedObject
+
+	// shards currently being read
+	mu      sync.Mutex
+	shards  map[string]bool
+	readers sync.WaitGroup
+}
+
+// NewKinesisConsumer creates a consumer for the stream. endpoint can be set to
+// use a local Kinesis stand-in (e.g., kinesalite) instead of AWS.
+func NewKinesisConsumer(sess *session.Session, stater state.Stater, streamName, region, endpoint string, backfill int) *KinesisConsumer {
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	return &KinesisConsumer{
+		Stater:             stater,
+		Client:             kinesis.New(sess, cfg),
+		StreamName:         streamName,
+		BackfillInterval:   time.Hour * time.Duration(backfill),
+		PollInterval:       defaultPollInterval,
+		CheckpointInterval: defaultCheckpointInterval,
+		ShardListInterval:  defaultShardListInterval,
+		shards:             make(map[string]bool),
+	}
+}
+
+// StreamNameFromARN returns the name and region of the stream, e.g.
+// arn:aws:kinesis:us-east-1:123456789012:stream/cloudfront-realtime
+func StreamNameFromARN(arn string) (string, string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "kinesis" || !strings.HasPrefix(parts[5], "stream/") {
+		return "", "", fmt.Errorf("%q is not a Kinesis data stream ARN", arn)
+	}
+	return strings.TrimPrefix(parts[5], "stream/"), parts[3], nil
+}
+
+func (c *KinesisConsumer) String() string {
+	return c.StreamName
+}
+
+func (c *KinesisConsumer) checkpointPrefix(shardID string) string {
+	return fmt.Sprintf("kinesis/%s/%s/", c.StreamName, shardID)
+}
+
+// laterSequenceNumber reports whether sequence number a comes after b. They
+// are decimal strings of up to 128 bits, so compare by length first.
+func laterSequenceNumber(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// checkpoint returns the last sequence number read from the shard, if any,
+// and whether the shard has been read to the end.
+func (c *KinesisConsumer) checkpoint(processedObjects map[string]time.Time, shardID string) (string, bool) {
+	prefix := c.checkpointPrefix(shardID)
+	seq := ""
+	for obj := range processedObjects {
+		if !strings.HasPrefix(obj, prefix) {
+			continue
+		}
+		s := strings.TrimPrefix(obj, prefix)
+		if s == checkpointShardEnd {
+			return "", true
+		}
+		if laterSequenceNumber(s, seq) {
+			seq = s
+		}
+	}
+	return seq, false
+}
+
+func (c *KinesisConsumer) shardIterator(shardID, seq string) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(c.StreamName),
+		ShardId:    aws.String(shardID),
+	}
+	if seq != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(seq)
+	} else {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAtTimestamp)
+		input.Timestamp = aws.Time(time.Now().Add(-c.BackfillInterval))
+	}
+
+	resp, err := c.Client.GetShardIterator(input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ShardIterator, nil
+}
+
+// writeRecords writes the data of each record to a temporary file, one text
+// record per line, optionally gzipped for parsers which expect objects to be
+// compressed.
+func writeRecords(records [][]byte, compress bool) (string, error) {
+	f, err := ioutil.TempFile("", "hc-entity-ingest")
+	if err != nil {
+		return "", fmt.Errorf("Error creating tmp file: %s", err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	for _, data := range records {
+		// Gzipped records, such as CloudWatch Logs subscription
+		// payloads, are left as is: concatenated, they can be read
+		// as a single gzip stream.
+		gzipped := len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b
+		if !gzipped && (len(data) == 0 || data[len(data)-1] != '\n') {
+			data = append(data, '\n')
+		}
+		if _, err := w.Write(data); err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("Error writing tmp file: %s", err)
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("Error writing tmp file: %s", err)
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// readShard reads the shard until it is closed or ctx is done, sending each
+// batch of records as an object.
+func (c *KinesisConsumer) readShard(ctx context.Context, shardID string) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.shards, shardID)
+		c.mu.Unlock()
+	}()
+
+	processedObjects, err := c.ProcessedObjects()
+	if err != nil {
+		logrus.Error(err)
+	}
+	seq, ended := c.checkpoint(processedObjects, shardID)
+	if ended {
+		logrus.WithField("shard", shardID).Debug("Shard already read to the end, skipping")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"shard":      shardID,
+		"checkpoint": seq,
+		"entity":     c.String(),
+	}).Info("Reading records from shard")
+
+	var iterator *string
+	checkpointed := seq
+	lastCheckpoint := time.Now()
+
+	for ctx.Err() == nil {
+		if iterator == nil {
+			iterator, err = c.shardIterator(shardID, seq)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"shard": shardID,
+					"error": err,
+				}).Error("Error getting shard iterator")
+				sleep(ctx, c.ShardListInterval)
+				continue
+			}
+		}
+
+		resp, err := c.Client.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
+				logrus.WithField("shard", shardID).Debug("Read throughput exceeded, backing off")
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"shard": shardID,
+					"error": err,
+				}).Error("Error getting records from shard")
+				// Start over from the last record read, e.g., if
+				// the iterator expired.
+				iterator = nil
+			}
+			sleep(ctx, 5*c.PollInterval)
+			continue
+		}
+
+		if len(resp.Records) > 0 {
+			data := make([][]byte, len(resp.Records))
+			for i, record := range resp.Records {
+				data[i] = record.Data
+			}
+			filename, err := writeRecords(data, false)
+			if err != nil {
+				logrus.Error(err)
+				sleep(ctx, c.PollInterval)
+				continue
+			}
+
+			seq = aws.StringValue(resp.Records[len(resp.Records)-1].SequenceNumber)
+			c.DownloadedObjects <- state.DownloadedObject{
+				Filename: filename,
+				Object:   c.checkpointPrefix(shardID) + seq,
+			}
+		}
+
+		iterator = resp.NextShardIterator
+
+		// A closed shard has no next iterator once all of its records
+		// have been read.
+		if iterator == nil {
+			if err := c.SetProcessed(c.checkpointPrefix(shardID) + checkpointShardEnd); err != nil {
+				logrus.WithField("shard", shardID).Debug("Error setting state of shard as read: ", err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"shard":  shardID,
+				"entity": c.String(),
+			}).Info("Shard closed and read to the end")
+			return
+		}
+
+		if seq != checkpointed && time.Since(lastCheckpoint) >= c.CheckpointInterval {
+			if err := c.SetProcessed(c.checkpointPrefix(shardID) + seq); err != nil {
+				logrus.WithField("shard", shardID).Debug("Error checkpointing shard: ", err)
+			} else {
+				checkpointed = seq
+				lastCheckpoint = time.Now()
+			}
+		}
+
+		sleep(ctx, c.PollInterval)
+	}
+
+	// Checkpoint the records which have been sent, so that the next
+	// consumer of the shard carries on from there.
+	if seq != checkpointed {
+		if err := c.SetProcessed(c.checkpointPrefix(shardID) + seq); err != nil {
+			logrus.WithField("shard", shardID).Debug("Error checkpointing shard: ", err)
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"shard":  shardID,
+		"entity": c.String(),
+	}).Info("Stopped reading records from shard")
+}
+
+// readNewShards starts reading any shard of the stream which isn't being read
+// already, such as those created by resharding.
+func (c *KinesisConsumer) readNewShards(ctx context.Context) error {
+	input := &kinesis.ListShardsInput{
+		StreamName: aws.String(c.StreamName),
+	}
+	for {
+		resp, err := c.Client.ListShards(input)
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range resp.Shards {
+			shardID := aws.StringValue(shard.ShardId)
+
+			c.mu.Lock()
+			reading := c.shards[shardID]
+			c.shards[shardID] = true
+			c.mu.Unlock()
+
+			if !reading {
+				c.readers.Add(1)
+				go func() {
+					defer c.readers.Done()
+					c.readShard(ctx, shardID)
+				}()
+			}
+		}
+
+		if resp.NextToken == nil {
+			return nil
+		}
+		// The stream name can't be given along with a token.
+		input = &kinesis.ListShardsInput{
+			NextToken: resp.NextToken,
+		}
+	}
+}
+
+func (c *KinesisConsumer) pollShards(ctx context.Context) {
+	ticker := time.NewTicker(c.ShardListInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.readNewShards(ctx); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"entity": c.String(),
+				"error":  err,
+			}).Error("Error listing stream shards")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Consume reads the stream, sending batches of records to downloadedObjects,
+// until ctx is done. It returns once every shard has stopped being read, with
+// the records which were sent checkpointed.
+func (c *KinesisConsumer) Consume(ctx context.Context, downloadedObjects chan state.DownloadedObject) {
+	c.DownloadedObjects = downloadedObjects
+	c.pollShards(ctx)
+	c.readers.Wait()
+}
@@ -0,0 +1,249 @@
+package logstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/honeycombio/honeyaws/state"
+)
+
+// fakeKinesis is a local stand-in for a stream with a single shard, which is
+// closed once all of its records have been read unless open is set.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	records []string
+	open    bool
+}
+
+func (k *fakeKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{
+		Shards: []*kinesis.Shard{{ShardId: aws.String("shardId-000000000000")}},
+	}, nil
+}
+
+// Sequence numbers are the 1-based position of the record, and iterators the
+// 0-based position of the next record to read.
+func (k *fakeKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	pos := 0
+	if aws.StringValue(input.ShardIteratorType) == kinesis.ShardIteratorTypeAfterSequenceNumber {
+		pos, _ = strconv.Atoi(aws.StringValue(input.StartingSequenceNumber))
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(strconv.Itoa(pos))}, nil
+}
+
+func (k *fakeKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	pos, _ := strconv.Atoi(aws.StringValue(input.ShardIterator))
+	if pos >= len(k.records) {
+		if k.open {
+			return &kinesis.GetRecordsOutput{NextShardIterator: input.ShardIterator}, nil
+		}
+		return &kinesis.GetRecordsOutput{}, nil
+	}
+
+	end := pos + 2
+	if end > len(k.records) {
+		end = len(k.records)
+	}
+	resp := &kinesis.GetRecordsOutput{NextShardIterator: aws.String(strconv.Itoa(end))}
+	for i := pos; i < end; i++ {
+		resp.Records = append(resp.Records, &kinesis.Record{
+			Data:           []byte(k.records[i]),
+			SequenceNumber: aws.String(strconv.Itoa(i + 1)),
+		})
+	}
+	return resp, nil
+}
+
+type memoryStater struct {
+	sync.Mutex
+	objs map[string]time.Time
+}
+
+func (m *memoryStater) ProcessedObjects() (map[string]time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+	objs := make(map[string]time.Time, len(m.objs))
+	for k, v := range m.objs {
+		objs[k] = v
+	}
+	return objs, nil
+}
+
+func (m *memoryStater) SetProcessed(object string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.objs[object] = time.Now()
+	return nil
+}
+
+func newTestConsumer(stater state.Stater, records []string) *KinesisConsumer {
+	return &KinesisConsumer{
+		Stater:            stater,
+		Client:            &fakeKinesis{records: records},
+		StreamName:        "cf-realtime",
+		BackfillInterval:  time.Hour,
+		PollInterval:      time.Millisecond,
+		ShardListInterval: time.Hour,
+		shards:            make(map[string]bool),
+	}
+}
+
+// consumeLines returns the lines of the objects sent by the consumer until
+// the shard has been read to the end.
+func consumeLines(t *testing.T, stater *memoryStater, c *KinesisConsumer) []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	downloadsCh := make(chan state.DownloadedObject)
+	go c.Consume(ctx, downloadsCh)
+
+	endMarker := "kinesis/cf-realtime/shardId-000000000000/end"
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case obj := <-downloadsCh:
+			data, err := ioutil.ReadFile(obj.Filename)
+			if err != nil {
+				t.Fatal("Shouldn't have err but did: ", err)
+			}
+			os.Remove(obj.Filename)
+			lines = append(lines, string(data))
+		case <-timeout:
+			t.Fatal("Timed out waiting for shard to be read")
+		case <-time.After(10 * time.Millisecond):
+			objs, _ := stater.ProcessedObjects()
+			if _, ok := objs[endMarker]; ok {
+				return lines
+			}
+		}
+	}
+}
+
+func TestKinesisConsumer(t *testing.T) {
+	records := []string{"a\tb\n", "c\td\n", "e\tf"}
+
+	testCases := []struct {
+		name       string
+		checkpoint string
+		expected   []string
+	}{
+		{"no checkpoint", "", []string{"a\tb\nc\td\n", "e\tf\n"}},
+		{"checkpoint", "kinesis/cf-realtime/shardId-000000000000/2", []string{"e\tf\n"}},
+		{"shard end", "kinesis/cf-realtime/shardId-000000000000/end", nil},
+	}
+
+	for _, tc := range testCases {
+		stater := &memoryStater{objs: make(map[string]time.Time)}
+		if tc.checkpoint != "" {
+			stater.SetProcessed(tc.checkpoint)
+		}
+
+		lines := consumeLines(t, stater, newTestConsumer(stater, records))
+		if len(lines) != len(tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, lines)
+			continue
+		}
+		for i := range lines {
+			if lines[i] != tc.expected[i] {
+				t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, lines)
+			}
+		}
+	}
+}
+
+func TestKinesisConsumerCheckpointsWhenCancelled(t *testing.T) {
+	stater := &memoryStater{objs: make(map[string]time.Time)}
+	c := newTestConsumer(stater, []string{"a\tb\n", "c\td\n"})
+	c.Client.(*fakeKinesis).open = true
+	c.CheckpointInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	downloadsCh := make(chan state.DownloadedObject)
+	consumed := make(chan struct{})
+	go func() {
+		c.Consume(ctx, downloadsCh)
+		close(consumed)
+	}()
+
+	select {
+	case obj := <-downloadsCh:
+		os.Remove(obj.Filename)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for records")
+	}
+	cancel()
+
+	select {
+	case <-consumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the consumer to stop")
+	}
+
+	objs, _ := stater.ProcessedObjects()
+	if _, ok := objs["kinesis/cf-realtime/shardId-000000000000/2"]; !ok {
+		t.Errorf("expected the records sent to be checkpointed, got %v", objs)
+	}
+}
+
+func TestLaterSequenceNumber(t *testing.T) {
+	if !laterSequenceNumber("49590338271490256608559692540925702759324208523137515618", "9") {
+		t.Error("Longer sequence number should be later")
+	}
+	if laterSequenceNumber("10", "11") {
+		t.Error("10 should not be later than 11")
+	}
+}
+
+func TestStreamNameFromARN(t *testing.T) {
+	name, region, err := StreamNameFromARN("arn:aws:kinesis:us-east-1:123456789012:stream/cf-realtime")
+	if err != nil || name != "cf-realtime" || region != "us-east-1" {
+		t.Errorf("Unexpected result: %q %q %v", name, region, err)
+	}
+	if _, _, err := StreamNameFromARN("arn:aws:firehose:us-east-1:123456789012:deliverystream/foo"); err == nil {
+		t.Error("Expected error for non-Kinesis ARN")
+	}
+}
+
+func TestWriteRecordsGzipped(t *testing.T) {
+	var records [][]byte
+	for _, data := range []string{"a\n", "b\n"} {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(data))
+		w.Close()
+		records = append(records, buf.Bytes())
+	}
+
+	filename, err := writeRecords(records, false)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Gzipped records should be readable as one stream: ", err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("Unexpected records %q", data)
+	}
+}
@@ -1,16 +1,43 @@
 package options
 
 type Options struct {
-	Dataset         string  `short:"d" long:"dataset" description:"Name of the dataset" default:"aws-$SERVICE-access"`
-	SampleRate      int     `long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
-	WriteKey        string  `short:"k" long:"writekey" description:"Honeycomb team write key"`
-	StateDir        string  `long:"statedir" description:"Directory where ingest state is stored" default:"."`
-	HighAvail       bool    `long:"highavail" description:"Enable high availability ingestion using DynamoDB"`
-	BackfillHr      int     `long:"backfill" description:"The number of hours to increase backfill of log ingestion to with max of 168 hours (1 week)" default:"1"`
-	EdgeMode        bool    `long:"edge_mode" description:"Ignore any parent trace id, if present, from a load balancer"`
-	SamplerType     string  `long:"sampler_type" default:"simple" description:"Type of dynamic sampler to use. Options are 'simple' and 'ema'"`
-	SamplerInterval int     `long:"sampler_interval" default:"300" description:"Interval between sample rate calculation, in seconds."`
-	SamplerDecay    float64 `long:"sampler_decay" default:"0.5" description:"Used only when sampler_type is set to 'ema'. A value between (0,1) that controls how fast new observations are factored into the moving average. Larger values mean the sample rates are more sensitive to recent observations."`
+	Dataset             string  `short:"d" long:"dataset" description:"Name of the dataset" default:"aws-$SERVICE-access"`
+	SampleRate          int     `long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
+	WriteKey            string  `short:"k" long:"writekey" description:"Honeycomb team write key"`
+	StateDir            string  `long:"statedir" description:"Directory where ingest state is stored" default:"."`
+	HighAvail           bool    `long:"highavail" description:"Enable high availability ingestion using DynamoDB"`
+	StateBackend        string  `long:"state_backend" description:"Where ingest state is stored: local, dynamodb, redis or s3 (--highavail is the same as dynamodb)" default:"local"`
+	DynamoTable         string  `long:"dynamodb_table" description:"Name of the DynamoDB table used by --state_backend=dynamodb" default:"HoneyAWSIngestState"`
+	DynamoNamespace     string  `long:"dynamodb_namespace" description:"Namespace, e.g. an environment, to keep ingest state under so that several deployments can share the DynamoDB table"`
+	DynamoTTLHr         int     `long:"dynamodb_ttl" description:"The number of hours processed objects are kept in the DynamoDB table" default:"168"`
+	DynamoCreateTable   bool    `long:"dynamodb_create_table" description:"Create the DynamoDB table, with TTL enabled, if it doesn't exist"`
+	LeaderElection      bool    `long:"leader_election" description:"Elect one replica to list each bucket and hand new objects to the others, rather than every replica listing them (requires --state_backend=dynamodb or redis)"`
+	Shard               bool    `long:"shard" description:"Split the entities (load balancers, distributions, etc.) between replicas, so that each is only listed by one of them (requires --state_backend=dynamodb or redis)"`
+	LeaseTTL            int     `long:"lease_ttl" description:"Seconds a leader's lease, or a replica's membership with --shard, lasts without being renewed, after which other replicas take over" default:"30"`
+	RedisURL            string  `long:"redis_url" description:"URL of the Redis server used by --state_backend=redis" default:"redis://localhost:6379/0"`
+	StateBucket         string  `long:"state_bucket" description:"S3 bucket where ingest state is stored by --state_backend=s3"`
+	StatePrefix         string  `long:"state_prefix" description:"Prefix of the keys of ingest state in --state_bucket" default:"honeyaws-state"`
+	BackfillHr          int     `long:"backfill" description:"The number of hours to increase backfill of log ingestion to with max of 168 hours (1 week)" default:"1"`
+	StateSinceHr        int     `long:"since" description:"The number of hours back the state subcommand looks for processed objects, to list, show, export or forget by prefix or time" default:"168"`
+	EdgeMode            bool    `long:"edge_mode" description:"Ignore any parent trace id, if present, from a load balancer"`
+	ConnectionLogs      bool    `long:"connection_logs" description:"Also ingest ALB connection logs (TLS handshake details), which share conn_trace_id with access log events"`
+	APIGatewayLogFormat string  `long:"apigateway_log_format" description:"API Gateway access log format ($context variables) to use instead of the format in the stage settings"`
+	RealtimeLogs        bool    `long:"realtime_logs" description:"Ingest CloudFront real-time logs from their Kinesis data stream instead of standard logs"`
+	KinesisEndpoint     string  `hidden:"true" long:"kinesis_endpoint" description:"Endpoint for Kinesis, e.g. a local stand-in such as kinesalite"`
+	ExportTasks         bool    `long:"export_tasks" description:"Also ingest recently completed CloudWatch Logs export tasks of the log groups"`
+	ListenAddr          string  `long:"listen" description:"Address to listen on for Kinesis Data Firehose deliveries with the serve subcommand" default:":8080"`
+	FirehoseAccessKey   string  `long:"firehose_access_key" description:"Access key which Firehose deliveries must include, as configured for the HTTP endpoint destination"`
+	TLSCertFile         string  `long:"tls_cert" description:"TLS certificate file for the serve subcommand, if TLS isn't terminated by a load balancer"`
+	TLSKeyFile          string  `long:"tls_key" description:"TLS private key file for the serve subcommand"`
+	DeadLetterFile      string  `long:"dead_letter_file" description:"Append lines which couldn't be parsed to this file as JSON, along with their object and line number (- for stderr)"`
+	CheckpointInterval  int     `long:"checkpoint_interval" description:"Seconds between recording how far into an object ingestion has got, so that an interrupted object can be resumed part way through (off by default)" default:"0"`
+	EventIDs            bool    `long:"event_ids" description:"Give each event a deterministic ID, in the event_id field: the ID of its record for services which have one (CloudTrail, CloudFront, CloudWatch Logs), otherwise a hash of its object and line"`
+	DedupWindow         int     `long:"dedup_window" description:"Seconds within which events with the same ID are dropped as duplicates, e.g. when an object is processed again after a failure (0 to disable, implies --event_ids)" default:"0"`
+	DedupSize           int     `long:"dedup_size" description:"Maximum number of event IDs remembered for --dedup_window" default:"1000000"`
+	ShutdownTimeout     int     `long:"shutdown_timeout" description:"Seconds to finish the objects in flight and flush events for after SIGINT or SIGTERM, before abandoning them (a second signal abandons them straight away)" default:"60"`
+	SamplerType         string  `long:"sampler_type" default:"simple" description:"Type of dynamic sampler to use. Options are 'simple' and 'ema'"`
+	SamplerInterval     int     `long:"sampler_interval" default:"300" description:"Interval between sample rate calculation, in seconds."`
+	SamplerDecay        float64 `long:"sampler_decay" default:"0.5" description:"Used only when sampler_type is set to 'ema'. A value between (0,1) that controls how fast new observations are factored into the moving average. Larger values mean the sample rates are more sensitive to recent observations."`
 
 	Version bool   `short:"V" long:"version" description:"Show version"`
 	APIHost string `hidden:"true" long:"api_host" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
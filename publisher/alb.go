@@ -2,11 +2,8 @@ package publisher
 
 import (
 	"bufio"
-	"compress/gzip"
 	"fmt"
 	"math/rand"
-	"os"
-	"runtime"
 	"strings"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -14,12 +11,12 @@ import (
 	"github.com/honeycombio/honeyaws/sampler"
 	"github.com/honeycombio/honeyaws/state"
 	"github.com/honeycombio/honeytail/event"
-	"github.com/honeycombio/honeytail/parsers/nginx"
 	"github.com/sirupsen/logrus"
 )
 
 type ALBEventParser struct {
 	sampler dynsampler.Sampler
+	lines   *nginxLineParser
 }
 
 func NewALBEventParser(opt *options.Options) *ALBEventParser {
@@ -28,7 +25,10 @@ func NewALBEventParser(opt *options.Options) *ALBEventParser {
 		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
 	}
 
-	ep := &ALBEventParser{sampler: s}
+	ep := &ALBEventParser{
+		sampler: s,
+		lines:   newNginxLineParser(AWSApplicationLoadBalancerFormat, "2006-01-02T15:04:05.9999Z", awsApplicationLoadBalancerFormatWithoutConnTraceID),
+	}
 
 	if err := ep.sampler.Start(); err != nil {
 		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
@@ -37,46 +37,43 @@ func NewALBEventParser(opt *options.Options) *ALBEventParser {
 	return ep
 }
 
-func (ep *ALBEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
-	np := &nginx.Parser{}
-	err := np.Init(&nginx.Options{
-		ConfigFile:      formatFileName,
-		TimeFieldName:   "timestamp",
-		TimeFieldFormat: "2006-01-02T15:04:05.9999Z",
-		LogFormatName:   AWSApplicationLoadBalancerFormat,
-		NumParsers:      runtime.NumCPU(),
-	})
-	if err != nil {
-		logrus.Fatal("Can't initialize the nginx parser")
-	}
-
-	linesCh := make(chan string)
+func (ep *ALBEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	linesCh := make(chan numberedLine)
+	done := make(chan struct{})
 
-	go np.ProcessLines(linesCh, out, nil)
+	go func() {
+		ep.lines.processLines(linesCh, out, report)
+		close(done)
+	}()
 
-	f, err := os.Open(obj.Filename)
+	r, err := openObject(obj.Filename)
 	if err != nil {
+		close(linesCh)
+		<-done
 		return err
 	}
 
-	defer f.Close()
-
-	r, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
+	defer r.Close()
 
 	scanner := bufio.NewScanner(r)
 
+	number := 0
 	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
 		line := scanner.Text()
 		if line == "" || strings.HasPrefix(line, "#") {
+			report.Skipped(number)
 			continue
 		}
-		linesCh <- line
+
+		linesCh <- numberedLine{number: number, raw: line, line: line}
 	}
 
 	close(linesCh)
+	<-done
 
 	return scanner.Err()
 }
@@ -0,0 +1,152 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"path"
+	"strings"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// ALBConnectionEventParser parses ALB connection logs, which record the TLS
+// handshake (protocol, cipher, latency and client certificate verification)
+// for each connection to the load balancer. Access log events for requests
+// made over the same connection share its conn_trace_id.
+type ALBConnectionEventParser struct {
+	sampler dynsampler.Sampler
+	lines   *nginxLineParser
+}
+
+func NewALBConnectionEventParser(opt *options.Options) *ALBConnectionEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &ALBConnectionEventParser{
+		sampler: s,
+		lines:   newNginxLineParser(AWSApplicationLoadBalancerConnectionFormat, "2006-01-02T15:04:05.9999Z"),
+	}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// lbFromConnectionLogObject recovers the load balancer from the name of a
+// connection log object, since unlike access logs the lines themselves don't
+// include it. The returned value matches the "elb" field of ALB access logs.
+//
+// Example object name:
+// conn_log.123456789012_elasticloadbalancing_us-east-1_app.my-lb.1234567890abcdef_20231004T1710Z_10.0.0.1_1a2b3c4d.log.gz
+func lbFromConnectionLogObject(object string) string {
+	parts := strings.Split(strings.TrimPrefix(path.Base(object), "conn_log."), "_")
+	if len(parts) < 4 {
+		return ""
+	}
+	return strings.Replace(parts[3], ".", "/", -1)
+}
+
+func (ep *ALBConnectionEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	linesCh := make(chan numberedLine)
+	parsedCh := make(chan event.Event)
+	done := make(chan struct{})
+
+	go func() {
+		ep.lines.processLines(linesCh, parsedCh, report)
+		close(parsedCh)
+	}()
+
+	lb := lbFromConnectionLogObject(obj.Object)
+	go func() {
+		for ev := range parsedCh {
+			if lb != "" {
+				ev.Data["elb"] = lb
+			}
+			out <- ev
+		}
+		close(done)
+	}()
+
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		close(linesCh)
+		<-done
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			report.Skipped(number)
+			continue
+		}
+		linesCh <- numberedLine{number: number, raw: line, line: line}
+	}
+
+	close(linesCh)
+	<-done
+
+	return scanner.Err()
+}
+
+func (ep *ALBConnectionEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// use the verification status to set sample rate, so that
+		// failed handshakes (rare, and what we're usually looking for)
+		// are kept at a much higher rate than successful ones
+		var key string
+		if verifyStatus, ok := ev.Data["tls_verify_status"]; ok {
+			if vs, ok := verifyStatus.(string); ok {
+				key = vs
+			} else {
+				key = "0"
+				logrus.WithFields(logrus.Fields{
+					"field":       "tls_verify_status",
+					"intended":    "string",
+					"actual_val":  verifyStatus,
+					"actual_type": fmt.Sprintf("%T", verifyStatus),
+				}).Error("Did not cast field from connection log correctly")
+			}
+		}
+
+		if tlsProtocol, ok := ev.Data["tls_protocol"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, tlsProtocol)
+		}
+
+		// Make sure sample rate is per-ALB
+		if elbName, ok := ev.Data["elb"]; ok {
+			if name, ok := elbName.(string); ok {
+				key = fmt.Sprintf("%s_%s", key, name)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestALBConnectionParseEvents(t *testing.T) {
+	connPublisher := NewALBConnectionEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`2023-10-04T17:10:20.203353Z 192.168.1.123 35898 443 TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256 4.036 "CN=amazon.com,OU=Amazon,O=Amazon,L=Seattle,ST=Washington,C=US" NotBefore=2023-09-21T22:43:21Z;NotAfter=2026-06-17T22:43:21Z FEF257D6C8D0E4A5 Failed:UntrustedCert TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "AWSLogs/12345/elasticloadbalancing/us-east-1/2023/10/04/conn_log.12345_elasticloadbalancing_us-east-1_app.my-lb.1db0c9806095122a_20231004T1710Z_10.0.0.1_1a2b3c4d.log.gz",
+		Filename: tmpFile.Name(),
+	}
+	if err := connPublisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	expected := map[string]interface{}{
+		"client_ip":                      "192.168.1.123",
+		"client_port":                    int64(35898),
+		"listener_port":                  int64(443),
+		"tls_protocol":                   "TLSv1.2",
+		"tls_cipher":                     "ECDHE-RSA-AES128-GCM-SHA256",
+		"tls_handshake_latency":          4.036,
+		"leaf_client_cert_subject":       "CN=amazon.com,OU=Amazon,O=Amazon,L=Seattle,ST=Washington,C=US",
+		"leaf_client_cert_validity":      "NotBefore=2023-09-21T22:43:21Z;NotAfter=2026-06-17T22:43:21Z",
+		"leaf_client_cert_serial_number": "FEF257D6C8D0E4A5",
+		"tls_verify_status":              "Failed:UntrustedCert",
+		"conn_trace_id":                  "TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2",
+		"elb":                            "app/my-lb/1db0c9806095122a",
+	}
+	ev := <-outCh
+	close(outCh)
+
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Error("Output did not match expected:")
+		for k, v := range ev.Data {
+			if reflect.DeepEqual(v, expected[k]) {
+				continue
+			}
+			log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+			log.Print("expected: ", k, "\t(", reflect.TypeOf(expected[k]), ") ", expected[k])
+		}
+		t.Fatal()
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 func TestALBParseEvents(t *testing.T) {
 	elbPubisher := NewALBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
-	outCh := make(chan event.Event)
+	outCh := make(chan event.Event, 1)
 	tmpFile, err := ioutil.TempFile("", "")
 	if err != nil {
 		t.Fatal("Shouldn't have err but did: ", err)
@@ -36,7 +36,7 @@ func TestALBParseEvents(t *testing.T) {
 		Object:   "foo",
 		Filename: tmpFile.Name(),
 	}
-	if err := elbPubisher.ParseEvents(obj, outCh); err != nil {
+	if err := elbPubisher.ParseEvents(obj, outCh, nil); err != nil {
 		t.Fatal("Shouldn't have err but did: ", err)
 	}
 	expected := map[string]interface{}{
@@ -90,3 +90,37 @@ func TestALBParseEvents(t *testing.T) {
 		t.Fatalf("actual duration_ms: %v, expected: %v", ev.Data["duration_ms"], excpectedDurMs)
 	}
 }
+
+func TestALBParseEventsConnTraceID(t *testing.T) {
+	elbPubisher := NewALBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`h2 2017-07-31T20:30:57.975041Z spline_reticulation_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 0.000016 200 200 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 groupARN "Root=1-5e71404d-84277a47a826ab3d2e844170" "ui-dogfood.honeycomb.io" "certARN" 0 2017-07-31T20:30:52.975041Z "forward" "-" "-" "10.11.12.13:80" "200" "-" "-" TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := elbPubisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	ev := <-outCh
+	close(outCh)
+
+	if ev.Data["conn_trace_id"] != "TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2" {
+		t.Fatalf("actual conn_trace_id: %v, expected: %v", ev.Data["conn_trace_id"], "TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2")
+	}
+}
@@ -0,0 +1,512 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const apiGatewayRequestTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var (
+	// $context variables in an access log format, e.g.
+	// $context.identity.sourceIp
+	apiGatewayVariableRegexp = regexp.MustCompile(`\$context\.[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*`)
+
+	// "key": "$context.variable" pairs in a JSON access log format. The
+	// quotes around the variable are optional.
+	apiGatewayJSONKeyRegexp = regexp.MustCompile(`"([^"]+)"\s*:\s*"?\$context\.([A-Za-z0-9_.]+)`)
+)
+
+// apiGatewayLogFormat describes a stage's access log format, which is made
+// up of $context variables chosen by the user. It is either JSON, in which
+// case the user's keys become the event fields, or a text format such as CLF
+// or CSV, in which case the variable names (without "$context.") do.
+type apiGatewayLogFormat struct {
+	json bool
+
+	// for text formats, the regexp matching a line and the variable
+	// captured by each group
+	re   *regexp.Regexp
+	vars []string
+
+	// event field name for each variable that appears in the format
+	fields map[string]string
+	// event fields of identifiers, e.g. requestId and accountId, which are
+	// kept as strings even if they look like numbers
+	ids map[string]bool
+}
+
+func parseAPIGatewayLogFormat(format string) (*apiGatewayLogFormat, error) {
+	format = strings.TrimSpace(format)
+	f := &apiGatewayLogFormat{fields: make(map[string]string), ids: make(map[string]bool)}
+
+	if strings.HasPrefix(format, "{") {
+		f.json = true
+		for _, match := range apiGatewayJSONKeyRegexp.FindAllStringSubmatch(format, -1) {
+			f.fields[match[2]] = match[1]
+		}
+		if len(f.fields) == 0 {
+			return nil, fmt.Errorf("no $context variables found in JSON access log format %q", format)
+		}
+		f.findIDs()
+		return f, nil
+	}
+
+	// Build a regexp out of the text format much like the nginx parser
+	// does: literal text is matched as is, and each variable matches
+	// everything up to the character following it.
+	locs := apiGatewayVariableRegexp.FindAllStringIndex(format, -1)
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("no $context variables found in access log format %q", format)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, loc := range locs {
+		expr.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		if loc[1] < len(format) {
+			expr.WriteString("([^" + regexp.QuoteMeta(format[loc[1]:loc[1]+1]) + "]*)")
+		} else {
+			expr.WriteString("(.*)")
+		}
+
+		variable := strings.TrimPrefix(format[loc[0]:loc[1]], "$context.")
+		f.vars = append(f.vars, variable)
+		f.fields[variable] = variable
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(format[last:]))
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	f.re = re
+	f.findIDs()
+
+	return f, nil
+}
+
+// findIDs records the fields of variables which are identifiers, e.g.
+// requestId and identity.accountId.
+func (f *apiGatewayLogFormat) findIDs() {
+	for variable, field := range f.fields {
+		if strings.HasSuffix(variable, "Id") {
+			f.ids[field] = true
+		}
+	}
+}
+
+// value returns the value of the $context variable in the event, if the
+// format includes it.
+func (f *apiGatewayLogFormat) value(data map[string]interface{}, variable string) (interface{}, bool) {
+	field, ok := f.fields[variable]
+	if !ok {
+		return nil, false
+	}
+	v, ok := data[field]
+	return v, ok
+}
+
+func (f *apiGatewayLogFormat) stringValue(data map[string]interface{}, variable string) string {
+	if v, ok := f.value(data, variable); ok {
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+// APIGatewayEventParser parses API Gateway access logs. Their format is
+// defined per stage, so each parser handles exactly one format.
+type APIGatewayEventParser struct {
+	sampler dynsampler.Sampler
+	format  *apiGatewayLogFormat
+	// CloudWatchLogs is set when the access logs are sent to CloudWatch
+	// Logs, in which case objects hold subscription payloads whose log
+	// events are access log lines.
+	CloudWatchLogs bool
+}
+
+func NewAPIGatewayEventParser(opt *options.Options, format string) *APIGatewayEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	logFormat, err := parseAPIGatewayLogFormat(format)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't understand API Gateway access log format")
+	}
+
+	ep := &APIGatewayEventParser{sampler: s, format: logFormat}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// addAPIGatewayTraceData fills in the same fields addTraceData does for load
+// balancers: the X-Ray trace ID (or the request ID when tracing isn't
+// enabled) is the trace, and each request is a span.
+func (ep *APIGatewayEventParser) addAPIGatewayTraceData(ev *event.Event) {
+	f := ep.format
+	requestID := f.stringValue(ev.Data, "requestId")
+	traceID := f.stringValue(ev.Data, "xrayTraceId")
+	if traceID == "" {
+		traceID = requestID
+	}
+	if traceID == "" {
+		return
+	}
+	ev.Data["trace.trace_id"] = strings.TrimPrefix(traceID, "Root=")
+	if requestID != "" {
+		ev.Data["trace.span_id"] = requestID
+	} else {
+		ev.Data["trace.span_id"] = ev.Data["trace.trace_id"]
+	}
+
+	if latency, ok := f.value(ev.Data, "responseLatency"); ok {
+		switch l := latency.(type) {
+		case int64:
+			ev.Data["duration_ms"] = float64(l)
+		case float64:
+			ev.Data["duration_ms"] = l
+		}
+	}
+
+	if apiID := f.stringValue(ev.Data, "apiId"); apiID != "" {
+		serviceName := apiID
+		if stage := f.stringValue(ev.Data, "stage"); stage != "" {
+			serviceName += "/" + stage
+		}
+		ev.Data["service_name"] = serviceName
+	} else if domainName := f.stringValue(ev.Data, "domainName"); domainName != "" {
+		ev.Data["service_name"] = domainName
+	}
+
+	for _, variable := range []string{"routeKey", "resourcePath", "path"} {
+		if name := f.stringValue(ev.Data, variable); name != "" {
+			ev.Data["name"] = name
+			break
+		}
+	}
+}
+
+// buildEvent turns the fields of one access log entry into an event, which
+// happened at received unless the format includes the request time.
+func (ep *APIGatewayEventParser) buildEvent(data map[string]interface{}, received time.Time) event.Event {
+	f := ep.format
+	ev := event.Event{Data: data}
+
+	if epoch, ok := f.value(data, "requestTimeEpoch"); ok {
+		if ms, ok := epoch.(int64); ok {
+			ev.Timestamp = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+		}
+	}
+	if ev.Timestamp.IsZero() {
+		if requestTime := f.stringValue(data, "requestTime"); requestTime != "" {
+			if t, err := time.Parse(apiGatewayRequestTimeFormat, requestTime); err == nil {
+				ev.Timestamp = t
+			}
+		}
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = received
+	}
+
+	// Put together a request line so that it is shaped like the load
+	// balancer requests (request_method, request_path, etc.).
+	if _, ok := data["request"]; !ok {
+		method := f.stringValue(data, "httpMethod")
+		path := f.stringValue(data, "path")
+		if path == "" {
+			path = f.stringValue(data, "resourcePath")
+		}
+		if method != "" && path != "" {
+			request := method + " " + path
+			if protocol := f.stringValue(data, "protocol"); protocol != "" {
+				request += " " + protocol
+			}
+			data["request"] = request
+		}
+	}
+
+	ep.addAPIGatewayTraceData(&ev)
+
+	return ev
+}
+
+// typeify typeifies the value of an event field, other than identifiers which
+// are only dropped if they're "-".
+func (f *apiGatewayLogFormat) typeify(field, v string) (interface{}, bool) {
+	if f.ids[field] {
+		return v, v != "-"
+	}
+	return typeifyValue(v)
+}
+
+// jsonData typeifies the fields of an entry in a JSON format.
+func (ep *APIGatewayEventParser) jsonData(raw map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			if typed, ok := ep.format.typeify(k, s); ok {
+				data[k] = typed
+			}
+			continue
+		}
+		data[k] = v
+	}
+	return data
+}
+
+// textData extracts the fields of a line in a text format, returning false if
+// it doesn't match.
+func (ep *APIGatewayEventParser) textData(line string) (map[string]interface{}, bool) {
+	values := ep.format.re.FindStringSubmatch(line)
+	if values == nil {
+		return nil, false
+	}
+
+	data := make(map[string]interface{}, len(ep.format.vars))
+	for i, variable := range ep.format.vars {
+		if typed, ok := ep.format.typeify(variable, values[i+1]); ok {
+			data[variable] = typed
+		}
+	}
+	return data, true
+}
+
+// splitJSONRecords is a bufio.SplitFunc which splits a stream of JSON objects
+// into records. Records delivered through Firehose aren't necessarily newline
+// delimited, so a record ends where its outermost object does. A malformed
+// record ends at the end of its line if it's part way through a string or
+// another record starts on the next, so that it doesn't take the rest of the
+// object with it.
+func splitJSONRecords(data []byte, atEOF bool) (int, []byte, error) {
+	start := 0
+	for start < len(data) && isJSONSpace(data[start]) {
+		start++
+	}
+	if start == len(data) {
+		return start, nil, nil
+	}
+
+	depth := 0
+	inString, escaped := false, false
+	for i := start; i < len(data); i++ {
+		c := data[i]
+		if c == '\n' {
+			next := i + 1
+			for next < len(data) && isJSONSpace(data[next]) {
+				next++
+			}
+			if next == len(data) && !atEOF {
+				// Need more data to know whether a record
+				// starts on the next line.
+				return start, nil, nil
+			}
+			// Strings can't span lines, so neither can a record
+			// which is in one.
+			if depth == 0 || inString || (next < len(data) && data[next] == '{') {
+				return i + 1, bytes.TrimSpace(data[start:i]), nil
+			}
+			continue
+		}
+		switch {
+		case inString && escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case inString:
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth <= 0 {
+				return i + 1, data[start : i+1], nil
+			}
+		}
+	}
+	if atEOF {
+		return len(data), bytes.TrimSpace(data[start:]), nil
+	}
+	return start, nil, nil
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (ep *APIGatewayEventParser) parseJSON(obj state.DownloadedObject, r io.Reader, out chan<- event.Event, report *LineReport) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitJSONRecords)
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &raw); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"line":   line,
+			}).Debug("API Gateway access log record is not valid JSON, skipping")
+			report.Failed(number, line, err)
+			continue
+		}
+
+		report.Send(out, ep.buildEvent(ep.jsonData(raw), time.Now()), number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *APIGatewayEventParser) parseText(obj state.DownloadedObject, r io.Reader, out chan<- event.Event, report *LineReport) error {
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			report.Skipped(number)
+			continue
+		}
+
+		data, ok := ep.textData(line)
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"line":   line,
+			}).Debug("API Gateway access log line does not match format, skipping")
+			report.Failed(number, line, fmt.Errorf("line does not match access log format"))
+			continue
+		}
+
+		report.Send(out, ep.buildEvent(data, time.Now()), number)
+	}
+
+	return scanner.Err()
+}
+
+// parseCloudWatchLogs parses the subscription payloads of the CloudWatch Logs
+// log group a stage sends its access logs to. Each log event is an access log
+// line, and counts as a line of the object.
+func (ep *APIGatewayEventParser) parseCloudWatchLogs(obj state.DownloadedObject, r io.Reader, out chan<- event.Event, report *LineReport) error {
+	dec := json.NewDecoder(r)
+	number := 0
+	for {
+		var envelope CloudWatchLogsEnvelope
+		if err := dec.Decode(&envelope); err == io.EOF {
+			return nil
+		} else if err != nil {
+			report.Failed(number+1, "", err)
+			return fmt.Errorf("Error decoding CloudWatch Logs payload in %s: %s", obj.Object, err)
+		}
+
+		if envelope.MessageType != cloudWatchLogsDataMessage {
+			number++
+			if !report.Resumed(number) {
+				report.Skipped(number)
+			}
+			continue
+		}
+
+		for _, logEvent := range envelope.LogEvents {
+			number++
+			if report.Resumed(number) {
+				continue
+			}
+
+			line := strings.TrimSpace(logEvent.Message)
+			var data map[string]interface{}
+			var err error
+			if ep.format.json {
+				var raw map[string]interface{}
+				if err = json.Unmarshal([]byte(line), &raw); err == nil {
+					data = ep.jsonData(raw)
+				}
+			} else if d, ok := ep.textData(line); ok {
+				data = d
+			} else {
+				err = fmt.Errorf("line does not match access log format")
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"object": obj.Object,
+					"line":   line,
+				}).Debug("API Gateway access log line does not match format, skipping")
+				report.Failed(number, line, err)
+				continue
+			}
+
+			report.Send(out, ep.buildEvent(data, time.Unix(0, logEvent.Timestamp*int64(time.Millisecond)).UTC()), number)
+		}
+	}
+}
+
+func (ep *APIGatewayEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	if ep.CloudWatchLogs {
+		return ep.parseCloudWatchLogs(obj, r, out, report)
+	}
+	if ep.format.json {
+		return ep.parseJSON(obj, r, out, report)
+	}
+	return ep.parseText(obj, r, out, report)
+}
+
+func (ep *APIGatewayEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// use status, method and resource to set sample rate, keyed
+		// per-API and stage
+		var key string
+		for _, variable := range []string{"status", "httpMethod", "routeKey", "resourcePath", "apiId", "stage"} {
+			if val, ok := ep.format.value(ev.Data, variable); ok {
+				key = fmt.Sprintf("%s_%v", key, val)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
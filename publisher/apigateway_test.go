@@ -0,0 +1,272 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/urlshaper"
+)
+
+func writeAPIGatewayLog(t *testing.T, contents string, gzipped bool) string {
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if gzipped {
+		w := gzip.NewWriter(tmpFile)
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+	} else if _, err := tmpFile.Write([]byte(contents)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	return tmpFile.Name()
+}
+
+func TestAPIGatewayParseEventsJSON(t *testing.T) {
+	format := `{ "requestId":"$context.requestId", "ip": "$context.identity.sourceIp", "requestTime":"$context.requestTimeEpoch", "httpMethod":"$context.httpMethod", "routeKey":"$context.routeKey", "status":$context.status, "protocol":"$context.protocol", "responseLength":"$context.responseLength", "latency":"$context.responseLatency", "apiId":"$context.apiId", "stage":"$context.stage", "xray":"$context.xrayTraceId" }`
+	ep := NewAPIGatewayEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, format)
+
+	// Firehose doesn't separate records, so the second one directly
+	// follows the first.
+	filename := writeAPIGatewayLog(t, `{"requestId":"abc-123","ip":"192.0.2.1","requestTime":"1696439400123","httpMethod":"GET","routeKey":"GET /pets/{id}","status":200,"protocol":"HTTP/1.1","responseLength":"42","latency":"17","apiId":"a1b2c3","stage":"prod","xray":"1-652ed8a8-1234567890abcdef12345678"}{"requestId":"def-456","ip":"192.0.2.2","requestTime":"1696439400456","httpMethod":"POST","routeKey":"POST /pets","status":500,"protocol":"HTTP/1.1","responseLength":"-","latency":"3","apiId":"a1b2c3","stage":"prod","xray":"-"}`, true)
+	defer os.Remove(filename)
+
+	outCh := make(chan event.Event, 2)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: filename}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+
+	expectedTime := time.Unix(1696439400, 123000000).UTC()
+	if !events[0].Timestamp.Equal(expectedTime) {
+		t.Errorf("Expected timestamp %s, got %s", expectedTime, events[0].Timestamp)
+	}
+
+	expected := map[string]interface{}{
+		"requestId":      "abc-123",
+		"ip":             "192.0.2.1",
+		"requestTime":    int64(1696439400123),
+		"httpMethod":     "GET",
+		"routeKey":       "GET /pets/{id}",
+		"status":         float64(200),
+		"protocol":       "HTTP/1.1",
+		"responseLength": int64(42),
+		"latency":        int64(17),
+		"apiId":          "a1b2c3",
+		"stage":          "prod",
+		"xray":           "1-652ed8a8-1234567890abcdef12345678",
+		// routeKey isn't a path, so no request line is built
+		"trace.trace_id": "1-652ed8a8-1234567890abcdef12345678",
+		"trace.span_id":  "abc-123",
+		"duration_ms":    float64(17),
+		"service_name":   "a1b2c3/prod",
+		"name":           "GET /pets/{id}",
+	}
+	if !reflect.DeepEqual(events[0].Data, expected) {
+		t.Errorf("Parsed event did not match:\n(expected)\t%v\n(actual)\t%v", expected, events[0].Data)
+	}
+
+	// Without X-Ray tracing the request ID is the trace ID.
+	if events[1].Data["trace.trace_id"] != "def-456" {
+		t.Errorf("Expected request ID as trace ID, got %v", events[1].Data["trace.trace_id"])
+	}
+	if _, ok := events[1].Data["responseLength"]; ok {
+		t.Error("Expected \"-\" value to be dropped")
+	}
+}
+
+func TestAPIGatewayParseEventsCLF(t *testing.T) {
+	format := `$context.identity.sourceIp $context.identity.caller $context.identity.user [$context.requestTime] "$context.httpMethod $context.resourcePath $context.protocol" $context.status $context.responseLength $context.requestId $context.extendedRequestId`
+	ep := NewAPIGatewayEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, format)
+
+	filename := writeAPIGatewayLog(t, "192.0.2.1 - - [04/Oct/2023:17:10:00 +0000] \"GET /pets/{petId} HTTP/1.1\" 404 37 c0ffee-1 Mx1aBc=\nnot an access log line\n", false)
+	defer os.Remove(filename)
+
+	outCh := make(chan event.Event, 2)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: filename}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+
+	expectedTime := time.Date(2023, time.October, 4, 17, 10, 0, 0, time.UTC)
+	if !events[0].Timestamp.Equal(expectedTime) {
+		t.Errorf("Expected timestamp %s, got %s", expectedTime, events[0].Timestamp)
+	}
+
+	expected := map[string]interface{}{
+		"identity.sourceIp": "192.0.2.1",
+		"requestTime":       "04/Oct/2023:17:10:00 +0000",
+		"httpMethod":        "GET",
+		"resourcePath":      "/pets/{petId}",
+		"protocol":          "HTTP/1.1",
+		"status":            int64(404),
+		"responseLength":    int64(37),
+		"requestId":         "c0ffee-1",
+		"extendedRequestId": "Mx1aBc=",
+		"request":           "GET /pets/{petId} HTTP/1.1",
+		"trace.trace_id":    "c0ffee-1",
+		"trace.span_id":     "c0ffee-1",
+		"name":              "/pets/{petId}",
+	}
+	if !reflect.DeepEqual(events[0].Data, expected) {
+		t.Errorf("Parsed event did not match:\n(expected)\t%v\n(actual)\t%v", expected, events[0].Data)
+	}
+}
+
+func TestAPIGatewayParseEventsMalformedJSON(t *testing.T) {
+	format := `{ "requestId":"$context.requestId", "accountId":"$context.identity.accountId", "status":"$context.status" }`
+	ep := NewAPIGatewayEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, format)
+
+	// the second record was cut short, the third isn't JSON at all
+	filename := writeAPIGatewayLog(t, `{"requestId":"123","accountId":"012345678901","status":"200"}
+{"requestId":"456","accountId":"0123
+not json
+{"requestId":"789","accountId":"012345678901","status":"404"}{"requestId":"-","status":"500"}`, false)
+	defer os.Remove(filename)
+
+	sink := &memoryDeadLetterSink{}
+	report := NewLineReport("foo", sink)
+	outCh := make(chan event.Event, 3)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: filename}, outCh, report); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	for i, id := range []string{"123", "789"} {
+		data := events[i].Data
+		if data["requestId"] != id || data["accountId"] != "012345678901" {
+			t.Errorf("expected identifiers to be kept as strings, got %v", data)
+		}
+	}
+	if events[1].Data["status"] != int64(404) {
+		t.Errorf("expected status to be typeified, got %v", events[1].Data["status"])
+	}
+	if _, ok := events[2].Data["requestId"]; ok {
+		t.Error("Expected \"-\" identifier to be dropped")
+	}
+
+	if counts := report.Counts(); counts.Failed != 2 || counts.Parsed != 3 {
+		t.Errorf("expected the malformed records to fail and the rest to be parsed, got %+v", counts)
+	}
+	expectedRaw := []string{`{"requestId":"456","accountId":"0123`, "not json"}
+	if len(sink.deadLetters) != len(expectedRaw) {
+		t.Fatalf("expected %d dead letters, got %v", len(expectedRaw), sink.deadLetters)
+	}
+	for i, raw := range expectedRaw {
+		if sink.deadLetters[i].Raw != raw || sink.deadLetters[i].Line != i+2 {
+			t.Errorf("expected dead letter %q on line %d, got %+v", raw, i+2, sink.deadLetters[i])
+		}
+	}
+}
+
+func TestParseAPIGatewayLogFormatErrors(t *testing.T) {
+	for _, format := range []string{"", "{}", "no variables here"} {
+		if _, err := parseAPIGatewayLogFormat(format); err == nil {
+			t.Errorf("Expected error for format %q", format)
+		}
+	}
+}
+
+func TestAPIGatewayRequestFieldNotString(t *testing.T) {
+	format := `{ "requestId":"$context.requestId", "request":"$context.requestOverride.header.x-request" }`
+	ep := NewAPIGatewayEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, format)
+
+	filename := writeAPIGatewayLog(t, `{"requestId":"abc-123","request":"42"}`+"\n"+`{"requestId":"def-456","request":true}`, false)
+	defer os.Remove(filename)
+
+	outCh := make(chan event.Event, 2)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: filename}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	// the request field is typeified like any other, and mustn't trip up
+	// the request shaping which every event goes through
+	shaper := requestShaper{&urlshaper.Parser{}}
+	expected := []interface{}{int64(42), true}
+	i := 0
+	for ev := range outCh {
+		shaper.Shape("request", &ev)
+		if ev.Data["request"] != expected[i] {
+			t.Errorf("expected request %v, got %v", expected[i], ev.Data["request"])
+		}
+		if _, ok := ev.Data["request_path"]; ok {
+			t.Errorf("expected a request which isn't a string not to be shaped, got %v", ev.Data)
+		}
+		i++
+	}
+	if i != 2 {
+		t.Fatalf("Expected 2 events, got %d", i)
+	}
+}
+
+func TestAPIGatewayParseEventsCloudWatchLogs(t *testing.T) {
+	format := `$context.identity.sourceIp $context.httpMethod $context.resourcePath $context.status $context.requestId`
+	ep := NewAPIGatewayEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, format)
+	ep.CloudWatchLogs = true
+
+	filename := writeAPIGatewayLog(t, `{"messageType":"CONTROL_MESSAGE","logEvents":[]}{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"API-Gateway-Access-Logs_a1b2c3/prod","logStream":"abc","subscriptionFilters":["honeycomb"],"logEvents":[{"id":"1","timestamp":1696439400123,"message":"192.0.2.1 GET /pets 200 abc-123"},{"id":"2","timestamp":1696439400456,"message":"bad line"}]}`, true)
+	defer os.Remove(filename)
+
+	report := NewLineReport("foo", nil)
+	outCh := make(chan event.Event, 2)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: filename}, outCh, report); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	ev := events[0]
+	if !ev.Timestamp.Equal(time.Unix(1696439400, 123000000)) {
+		t.Errorf("expected the time of the log event, got %v", ev.Timestamp)
+	}
+	if ev.Data["request"] != "GET /pets" || ev.Data["status"] != int64(200) || ev.Data["trace.trace_id"] != "abc-123" {
+		t.Errorf("unexpected event data %v", ev.Data)
+	}
+	if counts := report.Counts(); counts.Skipped != 1 || counts.Failed != 1 {
+		t.Errorf("expected the control message to be skipped and the bad line to fail, got %+v", counts)
+	}
+}
@@ -2,11 +2,8 @@ package publisher
 
 import (
 	"bufio"
-	"compress/gzip"
 	"fmt"
 	"math/rand"
-	"os"
-	"runtime"
 	"strings"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -14,12 +11,12 @@ import (
 	"github.com/honeycombio/honeyaws/sampler"
 	"github.com/honeycombio/honeyaws/state"
 	"github.com/honeycombio/honeytail/event"
-	"github.com/honeycombio/honeytail/parsers/nginx"
 	"github.com/sirupsen/logrus"
 )
 
 type CloudFrontEventParser struct {
 	sampler dynsampler.Sampler
+	lines   *nginxLineParser
 }
 
 func NewCloudFrontEventParser(opt *options.Options) *CloudFrontEventParser {
@@ -27,7 +24,10 @@ func NewCloudFrontEventParser(opt *options.Options) *CloudFrontEventParser {
 	if err != nil {
 		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
 	}
-	ep := &CloudFrontEventParser{sampler: s}
+	ep := &CloudFrontEventParser{
+		sampler: s,
+		lines:   newNginxLineParser(AWSCloudFrontWebFormat, "2006-01-02T15:04:05"),
+	}
 
 	if err := ep.sampler.Start(); err != nil {
 		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
@@ -36,44 +36,43 @@ func NewCloudFrontEventParser(opt *options.Options) *CloudFrontEventParser {
 	return ep
 }
 
-func (ep *CloudFrontEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
-	np := &nginx.Parser{}
-	err := np.Init(&nginx.Options{
-		ConfigFile:      formatFileName,
-		TimeFieldName:   "timestamp",
-		TimeFieldFormat: "2006-01-02T15:04:05",
-		LogFormatName:   AWSCloudFrontWebFormat,
-		NumParsers:      runtime.NumCPU(),
-	})
-	if err != nil {
-		logrus.Fatal("Can't initialize the nginx parser")
-	}
-
-	linesCh := make(chan string)
+func (ep *CloudFrontEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	linesCh := make(chan numberedLine)
+	done := make(chan struct{})
 
-	go np.ProcessLines(linesCh, out, nil)
+	go func() {
+		ep.lines.processLines(linesCh, out, report)
+		close(done)
+	}()
 
-	f, err := os.Open(obj.Filename)
+	r, err := openObject(obj.Filename)
 	if err != nil {
+		close(linesCh)
+		<-done
 		return err
 	}
 
-	defer f.Close()
-
-	r, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
+	defer r.Close()
 
 	scanner := bufio.NewScanner(r)
 
+	number := 0
 	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
 		line := scanner.Text()
 		if line == "" || strings.HasPrefix(line, "#") {
+			report.Skipped(number)
 			continue
 		}
 
 		splitLine := strings.Fields(line)
+		if len(splitLine) < 2 {
+			report.Failed(number, line, fmt.Errorf("CloudFront log line is missing date and time"))
+			continue
+		}
 
 		// Date and time are two separate fields instead of only one
 		// timestamp field, so join them together..
@@ -90,44 +89,45 @@ func (ep *CloudFrontEventParser) ParseEvents(obj state.DownloadedObject, out cha
 
 		// nginx parser is fickle about whitespace, so the join ensures
 		// that only one space exists between fields
-		linesCh <- strings.Join(splitLine, " ")
+		linesCh <- numberedLine{number: number, raw: line, line: strings.Join(splitLine, " ")}
 	}
 
 	close(linesCh)
+	<-done
 
-	return nil
+	return scanner.Err()
 }
 
 func (ep *CloudFrontEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
 	for ev := range in {
 		var key string
-		if backendStatusCode, ok := ev.Data["sc-status"]; ok {
+		if backendStatusCode, ok := ev.Data["sc_status"]; ok {
 			if bsc, ok := backendStatusCode.(int64); ok {
 				key = fmt.Sprintf("%d", bsc)
 			} else {
 				key = "0"
 				logrus.WithFields(logrus.Fields{
-					"field":    "sc-status",
+					"field":    "sc_status",
 					"intended": "int64",
 				}).Error("Did not cast field from access log correctly")
 			}
 		}
 
-		// Make sure sample rate is per-distribution (cs is the domain
-		// name of the CloudFront distribution)
-		if distributionDomain, ok := ev.Data["cs"]; ok {
+		// Make sure sample rate is per-distribution (cs_host is the
+		// domain name of the CloudFront distribution)
+		if distributionDomain, ok := ev.Data["cs_host"]; ok {
 			if name, ok := distributionDomain.(string); ok {
 				key = fmt.Sprintf("%s_%s", key, name)
 			}
 		}
 
-		if edgeResultType, ok := ev.Data["x-edge-result-type"]; ok {
+		if edgeResultType, ok := ev.Data["x_edge_result_type"]; ok {
 			if resultType, ok := edgeResultType.(string); ok {
 				key = fmt.Sprintf("%s_%s", key, resultType)
 			} else {
 				key = "0"
 				logrus.WithFields(logrus.Fields{
-					"field":    "x-edge-result-type",
+					"field":    "x_edge_result_type",
 					"intended": "string",
 				}).Error("Did not cast field from access log correctly")
 			}
@@ -0,0 +1,109 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// CloudFrontRealtimeEventParser parses CloudFront real-time logs, which are
+// tab-delimited records containing the fields selected in the real-time log
+// configuration, in that order. Field names follow the standard log events
+// (e.g., sc-status becomes sc_status), so that events are sampled the same
+// way by the embedded CloudFrontEventParser.
+type CloudFrontRealtimeEventParser struct {
+	*CloudFrontEventParser
+	fields []string
+}
+
+func NewCloudFrontRealtimeEventParser(opt *options.Options, fields []string) *CloudFrontRealtimeEventParser {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = strings.Replace(field, "-", "_", -1)
+	}
+
+	return &CloudFrontRealtimeEventParser{
+		CloudFrontEventParser: NewCloudFrontEventParser(opt),
+		fields:                names,
+	}
+}
+
+// parseRealtimeTimestamp parses the "timestamp" field of real-time logs,
+// seconds since the epoch with millisecond precision, e.g. 1598911234.123
+func parseRealtimeTimestamp(v string) (time.Time, error) {
+	parts := strings.SplitN(v, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		frac := (parts[1] + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+func (ep *CloudFrontRealtimeEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			report.Skipped(number)
+			continue
+		}
+
+		values := strings.Split(line, "\t")
+		if len(values) != len(ep.fields) {
+			logrus.WithFields(logrus.Fields{
+				"object":   obj.Object,
+				"fields":   len(values),
+				"expected": len(ep.fields),
+			}).Warn("Real-time log record doesn't match the configured field list, skipping")
+			report.Failed(number, line, fmt.Errorf("record has %d fields, expected %d", len(values), len(ep.fields)))
+			continue
+		}
+
+		ev := event.Event{Data: make(map[string]interface{}, len(values))}
+		for i, v := range values {
+			if ep.fields[i] == "timestamp" {
+				if t, err := parseRealtimeTimestamp(v); err == nil {
+					ev.Timestamp = t
+					continue
+				}
+			}
+			if typed, ok := typeifyValue(v); ok {
+				ev.Data[ep.fields[i]] = typed
+			}
+		}
+		if ev.Timestamp.IsZero() {
+			ev.Timestamp = time.Now()
+		}
+
+		report.Send(out, ev, number)
+	}
+
+	return scanner.Err()
+}
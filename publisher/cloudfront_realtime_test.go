@@ -0,0 +1,62 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestCloudFrontRealtimeParseEvents(t *testing.T) {
+	fields := []string{"timestamp", "c-ip", "sc-status", "cs-method", "cs-host", "cs-uri-stem", "time-taken", "x-edge-result-type", "cs-referer"}
+	ep := NewCloudFrontRealtimeEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"}, fields)
+
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte("1598911234.123\t192.0.2.10\t200\tGET\td111111abcdef8.cloudfront.net\t/index.html\t0.002\tHit\t-\nnot\tenough\tfields\n")); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	outCh := make(chan event.Event, 2)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: tmpFile.Name()}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+
+	expectedTime := time.Unix(1598911234, 123000000).UTC()
+	if !events[0].Timestamp.Equal(expectedTime) {
+		t.Errorf("Expected timestamp %s, got %s", expectedTime, events[0].Timestamp)
+	}
+
+	expected := map[string]interface{}{
+		"c_ip":               "192.0.2.10",
+		"sc_status":          int64(200),
+		"cs_method":          "GET",
+		"cs_host":            "d111111abcdef8.cloudfront.net",
+		"cs_uri_stem":        "/index.html",
+		"time_taken":         0.002,
+		"x_edge_result_type": "Hit",
+	}
+	if !reflect.DeepEqual(events[0].Data, expected) {
+		t.Errorf("Parsed event did not match:\n(expected)\t%v\n(actual)\t%v", expected, events[0].Data)
+	}
+}
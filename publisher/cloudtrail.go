@@ -1,12 +1,10 @@
 package publisher
 
 import (
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
-	"os"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -36,6 +34,7 @@ type CloudTrailRecords struct {
 
 type CloudTrailRecord struct {
 	UserIdentity      CloudTrailUserIdentity `json:"userIdentity"`
+	EventID           string                 `json:"eventID"`
 	EventTime         string                 `json:"eventTime"`
 	EventSource       string                 `json:"eventSource"`
 	EventName         string                 `json:"eventName"`
@@ -69,6 +68,10 @@ func flattenCloudTrailRecord(r *CloudTrailRecord) map[string]interface{} {
 	p["UserAgent"] = r.UserAgent
 	p["EventType"] = r.EventType
 	p["Parameters"] = r.RequestParameters
+	// The event ID is only used for --event_ids, and isn't sent.
+	if r.EventID != "" {
+		p[recordIDField] = r.EventID
+	}
 
 	return p
 }
@@ -88,60 +91,89 @@ func NewCloudTrailEventParser(opt *options.Options) *CloudTrailEventParser {
 }
 
 // we have to wrap events ourselves due to there being no existing parsers
-func (ep *CloudTrailEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
+func (ep *CloudTrailEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
 
-	f, err := os.Open(obj.Filename)
+	r, err := openObject(obj.Filename)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-
-	r, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
 	defer r.Close()
 
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"object": obj,
-			"err":    err,
-		}).Debug("Error parsing")
-		return err
-	}
-
+	// Log files delivered to S3 hold a single object with the events in
+	// Records, while events delivered through Firehose are one object each,
+	// either bare or wrapped by EventBridge in "detail". Each event counts
+	// as a line of the object.
 	dec := json.NewDecoder(r)
-	var rec CloudTrailRecords
+	number := 0
 	for {
-		if err := dec.Decode(&rec); err == io.EOF {
-			break
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
 		} else if err != nil {
-			logrus.Fatal(err)
+			// The decoder can't pick up after a syntax error, so the
+			// rest of the object is lost.
+			report.Failed(number+1, "", err)
+			return fmt.Errorf("Error decoding CloudTrail log in %s: %s", obj.Object, err)
 		}
-	}
-
-	timeFormat := "2006-01-02T15:04:05Z"
 
-	// parse records one at a time
-	// TODO: do we want to thread?
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			number++
+			report.Failed(number, string(raw), err)
+			continue
+		}
 
-	for _, record := range rec.Records {
-		t, err := time.Parse(timeFormat, record.EventTime)
+		if records, ok := fields["Records"]; ok {
+			var rawRecords []json.RawMessage
+			if err := json.Unmarshal(records, &rawRecords); err != nil {
+				number++
+				report.Failed(number, string(raw), err)
+				continue
+			}
+			for _, rawRecord := range rawRecords {
+				number++
+				if report.Resumed(number) {
+					continue
+				}
+				ep.parseRecord(rawRecord, number, out, report)
+			}
+			continue
+		}
 
-		if err != nil {
-			logrus.Fatal(err)
+		if detail, ok := fields["detail"]; ok {
+			raw = detail
 		}
-		omap := flattenCloudTrailRecord(&record)
-		e := event.Event{
-			Timestamp: t,
-			Data:      omap,
+		number++
+		if report.Resumed(number) {
+			continue
 		}
-		logrus.WithField("event", e).Info("Event parsing")
-		out <- e
+		ep.parseRecord(raw, number, out, report)
 	}
+}
 
-	return nil
+// parseRecord sends the event for a single CloudTrail record, numbered from 1
+// within its object.
+func (ep *CloudTrailEventParser) parseRecord(raw json.RawMessage, number int, out chan<- event.Event, report *LineReport) {
+	var record CloudTrailRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		report.Failed(number, string(raw), err)
+		return
+	}
+
+	t, err := time.Parse("2006-01-02T15:04:05Z", record.EventTime)
+	if err != nil {
+		report.Failed(number, string(raw), err)
+		return
+	}
+
+	omap := flattenCloudTrailRecord(&record)
+	e := event.Event{
+		Timestamp: t,
+		Data:      omap,
+	}
+	logrus.WithField("event", e).Info("Event parsing")
+	report.Send(out, e, number)
 }
 
 // samples every rate for event
@@ -0,0 +1,59 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestCloudTrailParseEvents(t *testing.T) {
+	ep := NewCloudTrailEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	// A log file as delivered to S3, followed by a bare event and an
+	// EventBridge event as delivered through Firehose.
+	w := gzip.NewWriter(tmpFile)
+	w.Write([]byte(`{"Records":[{"eventTime":"2024-01-02T03:04:05Z","eventSource":"s3.amazonaws.com","eventName":"GetObject","eventID":"6c7d8f38-0c4b-4f4a-9a3e-3d1f3e0b5c2a"}]}
+{"eventTime":"2024-01-02T03:04:06Z","eventSource":"ec2.amazonaws.com","eventName":"RunInstances"}
+{"version":"0","detail-type":"AWS API Call via CloudTrail","resources":["arn:aws:iam::123456789012:role/foo"],"detail":{"eventTime":"2024-01-02T03:04:07Z","eventSource":"iam.amazonaws.com","eventName":"CreateRole"}}
+`))
+	if err := w.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	outCh := make(chan event.Event, 3)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: tmpFile.Name()}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	expected := []string{"GetObject", "RunInstances", "CreateRole"}
+	var names []string
+	for ev := range outCh {
+		names = append(names, ev.Data["EventName"].(string))
+		if _, ok := ev.Data["EventID"]; ok {
+			t.Error("expected the event ID not to be among the fields sent")
+		}
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected events %v, got %v", expected, names)
+		}
+	}
+}
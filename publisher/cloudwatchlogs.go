@@ -0,0 +1,285 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const cloudWatchLogsDataMessage = "DATA_MESSAGE"
+
+var (
+	// Lambda writes a REPORT line at the end of each invocation, e.g.
+	// REPORT RequestId: 8f507cfc-...	Duration: 102.25 ms	Billed Duration: 103 ms	Memory Size: 128 MB	Max Memory Used: 71 MB	Init Duration: 146.71 ms
+	lambdaReportFields = []struct {
+		re    *regexp.Regexp
+		field string
+	}{
+		{regexp.MustCompile(`\bDuration: ([0-9.]+) ms`), "duration_ms"},
+		{regexp.MustCompile(`Billed Duration: ([0-9.]+) ms`), "billed_duration_ms"},
+		{regexp.MustCompile(`Memory Size: ([0-9]+) MB`), "memory_size_mb"},
+		{regexp.MustCompile(`Max Memory Used: ([0-9]+) MB`), "max_memory_used_mb"},
+		{regexp.MustCompile(`Init Duration: ([0-9.]+) ms`), "init_duration_ms"},
+	}
+	lambdaRequestIDRegexp = regexp.MustCompile(`^(?:START|END|REPORT) RequestId: ([0-9a-f-]+)`)
+	lambdaTraceIDRegexp   = regexp.MustCompile(`XRAY TraceId: ([0-9a-f-]+)`)
+
+	exportTaskIDRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// CloudWatchLogsEnvelope is the payload sent to subscription filter
+// destinations, gzipped, by CloudWatch Logs.
+type CloudWatchLogsEnvelope struct {
+	MessageType         string                   `json:"messageType"`
+	Owner               string                   `json:"owner"`
+	LogGroup            string                   `json:"logGroup"`
+	LogStream           string                   `json:"logStream"`
+	SubscriptionFilters []string                 `json:"subscriptionFilters"`
+	LogEvents           []CloudWatchLogsLogEvent `json:"logEvents"`
+}
+
+type CloudWatchLogsLogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// CloudWatchLogsEventParser parses log events from CloudWatch Logs, either
+// subscription filter payloads (delivered through Kinesis or Firehose) or
+// objects written by an export task to S3. Messages which are JSON or Lambda
+// REPORT lines are parsed into fields.
+type CloudWatchLogsEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewCloudWatchLogsEventParser(opt *options.Options) *CloudWatchLogsEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+	ep := &CloudWatchLogsEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// parseLambdaMessage adds the request ID, X-Ray trace ID and metrics of Lambda
+// START, END and REPORT lines to the event data.
+func parseLambdaMessage(message string, data map[string]interface{}) {
+	match := lambdaRequestIDRegexp.FindStringSubmatch(message)
+	if match == nil {
+		return
+	}
+	data["request_id"] = match[1]
+
+	if !strings.HasPrefix(message, "REPORT ") {
+		return
+	}
+	data["message_type"] = "report"
+	for _, f := range lambdaReportFields {
+		if m := f.re.FindStringSubmatch(message); m != nil {
+			if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+				data[f.field] = v
+			}
+		}
+	}
+	if m := lambdaTraceIDRegexp.FindStringSubmatch(message); m != nil {
+		data["xray_trace_id"] = m[1]
+	}
+}
+
+// cloudWatchLogsEventData builds the data of the event for a log message.
+func cloudWatchLogsEventData(message string, metadata map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(metadata)+1)
+
+	message = strings.TrimRight(message, "\n")
+	trimmed := strings.TrimSpace(message)
+
+	var fields map[string]interface{}
+	if strings.HasPrefix(trimmed, "{") && json.Unmarshal([]byte(trimmed), &fields) == nil {
+		for k, v := range fields {
+			data[k] = v
+		}
+		data["message_type"] = "json"
+	} else {
+		parseLambdaMessage(message, data)
+		data["message"] = message
+	}
+
+	// Metadata wins over fields from the message, so that events can
+	// always be found by log group and stream.
+	for k, v := range metadata {
+		data[k] = v
+	}
+
+	return data
+}
+
+// parseEnvelopes parses subscription payloads, in which each log event counts
+// as a line of the object.
+func (ep *CloudWatchLogsEventParser) parseEnvelopes(obj state.DownloadedObject, r io.Reader, out chan<- event.Event, report *LineReport) error {
+	dec := json.NewDecoder(r)
+	number := 0
+	for {
+		var envelope CloudWatchLogsEnvelope
+		if err := dec.Decode(&envelope); err == io.EOF {
+			return nil
+		} else if err != nil {
+			report.Failed(number+1, "", err)
+			return fmt.Errorf("Error decoding CloudWatch Logs payload in %s: %s", obj.Object, err)
+		}
+
+		// Control messages are only sent to check that the
+		// destination is reachable.
+		if envelope.MessageType != cloudWatchLogsDataMessage {
+			number++
+			if !report.Resumed(number) {
+				report.Skipped(number)
+			}
+			continue
+		}
+
+		metadata := map[string]interface{}{
+			"log_group":  envelope.LogGroup,
+			"log_stream": envelope.LogStream,
+			"owner":      envelope.Owner,
+		}
+
+		for _, logEvent := range envelope.LogEvents {
+			number++
+			if report.Resumed(number) {
+				continue
+			}
+
+			data := cloudWatchLogsEventData(logEvent.Message, metadata)
+			data["log_event_id"] = logEvent.ID
+
+			report.Send(out, event.Event{
+				Timestamp: time.Unix(0, logEvent.Timestamp*int64(time.Millisecond)).UTC(),
+				Data:      data,
+			}, number)
+		}
+	}
+}
+
+// logStreamFromExportObject recovers the log stream from the name of an
+// object written by an export task, <prefix>/<task id>/<log stream>/000000.gz
+// Log stream names can contain slashes, so everything between the task ID
+// and the object's base name is the stream.
+func logStreamFromExportObject(object string) string {
+	parts := strings.Split(path.Dir(object), "/")
+	for i, part := range parts {
+		if exportTaskIDRegexp.MatchString(part) {
+			return strings.Join(parts[i+1:], "/")
+		}
+	}
+	return parts[len(parts)-1]
+}
+
+// parseExport parses an object written by an export task, which holds the log
+// events of one stream as "<RFC 3339 timestamp> <message>" lines.
+func (ep *CloudWatchLogsEventParser) parseExport(obj state.DownloadedObject, r io.Reader, out chan<- event.Event, report *LineReport) error {
+	metadata := map[string]interface{}{
+		"log_stream": logStreamFromExportObject(obj.Object),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			report.Skipped(number)
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil || len(parts) != 2 {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"line":   line,
+			}).Debug("CloudWatch Logs export line has no timestamp, skipping")
+			if err == nil {
+				err = fmt.Errorf("line has no message")
+			}
+			report.Failed(number, line, err)
+			continue
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: t,
+			Data:      cloudWatchLogsEventData(parts[1], metadata),
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *CloudWatchLogsEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	rc, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	// Subscription payloads are JSON, export lines start with a
+	// timestamp.
+	r := bufio.NewReader(rc)
+	start, _ := r.Peek(1)
+	if bytes.Equal(start, []byte("{")) {
+		return ep.parseEnvelopes(obj, r, out, report)
+	}
+	return ep.parseExport(obj, r, out, report)
+}
+
+func (ep *CloudWatchLogsEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// sample per log group and kind of message, so that Lambda
+		// REPORT lines aren't drowned out by application logging
+		var key string
+		if logGroup, ok := ev.Data["log_group"].(string); ok {
+			key = logGroup
+		}
+		if messageType, ok := ev.Data["message_type"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, messageType)
+		}
+		if level, ok := ev.Data["level"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, level)
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
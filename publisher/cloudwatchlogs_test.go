@@ -0,0 +1,130 @@
+package publisher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	return buf.Bytes()
+}
+
+func parseCloudWatchLogs(t *testing.T, object string, contents []byte) []event.Event {
+	ep := NewCloudWatchLogsEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(contents); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	outCh := make(chan event.Event, 10)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: object, Filename: tmpFile.Name()}, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	var events []event.Event
+	for ev := range outCh {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestCloudWatchLogsParseEnvelopes(t *testing.T) {
+	// Records delivered through Kinesis or Firehose are each gzipped on
+	// their own, and are concatenated.
+	contents := append(
+		gzipped(t, `{"messageType":"CONTROL_MESSAGE","owner":"CloudwatchLogs","logGroup":"","logStream":"","subscriptionFilters":[],"logEvents":[{"id":"","timestamp":1700000000000,"message":"CWL CONTROL MESSAGE: Checking health of destination Kinesis stream."}]}`),
+		gzipped(t, `{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"/aws/lambda/my-function","logStream":"2024/01/02/[$LATEST]abcdef","subscriptionFilters":["honeycomb"],"logEvents":[`+
+			`{"id":"1","timestamp":1700000000000,"message":"{\"level\":\"info\",\"msg\":\"hello\",\"log_group\":\"nope\"}\n"},`+
+			`{"id":"2","timestamp":1700000000100,"message":"REPORT RequestId: 8f507cfc-1234-5678-9abc-def012345678\tDuration: 102.25 ms\tBilled Duration: 103 ms\tMemory Size: 128 MB\tMax Memory Used: 71 MB\tInit Duration: 146.71 ms\t\nXRAY TraceId: 1-5e1b4151-43a0913a12345678901234567\tSegmentId: 1234567890abcdef\tSampled: true\t\n"},`+
+			`{"id":"3","timestamp":1700000000200,"message":"plain text"}]}`)...,
+	)
+
+	events := parseCloudWatchLogs(t, "firehose/abc", contents)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	metadata := map[string]interface{}{
+		"log_group":  "/aws/lambda/my-function",
+		"log_stream": "2024/01/02/[$LATEST]abcdef",
+		"owner":      "123456789012",
+	}
+	expected := []map[string]interface{}{
+		{"level": "info", "msg": "hello", "message_type": "json", "log_event_id": "1"},
+		{
+			"message":            "REPORT RequestId: 8f507cfc-1234-5678-9abc-def012345678\tDuration: 102.25 ms\tBilled Duration: 103 ms\tMemory Size: 128 MB\tMax Memory Used: 71 MB\tInit Duration: 146.71 ms\t\nXRAY TraceId: 1-5e1b4151-43a0913a12345678901234567\tSegmentId: 1234567890abcdef\tSampled: true\t",
+			"message_type":       "report",
+			"request_id":         "8f507cfc-1234-5678-9abc-def012345678",
+			"duration_ms":        102.25,
+			"billed_duration_ms": float64(103),
+			"memory_size_mb":     float64(128),
+			"max_memory_used_mb": float64(71),
+			"init_duration_ms":   146.71,
+			"xray_trace_id":      "1-5e1b4151-43a0913a12345678901234567",
+			"log_event_id":       "2",
+		},
+		{"message": "plain text", "log_event_id": "3"},
+	}
+	for i := range expected {
+		for k, v := range metadata {
+			expected[i][k] = v
+		}
+		if !reflect.DeepEqual(events[i].Data, expected[i]) {
+			t.Errorf("Parsed event did not match:\n(expected)\t%v\n(actual)\t%v", expected[i], events[i].Data)
+		}
+	}
+
+	if !events[1].Timestamp.Equal(time.Unix(1700000000, 100000000)) {
+		t.Errorf("Unexpected timestamp %s", events[1].Timestamp)
+	}
+}
+
+func TestCloudWatchLogsParseExport(t *testing.T) {
+	contents := gzipped(t, "2024-01-02T03:04:05.678Z START RequestId: 8f507cfc-1234-5678-9abc-def012345678 Version: $LATEST\n2024-01-02T03:04:06.000Z {\"level\":\"error\"}\n")
+
+	events := parseCloudWatchLogs(t, "exportedlogs/0b4b7e8f-2a2e-4c67-9f3d-1e2a3b4c5d6e/2024/01/02/[$LATEST]abcdef/000000.gz", contents)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+
+	expected := map[string]interface{}{
+		"message":    "START RequestId: 8f507cfc-1234-5678-9abc-def012345678 Version: $LATEST",
+		"request_id": "8f507cfc-1234-5678-9abc-def012345678",
+		"log_stream": "2024/01/02/[$LATEST]abcdef",
+	}
+	if !reflect.DeepEqual(events[0].Data, expected) {
+		t.Errorf("Parsed event did not match:\n(expected)\t%v\n(actual)\t%v", expected, events[0].Data)
+	}
+	if !events[0].Timestamp.Equal(time.Date(2024, time.January, 2, 3, 4, 5, 678000000, time.UTC)) {
+		t.Errorf("Unexpected timestamp %s", events[0].Timestamp)
+	}
+	if events[1].Data["level"] != "error" {
+		t.Errorf("Expected JSON message to be parsed, got %v", events[1].Data)
+	}
+}
@@ -0,0 +1,130 @@
+package publisher
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventIDField is the field deterministic event IDs are sent in.
+	EventIDField = "event_id"
+
+	// lineField carries the object and line an event was parsed from
+	// until it's given an ID, and is never sent.
+	lineField = "honeyaws.line"
+
+	// recordIDField carries the ID of the record an event was parsed
+	// from, for services whose events don't otherwise include it, and is
+	// never sent.
+	recordIDField = "honeyaws.record_id"
+)
+
+// sourceLine is where an event was parsed from.
+type sourceLine struct {
+	object string
+	number int
+}
+
+// recordIDFields are the fields of services which give each record an ID of
+// its own, which is used as the event ID so that a record delivered in two
+// objects is recognised as the same.
+var recordIDFields = []string{
+	recordIDField,       // CloudTrail
+	"x_edge_request_id", // CloudFront (standard and real-time)
+	"log_event_id",      // CloudWatch Logs subscriptions
+}
+
+// eventID is the ID of an event: the ID of its record if it has one,
+// otherwise a hash of the object and line it was parsed from. It's empty if
+// the event has neither.
+func eventID(ev event.Event) string {
+	for _, f := range recordIDFields {
+		if id, ok := ev.Data[f].(string); ok && id != "" && id != "-" {
+			return id
+		}
+	}
+
+	line, ok := ev.Data[lineField].(sourceLine)
+	if !ok || line.object == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(line.object + "\x00" + strconv.Itoa(line.number)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Deduplicator remembers the IDs of the events seen within a window, up to
+// a maximum number of them, forgetting the oldest first.
+type Deduplicator struct {
+	Window  time.Duration
+	MaxSize int
+
+	mu    sync.Mutex
+	order *list.List // of seenID, oldest at the back
+	seen  map[string]*list.Element
+}
+
+type seenID struct {
+	id string
+	at time.Time
+}
+
+func NewDeduplicator(window time.Duration, maxSize int) *Deduplicator {
+	return &Deduplicator{
+		Window:  window,
+		MaxSize: maxSize,
+		order:   list.New(),
+		seen:    make(map[string]*list.Element),
+	}
+}
+
+// Seen records that an event with the ID was seen at now, returning whether
+// one already had been within the window.
+func (d *Deduplicator) Seen(id string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for e := d.order.Back(); e != nil && now.Sub(e.Value.(seenID).at) > d.Window; e = d.order.Back() {
+		d.forget(e)
+	}
+
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+
+	for d.order.Len() > 0 && d.order.Len() >= d.MaxSize {
+		d.forget(d.order.Back())
+	}
+	d.seen[id] = d.order.PushFront(seenID{id, now})
+	return false
+}
+
+// forget removes an ID; d.mu must be held.
+func (d *Deduplicator) forget(e *list.Element) {
+	delete(d.seen, e.Value.(seenID).id)
+	d.order.Remove(e)
+}
+
+// identifyEvents gives the events parsed from objects IDs, and drops those
+// which the deduplicator (if any) has seen already.
+func identifyEvents(in <-chan event.Event, out chan<- event.Event, dedup *Deduplicator) {
+	for ev := range in {
+		id := eventID(ev)
+		delete(ev.Data, lineField)
+		delete(ev.Data, recordIDField)
+		if id != "" {
+			ev.Data[EventIDField] = id
+			if dedup != nil && dedup.Seen(id, time.Now()) {
+				logrus.WithField("event_id", id).Debug("Dropping duplicate event")
+				continue
+			}
+		}
+		out <- ev
+	}
+}
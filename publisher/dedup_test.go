@@ -0,0 +1,75 @@
+package publisher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 2)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if d.Seen("a", now) {
+		t.Error("expected a not to have been seen")
+	}
+	if !d.Seen("a", now.Add(30*time.Second)) {
+		t.Error("expected a to have been seen within the window")
+	}
+	if d.Seen("a", now.Add(2*time.Minute)) {
+		t.Error("expected a to be forgotten after the window")
+	}
+
+	// the oldest IDs are forgotten beyond the maximum size
+	d.Seen("b", now.Add(2*time.Minute))
+	d.Seen("c", now.Add(2*time.Minute))
+	if d.Seen("a", now.Add(2*time.Minute)) {
+		t.Error("expected a to be forgotten beyond the maximum size")
+	}
+	if !d.Seen("c", now.Add(2*time.Minute)) {
+		t.Error("expected c to have been seen")
+	}
+}
+
+func TestIdentifyEvents(t *testing.T) {
+	report := NewLineReport("AWSLogs/foo.log", nil)
+	report.identify = true
+	parsed := make(chan event.Event, 10)
+	for _, number := range []int{1, 2, 1} {
+		report.Send(parsed, event.Event{Data: map[string]interface{}{}}, number)
+	}
+	report.Send(parsed, event.Event{Data: map[string]interface{}{recordIDField: "6c7d8f38-0c4b-4f4a-9a3e-3d1f3e0b5c2a"}}, 3)
+	report.Send(parsed, event.Event{Data: map[string]interface{}{recordIDField: "6c7d8f38-0c4b-4f4a-9a3e-3d1f3e0b5c2a"}}, 4)
+	close(parsed)
+
+	out := make(chan event.Event, 10)
+	identifyEvents(parsed, out, NewDeduplicator(time.Minute, 100))
+	close(out)
+
+	var ids []string
+	for ev := range out {
+		if _, ok := ev.Data[lineField]; ok {
+			t.Error("expected the line not to be sent")
+		}
+		ids = append(ids, ev.Data[EventIDField].(string))
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected the duplicates of lines 1 and 3 to be dropped, got IDs %v", ids)
+	}
+	if ids[0] == ids[1] || len(ids[0]) != 32 {
+		t.Errorf("expected distinct hashes of the lines, got %v", ids)
+	}
+	if ids[2] != "6c7d8f38-0c4b-4f4a-9a3e-3d1f3e0b5c2a" {
+		t.Errorf("expected the ID of the record, got %s", ids[2])
+	}
+
+	// the same line of another object has another ID
+	other := NewLineReport("AWSLogs/bar.log", nil)
+	other.identify = true
+	ch := make(chan event.Event, 1)
+	other.Send(ch, event.Event{Data: map[string]interface{}{}}, 1)
+	if id := eventID(<-ch); id == ids[0] {
+		t.Error("expected lines of different objects to have different IDs")
+	}
+}
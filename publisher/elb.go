@@ -4,21 +4,24 @@ import (
 	"bufio"
 	"fmt"
 	"math/rand"
-	"os"
-	"runtime"
 	"strings"
+	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/sampler"
 	"github.com/honeycombio/honeyaws/state"
 	"github.com/honeycombio/honeytail/event"
-	"github.com/honeycombio/honeytail/parsers/nginx"
 	"github.com/sirupsen/logrus"
 )
 
+// Classic ELB TCP and SSL listeners log the same fields as HTTP(S) ones, with
+// placeholders for everything which only makes sense for a request.
+const elbConnectionPlaceholders = ` "- - - " "-" `
+
 type ELBEventParser struct {
 	sampler dynsampler.Sampler
+	lines   *nginxLineParser
 }
 
 func NewELBEventParser(opt *options.Options) *ELBEventParser {
@@ -27,7 +30,10 @@ func NewELBEventParser(opt *options.Options) *ELBEventParser {
 		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
 	}
 
-	ep := &ELBEventParser{sampler: s}
+	ep := &ELBEventParser{
+		sampler: s,
+		lines:   newNginxLineParser(AWSElasticLoadBalancerFormat, "2006-01-02T15:04:05.9999Z"),
+	}
 
 	if err := ep.sampler.Start(); err != nil {
 		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
@@ -36,45 +42,96 @@ func NewELBEventParser(opt *options.Options) *ELBEventParser {
 	return ep
 }
 
-func (ep *ELBEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
-	np := &nginx.Parser{}
-	err := np.Init(&nginx.Options{
-		ConfigFile:      formatFileName,
-		TimeFieldName:   "timestamp",
-		TimeFieldFormat: "2006-01-02T15:04:05.9999Z",
-		LogFormatName:   AWSElasticLoadBalancerFormat,
-		NumParsers:      runtime.NumCPU(),
-	})
-	if err != nil {
-		logrus.Fatal("Can't initialize the nginx parser")
-	}
+func (ep *ELBEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	linesCh := make(chan numberedLine)
+	done := make(chan struct{})
 
-	linesCh := make(chan string)
+	go func() {
+		ep.lines.processLines(linesCh, out, report)
+		close(done)
+	}()
 
-	go np.ProcessLines(linesCh, out, nil)
-
-	f, err := os.Open(obj.Filename)
+	r, err := openObject(obj.Filename)
 	if err != nil {
+		close(linesCh)
+		<-done
 		return err
 	}
 
-	defer f.Close()
+	defer r.Close()
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 
+	number := 0
 	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
 		line := scanner.Text()
 		if line == "" || strings.HasPrefix(line, "#") {
+			report.Skipped(number)
 			continue
 		}
-		linesCh <- line
+		if ev, ok := parseELBConnectionLine(line); ok {
+			report.Send(out, ev, number)
+			continue
+		}
+		linesCh <- numberedLine{number: number, raw: line, line: line}
 	}
 
 	close(linesCh)
+	<-done
 
 	return scanner.Err()
 }
 
+// parseELBConnectionLine parses a line logged by a TCP or SSL listener into a
+// connection event, with type set to "tcp" or "ssl" like the type of ALB and
+// NLB log entries. Lines logged for HTTP(S) requests are reported as !ok.
+//
+// Example lines:
+// 2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.001065 0.000015 0.000023 - - 57 502 "- - - " "-" - -
+// 2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.001065 0.000015 0.000023 - - 57 502 "- - - " "-" ECDHE-ECDSA-AES128-GCM-SHA256 TLSv1.2
+func parseELBConnectionLine(line string) (event.Event, bool) {
+	i := strings.Index(line, elbConnectionPlaceholders)
+	if i < 0 {
+		return event.Event{}, false
+	}
+
+	names := []string{
+		"timestamp", "elb", "client_authority", "backend_authority",
+		"request_processing_time", "backend_processing_time", "response_processing_time",
+		"elb_status_code", "backend_status_code", "received_bytes", "sent_bytes",
+	}
+	values := strings.Fields(line[:i])
+	tls := strings.Fields(line[i+len(elbConnectionPlaceholders):])
+	if len(values) != len(names) || len(tls) != 2 {
+		return event.Event{}, false
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, values[0])
+	if err != nil {
+		return event.Event{}, false
+	}
+
+	data := make(map[string]interface{}, len(names)+2)
+	for i, name := range names[1:] {
+		if typed, ok := typeifyValue(values[i+1]); ok {
+			data[name] = typed
+		}
+	}
+
+	data["type"] = "tcp"
+	if tls[0] != "-" {
+		data["type"] = "ssl"
+		data["ssl_cipher"] = tls[0]
+		data["ssl_protocol"] = tls[1]
+	}
+
+	return event.Event{Timestamp: timestamp, Data: data}, true
+}
+
 func (ep *ELBEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
 	for ev := range in {
 		// use backend_status_code and elb_status_code to set sample rate
@@ -105,6 +162,11 @@ func (ep *ELBEventParser) DynSample(in <-chan event.Event, out chan<- event.Even
 			}
 		}
 
+		// TCP and SSL connections don't have status codes
+		if connType, ok := ev.Data["type"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, connType)
+		}
+
 		// Make sure sample rate is per-ELB
 		if elbName, ok := ev.Data["elb"]; ok {
 			if name, ok := elbName.(string); ok {
@@ -1,11 +1,13 @@
 package publisher
 
 import (
+	"compress/gzip"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/honeycombio/honeyaws/options"
 	"github.com/honeycombio/honeyaws/state"
@@ -14,7 +16,7 @@ import (
 
 func TestNginxParseEvents(t *testing.T) {
 	elbPubisher := NewELBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
-	outCh := make(chan event.Event)
+	outCh := make(chan event.Event, 1)
 	tmpFile, err := ioutil.TempFile("", "")
 	if err != nil {
 		t.Fatal("Shouldn't have err but did: ", err)
@@ -30,7 +32,7 @@ func TestNginxParseEvents(t *testing.T) {
 		Object:   "foo",
 		Filename: tmpFile.Name(),
 	}
-	if err := elbPubisher.ParseEvents(obj, outCh); err != nil {
+	if err := elbPubisher.ParseEvents(obj, outCh, nil); err != nil {
 		t.Fatal("Shouldn't have err but did: ", err)
 	}
 	expected := map[string]interface{}{
@@ -60,3 +62,116 @@ func TestNginxParseEvents(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestELBParseEventsGzipped(t *testing.T) {
+	elbPublisher := NewELBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`2017-07-31T20:30:57.975041Z spline_reticulation_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 -1 504 504 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	go func() {
+		if err := elbPublisher.ParseEvents(obj, outCh, nil); err != nil {
+			t.Error("Shouldn't have err but did: ", err)
+		}
+	}()
+
+	evData := (<-outCh).Data
+	if evData["request"] != "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" {
+		t.Errorf("unexpected request %v", evData["request"])
+	}
+	if evData["elb_status_code"] != int64(504) {
+		t.Errorf("unexpected elb_status_code %v", evData["elb_status_code"])
+	}
+}
+
+func TestELBParseConnectionEvents(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected map[string]interface{}
+	}{
+		{
+			line: `2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.001065 0.000015 0.000023 - - 57 502 "- - - " "-" - -`,
+			expected: map[string]interface{}{
+				"elb":                      "my-loadbalancer",
+				"client_authority":         "192.168.131.39:2817",
+				"backend_authority":        "10.0.0.1:80",
+				"request_processing_time":  0.001065,
+				"backend_processing_time":  0.000015,
+				"response_processing_time": 0.000023,
+				"received_bytes":           int64(57),
+				"sent_bytes":               int64(502),
+				"type":                     "tcp",
+			},
+		},
+		{
+			line: `2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.001065 0.000015 0.000023 - - 57 502 "- - - " "-" ECDHE-ECDSA-AES128-GCM-SHA256 TLSv1.2`,
+			expected: map[string]interface{}{
+				"elb":                      "my-loadbalancer",
+				"client_authority":         "192.168.131.39:2817",
+				"backend_authority":        "10.0.0.1:80",
+				"request_processing_time":  0.001065,
+				"backend_processing_time":  0.000015,
+				"response_processing_time": 0.000023,
+				"received_bytes":           int64(57),
+				"sent_bytes":               int64(502),
+				"type":                     "ssl",
+				"ssl_cipher":               "ECDHE-ECDSA-AES128-GCM-SHA256",
+				"ssl_protocol":             "TLSv1.2",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		elbPublisher := NewELBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+		outCh := make(chan event.Event, 1)
+		tmpFile, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := tmpFile.Write([]byte(tc.line + "\n")); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := tmpFile.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		obj := state.DownloadedObject{
+			Object:   "foo",
+			Filename: tmpFile.Name(),
+		}
+		if err := elbPublisher.ParseEvents(obj, outCh, nil); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		ev := <-outCh
+		close(outCh)
+
+		if !ev.Timestamp.Equal(time.Date(2015, time.May, 13, 23, 39, 43, 945958000, time.UTC)) {
+			t.Errorf("unexpected timestamp %v", ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Error("Output did not match expected:")
+			for k, v := range ev.Data {
+				log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+				log.Print("expected: ", k, "\t(", reflect.TypeOf(tc.expected[k]), ") ", tc.expected[k])
+			}
+			t.Fatal()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// Fields of a Global Accelerator flow log record, in order. Unlike VPC flow
+// logs the format can't be customized and objects have no header line, but
+// older records end before the newer fields do.
+var globalAcceleratorFlowLogFields = []string{
+	"version",
+	"aws_account_id",
+	"accelerator_id",
+	"client_ip",
+	"client_port",
+	"gip",
+	"gip_port",
+	"endpoint_ip",
+	"endpoint_port",
+	"protocol",
+	"ip_address_type",
+	"numpackets",
+	"numbytes",
+	"start_time",
+	"end_time",
+	"action",
+	"log_status",
+	"globalaccelerator_source_ip",
+	"globalaccelerator_source_port",
+	"endpoint_region",
+	"globalaccelerator_region",
+	"direction",
+	"vpc_id",
+	"reject_reason",
+}
+
+// Every version of the format has the fields up to and including log_status.
+const globalAcceleratorFlowLogMinFields = 17
+
+type GlobalAcceleratorEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewGlobalAcceleratorEventParser(opt *options.Options) *GlobalAcceleratorEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &GlobalAcceleratorEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// Example object contents:
+// 1.0 123456789012 123e4567-e89b-12d3-a456-426655440000 198.51.100.1 42297 192.0.2.1 443 10.0.1.5 443 TCP IPV4 10 3200 1587586024 1587586084 ACCEPT OK 10.0.1.254 50000 us-east-1 us-west-2 INGRESS vpc-0123456789abcdef0
+func (ep *GlobalAcceleratorEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "version ") {
+			report.Skipped(number)
+			continue
+		}
+
+		values := strings.Fields(line)
+		if len(values) > len(globalAcceleratorFlowLogFields) || len(values) < globalAcceleratorFlowLogMinFields {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"actual": len(values),
+			}).Debug("Global Accelerator flow log record has an unexpected number of fields, skipping")
+			report.Failed(number, line, fmt.Errorf("record has %d fields", len(values)))
+			continue
+		}
+
+		data := make(map[string]interface{}, len(values)+2)
+		for i, v := range values {
+			if typed, ok := typeifyValue(v); ok {
+				data[globalAcceleratorFlowLogFields[i]] = typed
+			}
+		}
+
+		// Client IPs are preserved by the accelerator for load balancer
+		// endpoints, so this matches client_authority in ALB access
+		// logs for the same connection.
+		if ip, ok := data["client_ip"].(string); ok {
+			if port, ok := data["client_port"].(int64); ok {
+				data["client_authority"] = fmt.Sprintf("%s:%d", ip, port)
+			}
+		}
+		if ip, ok := data["endpoint_ip"].(string); ok {
+			if port, ok := data["endpoint_port"].(int64); ok {
+				data["endpoint_authority"] = fmt.Sprintf("%s:%d", ip, port)
+			}
+		}
+
+		// Records without a start time (e.g. NODATA) are timestamped
+		// when we read them.
+		timestamp := time.Now()
+		if start, ok := data["start_time"].(int64); ok {
+			timestamp = time.Unix(start, 0).UTC()
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: timestamp,
+			Data:      data,
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *GlobalAcceleratorEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// action (ACCEPT/REJECT) and log_status are what we care the
+		// most about, so that rejected traffic and skipped records
+		// aren't drowned out by accepted traffic, keyed per-accelerator
+		// and endpoint region
+		var key string
+		for _, field := range []string{"action", "log_status", "protocol", "accelerator_id", "endpoint_region"} {
+			if val, ok := ev.Data[field]; ok {
+				key = fmt.Sprintf("%s_%v", key, val)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
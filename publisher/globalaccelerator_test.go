@@ -0,0 +1,125 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestGlobalAcceleratorParseEvents(t *testing.T) {
+	testCases := []struct {
+		contents  string
+		timestamp time.Time
+		expected  map[string]interface{}
+	}{
+		{
+			contents: `1.0 123456789012 123e4567-e89b-12d3-a456-426655440000 198.51.100.1 42297 192.0.2.1 443 10.0.1.5 443 TCP IPV4 10 3200 1587586024 1587586084 ACCEPT OK 10.0.1.254 50000 us-east-1 us-west-2 INGRESS vpc-0123456789abcdef0
+`,
+			timestamp: time.Unix(1587586024, 0).UTC(),
+			expected: map[string]interface{}{
+				"version":                       float64(1),
+				"aws_account_id":                int64(123456789012),
+				"accelerator_id":                "123e4567-e89b-12d3-a456-426655440000",
+				"client_ip":                     "198.51.100.1",
+				"client_port":                   int64(42297),
+				"client_authority":              "198.51.100.1:42297",
+				"gip":                           "192.0.2.1",
+				"gip_port":                      int64(443),
+				"endpoint_ip":                   "10.0.1.5",
+				"endpoint_port":                 int64(443),
+				"endpoint_authority":            "10.0.1.5:443",
+				"protocol":                      "TCP",
+				"ip_address_type":               "IPV4",
+				"numpackets":                    int64(10),
+				"numbytes":                      int64(3200),
+				"start_time":                    int64(1587586024),
+				"end_time":                      int64(1587586084),
+				"action":                        "ACCEPT",
+				"log_status":                    "OK",
+				"globalaccelerator_source_ip":   "10.0.1.254",
+				"globalaccelerator_source_port": int64(50000),
+				"endpoint_region":               "us-east-1",
+				"globalaccelerator_region":      "us-west-2",
+				"direction":                     "INGRESS",
+				"vpc_id":                        "vpc-0123456789abcdef0",
+			},
+		},
+		{
+			// older records end earlier, "-" values are dropped
+			contents: `1.0 123456789012 123e4567-e89b-12d3-a456-426655440000 198.51.100.1 42298 192.0.2.1 443 - - TCP IPV4 1 40 1587586024 1587586084 REJECT OK
+`,
+			timestamp: time.Unix(1587586024, 0).UTC(),
+			expected: map[string]interface{}{
+				"version":          float64(1),
+				"aws_account_id":   int64(123456789012),
+				"accelerator_id":   "123e4567-e89b-12d3-a456-426655440000",
+				"client_ip":        "198.51.100.1",
+				"client_port":      int64(42298),
+				"client_authority": "198.51.100.1:42298",
+				"gip":              "192.0.2.1",
+				"gip_port":         int64(443),
+				"protocol":         "TCP",
+				"ip_address_type":  "IPV4",
+				"numpackets":       int64(1),
+				"numbytes":         int64(40),
+				"start_time":       int64(1587586024),
+				"end_time":         int64(1587586084),
+				"action":           "REJECT",
+				"log_status":       "OK",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		ep := NewGlobalAcceleratorEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+		outCh := make(chan event.Event, 1)
+		tmpFile, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		zipper := gzip.NewWriter(tmpFile)
+		if _, err := zipper.Write([]byte(tc.contents)); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := zipper.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := tmpFile.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		obj := state.DownloadedObject{
+			Object:   "foo",
+			Filename: tmpFile.Name(),
+		}
+		if err := ep.ParseEvents(obj, outCh, nil); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		ev := <-outCh
+		close(outCh)
+
+		if !ev.Timestamp.Equal(tc.timestamp) {
+			t.Errorf("actual timestamp: %v, expected: %v", ev.Timestamp, tc.timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Error("Output did not match expected:")
+			for k, v := range ev.Data {
+				if reflect.DeepEqual(v, tc.expected[k]) {
+					continue
+				}
+				log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+				log.Print("expected: ", k, "\t(", reflect.TypeOf(tc.expected[k]), ") ", tc.expected[k])
+			}
+			t.Fatal()
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	networkFirewallEventTypeAlert = "alert"
+
+	// Suricata's EVE timestamps, e.g. 2020-10-13T22:10:01.006481+0000
+	networkFirewallTimestampFormat = "2006-01-02T15:04:05.999999-0700"
+)
+
+// NetworkFirewallRecord is the AWS envelope around each Suricata EVE JSON
+// event written by Network Firewall.
+type NetworkFirewallRecord struct {
+	FirewallName     string                 `json:"firewall_name"`
+	AvailabilityZone string                 `json:"availability_zone"`
+	EventTimestamp   json.Number            `json:"event_timestamp"`
+	Event            map[string]interface{} `json:"event"`
+}
+
+// NetworkFirewallEventParser parses Network Firewall alert and flow logs,
+// JSON lines with one Suricata event each.
+type NetworkFirewallEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewNetworkFirewallEventParser(opt *options.Options) *NetworkFirewallEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &NetworkFirewallEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// flattenNetworkFirewallValue adds v to p under key, with nested objects
+// (alert, flow, netflow, http, tls, etc.) becoming dotted fields such as
+// alert.signature or flow.bytes_toserver.
+func flattenNetworkFirewallValue(p map[string]interface{}, key string, v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, nested := range val {
+			flattenNetworkFirewallValue(p, key+"."+k, nested)
+		}
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			p[key] = i
+		} else if u, err := strconv.ParseUint(val.String(), 10, 64); err == nil {
+			// flow IDs can use all 64 bits
+			p[key] = u
+		} else if f, err := val.Float64(); err == nil {
+			p[key] = f
+		} else {
+			p[key] = val.String()
+		}
+	case []interface{}:
+		// e.g. alert.metadata values; keep them searchable as JSON
+		if b, err := json.Marshal(val); err == nil {
+			p[key] = string(b)
+		}
+	case nil:
+	default:
+		p[key] = val
+	}
+}
+
+// Helper function for flattening Network Firewall records. The envelope's
+// fields are kept as is and the Suricata event is flattened alongside them.
+func flattenNetworkFirewallRecord(r *NetworkFirewallRecord) map[string]interface{} {
+	p := make(map[string]interface{})
+
+	p["firewall_name"] = r.FirewallName
+	p["availability_zone"] = r.AvailabilityZone
+
+	for k, v := range r.Event {
+		// the timestamp becomes the event's
+		if k == "timestamp" {
+			continue
+		}
+		flattenNetworkFirewallValue(p, k, v)
+	}
+
+	return p
+}
+
+func (ep *NetworkFirewallEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			report.Skipped(number)
+			continue
+		}
+
+		// flow_id doesn't fit in a float64, so keep numbers as they
+		// are written until flattening
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+
+		var record NetworkFirewallRecord
+		if err := dec.Decode(&record); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"error":  err,
+			}).Debug("Couldn't unmarshal Network Firewall log record, skipping")
+			report.Failed(number, string(line), err)
+			continue
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: networkFirewallTimestamp(&record),
+			Data:      flattenNetworkFirewallRecord(&record),
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+// networkFirewallTimestamp prefers the precise time of the Suricata event,
+// falling back to the envelope's epoch seconds.
+func networkFirewallTimestamp(r *NetworkFirewallRecord) time.Time {
+	if ts, ok := r.Event["timestamp"].(string); ok {
+		if t, err := time.Parse(networkFirewallTimestampFormat, ts); err == nil {
+			return t.UTC()
+		}
+	}
+	if secs, err := r.EventTimestamp.Int64(); err == nil {
+		return time.Unix(secs, 0).UTC()
+	}
+	return time.Now()
+}
+
+func (ep *NetworkFirewallEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		eventType, _ := ev.Data["event_type"].(string)
+
+		// Alerts are what people look at firewall logs for, so keep
+		// every one of them.
+		if eventType == networkFirewallEventTypeAlert {
+			ev.SampleRate = 1
+			out <- ev
+			continue
+		}
+
+		key := eventType
+		for _, field := range []string{"proto", "app_proto"} {
+			if val, ok := ev.Data[field].(string); ok {
+				key = fmt.Sprintf("%s_%s", key, val)
+			}
+		}
+
+		// Make sure sample rate is per-firewall
+		if name, ok := ev.Data["firewall_name"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, name)
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
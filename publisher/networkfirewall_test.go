@@ -0,0 +1,132 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestNetworkFirewallParseEvents(t *testing.T) {
+	networkFirewallPublisher := NewNetworkFirewallEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 2)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`{"firewall_name":"test-firewall","availability_zone":"us-east-1b","event_timestamp":"1602627001","event":{"timestamp":"2020-10-13T22:10:01.006481+0000","flow_id":1582438383425873,"event_type":"alert","src_ip":"203.0.113.4","src_port":55555,"dest_ip":"192.0.2.16","dest_port":111,"proto":"TCP","alert":{"action":"blocked","signature_id":5,"rev":0,"signature":"test_tcp","category":"","severity":1}}}
+{"firewall_name":"test-firewall","availability_zone":"us-east-1b","event_timestamp":"1602627060","event":{"timestamp":"2020-10-13T22:11:00.000000+0000","flow_id":18446744073709551615,"event_type":"netflow","src_ip":"192.0.2.16","src_port":443,"dest_ip":"203.0.113.4","dest_port":55556,"proto":"TCP","app_proto":"tls","netflow":{"pkts":9,"bytes":1488,"start":"2020-10-13T22:10:58.120120+0000","end":"2020-10-13T22:10:59.401234+0000","age":1,"min_ttl":63,"max_ttl":63}}}
+`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := networkFirewallPublisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	expected := []struct {
+		timestamp time.Time
+		data      map[string]interface{}
+	}{
+		{
+			time.Date(2020, time.October, 13, 22, 10, 1, 6481000, time.UTC),
+			map[string]interface{}{
+				"firewall_name":      "test-firewall",
+				"availability_zone":  "us-east-1b",
+				"flow_id":            int64(1582438383425873),
+				"event_type":         "alert",
+				"src_ip":             "203.0.113.4",
+				"src_port":           int64(55555),
+				"dest_ip":            "192.0.2.16",
+				"dest_port":          int64(111),
+				"proto":              "TCP",
+				"alert.action":       "blocked",
+				"alert.signature_id": int64(5),
+				"alert.rev":          int64(0),
+				"alert.signature":    "test_tcp",
+				"alert.category":     "",
+				"alert.severity":     int64(1),
+			},
+		},
+		{
+			time.Date(2020, time.October, 13, 22, 11, 0, 0, time.UTC),
+			map[string]interface{}{
+				"firewall_name":     "test-firewall",
+				"availability_zone": "us-east-1b",
+				"flow_id":           uint64(18446744073709551615),
+				"event_type":        "netflow",
+				"src_ip":            "192.0.2.16",
+				"src_port":          int64(443),
+				"dest_ip":           "203.0.113.4",
+				"dest_port":         int64(55556),
+				"proto":             "TCP",
+				"app_proto":         "tls",
+				"netflow.pkts":      int64(9),
+				"netflow.bytes":     int64(1488),
+				"netflow.start":     "2020-10-13T22:10:58.120120+0000",
+				"netflow.end":       "2020-10-13T22:10:59.401234+0000",
+				"netflow.age":       int64(1),
+				"netflow.min_ttl":   int64(63),
+				"netflow.max_ttl":   int64(63),
+			},
+		},
+	}
+
+	for _, exp := range expected {
+		ev := <-outCh
+		if !ev.Timestamp.Equal(exp.timestamp) {
+			t.Errorf("unexpected timestamp %v, expected %v", ev.Timestamp, exp.timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, exp.data) {
+			t.Error("Output did not match expected:")
+			for k, v := range ev.Data {
+				if reflect.DeepEqual(v, exp.data[k]) {
+					continue
+				}
+				log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+				log.Print("expected: ", k, "\t(", reflect.TypeOf(exp.data[k]), ") ", exp.data[k])
+			}
+			t.Fatal()
+		}
+	}
+}
+
+func TestNetworkFirewallDynSampleKeepsAlerts(t *testing.T) {
+	// a sampler that would drop (nearly) everything
+	networkFirewallPublisher := NewNetworkFirewallEventParser(&options.Options{SampleRate: 1000000, SamplerType: "simple", SamplerInterval: 300})
+	in := make(chan event.Event)
+	out := make(chan event.Event, 100)
+	go networkFirewallPublisher.DynSample(in, out)
+
+	for i := 0; i < 100; i++ {
+		in <- event.Event{Data: map[string]interface{}{"event_type": "alert", "proto": "TCP", "firewall_name": "test-firewall"}}
+	}
+	close(in)
+
+	for i := 0; i < 100; i++ {
+		ev := <-out
+		if ev.SampleRate != 1 {
+			t.Fatalf("expected alert to be kept with sample rate 1, got %d", ev.SampleRate)
+		}
+	}
+}
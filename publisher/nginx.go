@@ -0,0 +1,111 @@
+package publisher
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/honeycombio/gonx"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/sirupsen/logrus"
+)
+
+// numberedLine is a line of an object along with its line number (from 1).
+// Some formats are massaged before parsing, so the line as it was read is
+// kept for the dead-letter sink.
+type numberedLine struct {
+	number    int
+	raw, line string
+}
+
+// nginxLineParser parses lines in one of the formats of formatFileName much
+// like the honeytail nginx parser does, except that lines which don't match
+// the format are reported rather than dropped.
+type nginxLineParser struct {
+	// parsers are tried in order, the first being the current format and
+	// the rest older ones, until one matches.
+	parsers    []*gonx.Parser
+	timeFormat string
+}
+
+// newNginxLineParser returns a parser for the format, which also accepts
+// lines in the older formats given, e.g. from before fields were added to
+// the end of it.
+func newNginxLineParser(formatName, timeFormat string, olderFormatNames ...string) *nginxLineParser {
+	np := &nginxLineParser{timeFormat: timeFormat}
+	for _, name := range append([]string{formatName}, olderFormatNames...) {
+		np.parsers = append(np.parsers, newNginxParser(name))
+	}
+	return np
+}
+
+func newNginxParser(formatName string) *gonx.Parser {
+	conf, err := os.Open(formatFileName)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Can't initialize the nginx parser")
+	}
+	defer conf.Close()
+
+	parser, err := gonx.NewNginxParser(conf, formatName)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Can't initialize the nginx parser")
+	}
+
+	return parser
+}
+
+// parseLine parses a single line into an event timestamped by its
+// "timestamp" field, which all of our formats have.
+func (np *nginxLineParser) parseLine(line string) (event.Event, error) {
+	line = strings.TrimSpace(line)
+	entry, err := np.parsers[0].ParseString(line)
+	for _, parser := range np.parsers[1:] {
+		if err == nil {
+			break
+		}
+		entry, err = parser.ParseString(line)
+	}
+	if err != nil {
+		return event.Event{}, err
+	}
+
+	data := make(map[string]interface{}, len(entry.Fields))
+	for k, v := range entry.Fields {
+		if typed, ok := typeifyValue(v); ok {
+			data[k] = typed
+		}
+	}
+
+	return event.Event{
+		Timestamp: httime.GetTimestamp(data, "timestamp", np.timeFormat),
+		Data:      data,
+	}, nil
+}
+
+// processLines parses the lines received with one goroutine per CPU until
+// the channel is closed and all of them have been sent on.
+func (np *nginxLineParser) processLines(lines <-chan numberedLine, out chan<- event.Event, report *LineReport) {
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lines {
+				ev, err := np.parseLine(l.line)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"object": report.objectName(),
+						"line":   l.number,
+						"error":  err,
+					}).Debug("Failed to parse log line")
+					report.Failed(l.number, l.raw, err)
+					continue
+				}
+				report.Send(out, ev, l.number)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,123 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// NLBEventParser parses Network Load Balancer access logs. NLBs only write
+// access logs for TLS listeners, so each line describes a TLS connection
+// rather than an HTTP request.
+type NLBEventParser struct {
+	sampler dynsampler.Sampler
+	lines   *nginxLineParser
+}
+
+func NewNLBEventParser(opt *options.Options) *NLBEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &NLBEventParser{
+		sampler: s,
+		lines:   newNginxLineParser(AWSNetworkLoadBalancerFormat, "2006-01-02T15:04:05"),
+	}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+func (ep *NLBEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	linesCh := make(chan numberedLine)
+	done := make(chan struct{})
+
+	go func() {
+		ep.lines.processLines(linesCh, out, report)
+		close(done)
+	}()
+
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		close(linesCh)
+		<-done
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			report.Skipped(number)
+			continue
+		}
+		linesCh <- numberedLine{number: number, raw: line, line: line}
+	}
+
+	close(linesCh)
+	<-done
+
+	return scanner.Err()
+}
+
+func (ep *NLBEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// incoming_tls_alert is only set when the client sent a TLS
+		// alert (usually a failed handshake), so use it along with the
+		// listener to set sample rate
+		key := "none"
+		if incomingAlert, ok := ev.Data["incoming_tls_alert"]; ok {
+			key = fmt.Sprintf("%v", incomingAlert)
+		}
+
+		if listener, ok := ev.Data["listener"]; ok {
+			if l, ok := listener.(string); ok {
+				key = fmt.Sprintf("%s_%s", key, l)
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"field":       "listener",
+					"intended":    "string",
+					"actual_val":  listener,
+					"actual_type": fmt.Sprintf("%T", listener),
+				}).Error("Did not cast field from access log correctly")
+			}
+		}
+
+		// Make sure sample rate is per-NLB
+		if elbName, ok := ev.Data["elb"]; ok {
+			if name, ok := elbName.(string); ok {
+				key = fmt.Sprintf("%s_%s", key, name)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
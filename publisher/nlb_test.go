@@ -0,0 +1,76 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestNLBParseEvents(t *testing.T) {
+	nlbPublisher := NewNLBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com h2 h2 "h2","http/1.1" 2018-12-20T02:59:30`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := nlbPublisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	expected := map[string]interface{}{
+		"type":                         "tls",
+		"version":                      2.0,
+		"elb":                          "net/my-network-loadbalancer/c6e77e28c25b2234",
+		"listener":                     "g3d4b5e8bb8464cd",
+		"client_authority":             "72.21.218.154:51341",
+		"backend_authority":            "172.100.100.185:443",
+		"connection_time":              int64(5),
+		"tls_handshake_time":           int64(2),
+		"received_bytes":               int64(98),
+		"sent_bytes":                   int64(246),
+		"chosen_cert_arn":              "arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99",
+		"ssl_cipher":                   "ECDHE-RSA-AES128-SHA",
+		"ssl_protocol":                 "tlsv12",
+		"domain_name":                  "my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com",
+		"alpn_fe_protocol":             "h2",
+		"alpn_be_protocol":             "h2",
+		"alpn_client_preference_list":  `"h2","http/1.1"`,
+		"tls_connection_creation_time": "2018-12-20T02:59:30",
+	}
+	ev := <-outCh
+	close(outCh)
+
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Error("Output did not match expected:")
+		for k, v := range ev.Data {
+			if reflect.DeepEqual(v, expected[k]) {
+				continue
+			}
+			log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+			log.Print("expected: ", k, "\t(", reflect.TypeOf(expected[k]), ") ", expected[k])
+		}
+		t.Fatal()
+	}
+}
@@ -1,10 +1,16 @@
 package publisher
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/honeycombio/honeyaws/options"
@@ -16,9 +22,19 @@ import (
 )
 
 const (
-	AWSApplicationLoadBalancerFormat = "aws_alb"
-	AWSElasticLoadBalancerFormat     = "aws_elb"
-	AWSCloudFrontWebFormat           = "aws_cf_web"
+	AWSApplicationLoadBalancerFormat           = "aws_alb"
+	AWSApplicationLoadBalancerConnectionFormat = "aws_alb_conn"
+	AWSNetworkLoadBalancerFormat               = "aws_nlb"
+	AWSElasticLoadBalancerFormat               = "aws_elb"
+	AWSCloudFrontWebFormat                     = "aws_cf_web"
+
+	// ALB access log lines written before conn_trace_id was added to the
+	// end of the format don't have it.
+	awsApplicationLoadBalancerFormatWithoutConnTraceID = "aws_alb_without_conn_trace_id"
+
+	// checkpointField carries a checkpoint through sampling to the point
+	// where an event is handed to libhoney, and is never sent.
+	checkpointField = "honeyaws.checkpoint"
 )
 
 var (
@@ -28,16 +44,28 @@ var (
 	// Example ALB log format (aws_elbv2):
 	// h2 2023-09-26T21:12:00.951475Z app/alb-name/cd02e94b08136065 10.11.12.13:47882 10.3.47.87:8080 0.000 0.003 0.000 200 200 47 258 "GET https://api.simulation.io:443/reticulate/spline/ HTTP/2.0" "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-1:123321:targetgroup/target-group-name/55f5bbaecb7cd4b2 "Root=1-65134920-5f5a22aa51fbe54353e16dcb" "app.simulation.io" "arn:aws:acm:us-east-1:123321:certificate/4c8788c1-b87a-4d6f-a48a-bc5e5b206e21" 9 2023-09-26T21:12:00.948000Z "forward" "-" "-" "10.0.26.59:80" "200" "-" "-"
 	//
+	// Example ALB connection log format (aws_alb_conn):
+	// 2023-10-04T17:10:20.203353Z 192.168.1.123 35898 443 TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256 4.036 "CN=amazon.com,OU=Amazon,O=Amazon,L=Seattle,ST=Washington,C=US" NotBefore=2023-09-21T22:43:21Z;NotAfter=2026-06-17T22:43:21Z FEF257D6C8D0E4A5 Success TID_1ec5b8bf5a8d6f4bb7e5a8d8f5c2a4d2
+	//
+	// Example NLB TLS log format (aws_nlb):
+	// tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com h2 h2 "h2","http/1.1" 2018-12-20T02:59:30
+	//
 	// Example CloudFront log format (aws_cf_web):
 	// 2014-05-23 01:13:11 FRA2 182 192.0.2.10 GET d111111abcdef8.cloudfront.net /view/my/file.html 200 www.displaymyfiles.com Mozilla/4.0%20(compatible;%20MSIE%205.0b1;%20Mac_PowerPC) - zip=98101 RefreshHit MRVMF7KydIvxMWfJIglgwHQwZsbG2IhRJ07sn9AkKUFSHS9EXAMPLE== d111111abcdef8.cloudfront.net http - 0.001 - - - RefreshHit HTTP/1.1
 
 	logFormat = []byte(fmt.Sprintf(
 		`log_format %s '$timestamp $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol';
 log_format %s '$timestamp $x_edge_location $sc_bytes $c_ip $cs_method $cs_host $cs_uri_stem $sc_status $cs_referer $cs_user_agent $cs_uri_query $cs_cookie $x_edge_result_type $x_edge_request_id $x_host_header $cs_protocol $cs_bytes $time_taken $x_forwarded_for $ssl_protocol $ssl_cipher $x_edge_response_result_type $cs_protocol_version';
-log_format %s '$type $response_time $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol $target_group_arn "$trace_id" "$domain_name" "$chosen_cert_arn" $matched_rule_priority $timestamp "$actions_executed" "$redirect_url" "$error_reason" "$target_port_list" "$target_status_code_list" "$classification" "$classification_reason"';`,
+log_format %s '$type $response_time $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol $target_group_arn "$trace_id" "$domain_name" "$chosen_cert_arn" $matched_rule_priority $timestamp "$actions_executed" "$redirect_url" "$error_reason" "$target_port_list" "$target_status_code_list" "$classification" "$classification_reason" $conn_trace_id';
+log_format %s '$type $response_time $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol $target_group_arn "$trace_id" "$domain_name" "$chosen_cert_arn" $matched_rule_priority $timestamp "$actions_executed" "$redirect_url" "$error_reason" "$target_port_list" "$target_status_code_list" "$classification" "$classification_reason"';
+log_format %s '$timestamp $client_ip $client_port $listener_port $tls_protocol $tls_cipher $tls_handshake_latency "$leaf_client_cert_subject" $leaf_client_cert_validity $leaf_client_cert_serial_number $tls_verify_status $conn_trace_id';
+log_format %s '$type $version $timestamp $elb $listener $client_authority $backend_authority $connection_time $tls_handshake_time $received_bytes $sent_bytes $incoming_tls_alert $chosen_cert_arn $chosen_cert_serial $ssl_cipher $ssl_protocol $tls_named_group $domain_name $alpn_fe_protocol $alpn_be_protocol $alpn_client_preference_list $tls_connection_creation_time';`,
 		AWSElasticLoadBalancerFormat,
 		AWSCloudFrontWebFormat,
 		AWSApplicationLoadBalancerFormat,
+		awsApplicationLoadBalancerFormatWithoutConnTraceID,
+		AWSApplicationLoadBalancerConnectionFormat,
+		AWSNetworkLoadBalancerFormat,
 	))
 	libhoneyInitialized = false
 	formatFileName      string
@@ -64,20 +92,25 @@ func init() {
 type Publisher interface {
 	// Publish accepts an io.Reader and scans it line-by-line, parses the
 	// relevant event from each line (using EventParser), and sends to the
-	// target (Honeycomb).
-	Publish(f state.DownloadedObject) error
+	// target (Honeycomb). If ctx is done before the object has been
+	// published, the rest of it may be abandoned, to be picked up from its
+	// offset the next time it's published.
+	Publish(ctx context.Context, f state.DownloadedObject) error
 }
 
 type EventParser interface {
 	// ParseEvents runs in a background goroutine and parses the downloaded
 	// object, sending the events parsed from it further down the pipeline
-	// using the output channel. er
-	ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error
+	// using the output channel. Each line of the object is accounted for
+	// in the report, which may be nil.
+	ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error
 
 	// DynSample dynamically samples events, reading them from `eventsCh`
 	// and sending them to `sampledCh`. Behavior is dependent on the
 	// publisher implementation, e.g., some fields might matter more for
-	// ELB than for CloudFront.
+	// ELB than for CloudFront. Events are sampled one at a time, in
+	// order, so that an event has been sent on or dropped by the time the
+	// next one is read.
 	DynSample(in <-chan event.Event, out chan<- event.Event)
 }
 
@@ -88,17 +121,36 @@ type EventParser interface {
 type HoneycombPublisher struct {
 	state.Stater
 	EventParser
-	APIHost             string
-	SampleRate          int
-	FinishedObjects     chan string
+	APIHost         string
+	SampleRate      int
+	FinishedObjects chan string
+	// DeadLetters receives the lines of published objects which couldn't
+	// be parsed, if set.
+	DeadLetters DeadLetterSink
+	// CheckpointInterval is how often the offset of an object is recorded,
+	// if the Stater is a state.OffsetStater.
+	CheckpointInterval time.Duration
+	// identify is set if events are given IDs.
+	identify            bool
 	parsedCh, sampledCh chan event.Event
+	// sent is closed once every event has been handed to libhoney, after
+	// Close.
+	sent chan struct{}
+}
+
+// checkpoint is attached to an event to record that once it has been handed
+// to libhoney, so have the events of the first offset lines of its object.
+type checkpoint struct {
+	report *LineReport
+	offset int
 }
 
 func NewHoneycombPublisher(opt *options.Options, stater state.Stater, eventParser EventParser) *HoneycombPublisher {
 	hp := &HoneycombPublisher{
-		Stater:          stater,
-		EventParser:     eventParser,
-		FinishedObjects: make(chan string),
+		Stater:             stater,
+		EventParser:        eventParser,
+		FinishedObjects:    make(chan string),
+		CheckpointInterval: time.Duration(opt.CheckpointInterval) * time.Second,
 	}
 
 	if !libhoneyInitialized {
@@ -117,11 +169,56 @@ func NewHoneycombPublisher(opt *options.Options, stater state.Stater, eventParse
 		}
 	}
 
+	if opt.DeadLetterFile != "" {
+		sink, err := deadLetterSinkForFile(opt.DeadLetterFile)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  opt.DeadLetterFile,
+				"error": err,
+			}).Fatal("Couldn't open dead-letter file")
+		}
+		hp.DeadLetters = sink
+	}
+
 	hp.parsedCh = make(chan event.Event)
 	hp.sampledCh = make(chan event.Event)
 
-	go sendEventsToHoneycomb(hp.sampledCh, opt.EdgeMode)
-	go hp.EventParser.DynSample(hp.parsedCh, hp.sampledCh)
+	// Events are given IDs, and duplicates dropped, before sampling so
+	// that duplicates don't skew the sample rates.
+	toSample := hp.parsedCh
+	if opt.EventIDs || opt.DedupWindow > 0 {
+		hp.identify = true
+		var dedup *Deduplicator
+		if opt.DedupWindow > 0 {
+			dedup = NewDeduplicator(time.Duration(opt.DedupWindow)*time.Second, opt.DedupSize)
+		}
+		identifiedCh := make(chan event.Event)
+		go func() {
+			identifyEvents(hp.parsedCh, identifiedCh, dedup)
+			close(identifiedCh)
+		}()
+		toSample = identifiedCh
+	}
+
+	// The checkpoints of events which are sampled out are passed on to
+	// the sender too, so that offsets keep up with what has been read
+	// however few events are sent.
+	sampledOut := &sampledOutCheckpoints{}
+	trackedCh := make(chan event.Event)
+	go func() {
+		trackSampling(toSample, trackedCh, sampledOut)
+		close(trackedCh)
+	}()
+
+	hp.sent = make(chan struct{})
+	go func() {
+		sendEventsToHoneycomb(hp.sampledCh, sampledOut, opt.EdgeMode)
+		close(hp.sent)
+	}()
+	go func() {
+		hp.EventParser.DynSample(trackedCh, hp.sampledCh)
+		close(hp.sampledCh)
+	}()
 
 	return hp
 }
@@ -154,6 +251,69 @@ func dropNegativeTimes(ev *event.Event) {
 	}
 }
 
+// gzippedObject closes both the gzip reader and the underlying file.
+type gzippedObject struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzippedObject) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// plainObject reads through the buffer used to sniff the object's contents.
+type plainObject struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (p *plainObject) Close() error {
+	return p.f.Close()
+}
+
+// openObject opens a downloaded object for reading. Some sources can be
+// configured to compress objects or not, so rather than trusting the name of
+// the object we look for the gzip magic bytes and decompress if present.
+func openObject(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		r, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzippedObject{r, f}, nil
+	}
+
+	return &plainObject{br, f}, nil
+}
+
+// typeifyValue converts a field value from a log line split by one of our own
+// parsers the same way the nginx parser does: numbers become int64 or
+// float64, and "-" means that there is no value at all (reported as !ok).
+func typeifyValue(v string) (interface{}, bool) {
+	switch {
+	case v == "-":
+		return nil, false
+	case strings.Contains(v, "."):
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, true
+		}
+	default:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i, true
+		}
+	}
+	return v, true
+}
+
 // parse the included X-Amzn-Trace-Id header if it is present in an ALB access
 // log - see
 // https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-request-tracing.html
@@ -226,9 +386,73 @@ func addTraceData(ev *event.Event, edgeMode bool) {
 	ev.Data["request.headers.x-amzn-trace-id"] = amznTraceID
 }
 
-func sendEventsToHoneycomb(in <-chan event.Event, edgeMode bool) {
-	shaper := requestShaper{&urlshaper.Parser{}}
+// sampledOutCheckpoints holds the checkpoints of events which have been
+// through the sampler, whether or not they were sampled out, until the sender
+// records them.
+type sampledOutCheckpoints struct {
+	sync.Mutex
+	checkpoints []checkpoint
+}
+
+func (s *sampledOutCheckpoints) add(cp checkpoint) {
+	s.Lock()
+	s.checkpoints = append(s.checkpoints, cp)
+	s.Unlock()
+}
+
+// setSent records the checkpoints as sent. It must only be called by the
+// sender once it has handed every event it has received to libhoney, as those
+// which weren't sampled out went to it before the checkpoints were added.
+func (s *sampledOutCheckpoints) setSent() {
+	s.Lock()
+	checkpoints := s.checkpoints
+	s.checkpoints = nil
+	s.Unlock()
+	for _, cp := range checkpoints {
+		cp.report.setSent(cp.offset)
+	}
+}
+
+// trackSampling hands events on to be sampled. Once the sampler has read an
+// event it's done with the one before, so that one's checkpoint is added to
+// sampledOut.
+func trackSampling(in <-chan event.Event, out chan<- event.Event, sampledOut *sampledOutCheckpoints) {
+	var last *checkpoint
 	for ev := range in {
+		cp, hasCheckpoint := ev.Data[checkpointField].(checkpoint)
+		out <- ev
+		if last != nil {
+			sampledOut.add(*last)
+		}
+		last = nil
+		if hasCheckpoint {
+			last = &cp
+		}
+	}
+}
+
+func sendEventsToHoneycomb(in <-chan event.Event, sampledOut *sampledOutCheckpoints, edgeMode bool) {
+	shaper := requestShaper{&urlshaper.Parser{}}
+	// Checkpoints of events which were sampled out while none were sent
+	// are recorded every so often.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var ev event.Event
+		select {
+		case e, ok := <-in:
+			if !ok {
+				return
+			}
+			ev = e
+		case <-ticker.C:
+			sampledOut.setSent()
+			continue
+		}
+		cp, hasCheckpoint := ev.Data[checkpointField].(checkpoint)
+		delete(ev.Data, checkpointField)
+		delete(ev.Data, lineField)
+		delete(ev.Data, recordIDField)
 		shaper.Shape("request", &ev)
 		libhEv := libhoney.NewEvent()
 		libhEv.Timestamp = ev.Timestamp
@@ -248,17 +472,165 @@ func sendEventsToHoneycomb(in <-chan event.Event, edgeMode bool) {
 				"error": err,
 			}).Error("Unexpected error event to libhoney send")
 		}
+		if hasCheckpoint {
+			cp.report.setSent(cp.offset)
+		}
+		sampledOut.setSent()
 	}
 }
 
-func (hp *HoneycombPublisher) Publish(downloadedObj state.DownloadedObject) error {
-	logrus.WithField("object", downloadedObj.Object).Debug("Parse events begin")
+// stampCheckpoints sends the events parsed from an object on, attaching the
+// number of lines of the object which had been dealt with when each one was
+// received. Lines are only accounted for once their events have been sent,
+// so the events of those lines are ahead of it in the pipeline.
+//
+// Once ctx is done the rest of the events are dropped, so that parsing
+// finishes quickly and the offset stays at the last event sent. It returns
+// whether any were.
+func stampCheckpoints(ctx context.Context, in <-chan event.Event, out chan<- event.Event, report *LineReport) bool {
+	dropped := false
+	for ev := range in {
+		if dropped = dropped || ctx.Err() != nil; dropped {
+			continue
+		}
+		ev.Data[checkpointField] = checkpoint{report, report.offset()}
+		select {
+		case out <- ev:
+		case <-ctx.Done():
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// saveCheckpoint records the offset of the object up to which events have
+// been handed to libhoney, once libhoney has flushed them. The offset is
+// recorded again even if it hasn't moved on, as a heartbeat which keeps other
+// replicas from resuming the object.
+func (hp *HoneycombPublisher) saveCheckpoint(stater state.OffsetStater, report *LineReport, saved int) int {
+	offset := report.sentOffset()
+	if offset > saved {
+		libhoney.Flush()
+	} else {
+		offset = saved
+	}
+	if err := stater.SetOffset(report.Object, offset); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"object": report.Object,
+			"offset": offset,
+			"error":  err,
+		}).Error("Couldn't record offset of object")
+		return saved
+	}
+	logrus.WithFields(logrus.Fields{
+		"object": report.Object,
+		"offset": offset,
+	}).Debug("Recorded offset of object")
+	return offset
+}
+
+// parseWithCheckpoints parses the object, resuming from its recorded offset
+// and recording how far it has got every CheckpointInterval, or until ctx is
+// done.
+func (hp *HoneycombPublisher) parseWithCheckpoints(ctx context.Context, downloadedObj state.DownloadedObject, stater state.OffsetStater, report *LineReport) error {
+	offset, err := stater.Offset(downloadedObj.Object)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"object": downloadedObj.Object,
+			"error":  err,
+		}).Error("Couldn't look up offset of object, starting from the beginning")
+	}
+	if offset > 0 {
+		logrus.WithFields(logrus.Fields{
+			"object": downloadedObj.Object,
+			"offset": offset,
+		}).Info("Resuming object part way through")
+	}
+	report.resumeAfter = offset
+
+	parsedCh := make(chan event.Event)
+	stamped := make(chan bool, 1)
+	go func() {
+		stamped <- stampCheckpoints(ctx, parsedCh, hp.parsedCh, report)
+	}()
+
+	parsed := make(chan error, 1)
+	go func() {
+		parsed <- hp.EventParser.ParseEvents(downloadedObj, parsedCh, report)
+		close(parsedCh)
+	}()
 
-	if err := hp.EventParser.ParseEvents(downloadedObj, hp.parsedCh); err != nil {
+	// Checkpoints are also heartbeats, so they're recorded well within
+	// the lease of the object however long the interval is.
+	interval := hp.CheckpointInterval
+	if interval > state.OffsetLease/3 {
+		interval = state.OffsetLease / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	saved := offset
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			saved = hp.saveCheckpoint(stater, report, saved)
+		case err = <-parsed:
+			done = true
+		}
+	}
+	if dropped := <-stamped; dropped && err == nil {
+		err = fmt.Errorf("Abandoned object %s part way through: %s", downloadedObj.Object, ctx.Err())
+	}
+	if err != nil {
+		// Keep the offset reached so that another attempt can pick up
+		// from there.
+		hp.saveCheckpoint(stater, report, saved)
 		return err
 	}
 
-	logrus.WithField("object", downloadedObj.Object).Debug("Parse events end")
+	// The events of every line are on their way to libhoney, so there's
+	// no longer anything to resume.
+	if err := stater.ClearOffset(downloadedObj.Object); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"object": downloadedObj.Object,
+			"error":  err,
+		}).Error("Couldn't record object as finished")
+	}
+
+	return nil
+}
+
+func (hp *HoneycombPublisher) Publish(ctx context.Context, downloadedObj state.DownloadedObject) error {
+	logrus.WithField("object", downloadedObj.Object).Debug("Parse events begin")
+
+	report := NewLineReport(downloadedObj.Object, hp.DeadLetters)
+	report.identify = hp.identify
+
+	var err error
+	if stater, ok := hp.Stater.(state.OffsetStater); ok && hp.CheckpointInterval > 0 {
+		err = hp.parseWithCheckpoints(ctx, downloadedObj, stater, report)
+	} else {
+		// Without offsets there would be nowhere to pick up from, so
+		// the object is always published in full.
+		err = hp.EventParser.ParseEvents(downloadedObj, hp.parsedCh, report)
+	}
+
+	counts := report.Counts()
+	entry := logrus.WithFields(logrus.Fields{
+		"object":  downloadedObj.Object,
+		"total":   counts.Total,
+		"parsed":  counts.Parsed,
+		"skipped": counts.Skipped,
+		"failed":  counts.Failed,
+	})
+	if counts.Failed > 0 {
+		entry.Warn("Some lines of the object couldn't be parsed")
+	} else {
+		entry.Debug("Parse events end")
+	}
+
+	if err != nil {
+		return err
+	}
 
 	// Clean up the downloaded object.
 	// TODO: Should always be done?
@@ -269,7 +641,23 @@ func (hp *HoneycombPublisher) Publish(downloadedObj state.DownloadedObject) erro
 	return nil
 }
 
-// Close flushes outstanding sends
-func (hp *HoneycombPublisher) Close() {
-	libhoney.Close()
+// Close waits for the events of the objects published to be handed to
+// libhoney, and flushes them, or gives up once ctx is done. Nothing can be
+// published once it has been called.
+func (hp *HoneycombPublisher) Close(ctx context.Context) error {
+	close(hp.parsedCh)
+
+	flushed := make(chan struct{})
+	go func() {
+		<-hp.sent
+		libhoney.Flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up flushing events: %s", ctx.Err())
+	}
 }
@@ -0,0 +1,245 @@
+package publisher
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// DeadLetter is a line which couldn't be parsed, along with where it came
+// from, so that changes to a log format can be tracked down.
+type DeadLetter struct {
+	Object string `json:"object"`
+	Line   int    `json:"line"`
+	Raw    string `json:"raw"`
+	Error  string `json:"error"`
+}
+
+// DeadLetterSink receives the lines which couldn't be parsed.
+type DeadLetterSink interface {
+	WriteDeadLetter(dl DeadLetter) error
+}
+
+// FileDeadLetterSink appends dead letters to a file as JSON lines.
+type FileDeadLetterSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFileDeadLetterSink opens (or creates) the file at path for appending,
+// with "-" meaning stderr.
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	f := os.Stderr
+	if path != "-" {
+		var err error
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FileDeadLetterSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *FileDeadLetterSink) WriteDeadLetter(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(dl)
+}
+
+var (
+	deadLetterSinksMu sync.Mutex
+	deadLetterSinks   = make(map[string]DeadLetterSink)
+)
+
+// deadLetterSinkForFile returns the sink for the file at path, shared by all
+// of the publishers of a process so that their writes don't interleave.
+func deadLetterSinkForFile(path string) (DeadLetterSink, error) {
+	deadLetterSinksMu.Lock()
+	defer deadLetterSinksMu.Unlock()
+
+	if sink, ok := deadLetterSinks[path]; ok {
+		return sink, nil
+	}
+	sink, err := NewFileDeadLetterSink(path)
+	if err != nil {
+		return nil, err
+	}
+	deadLetterSinks[path] = sink
+	return sink, nil
+}
+
+// LineCounts are the number of lines (or records, for formats which aren't
+// line based) of an object that were seen, turned into events, intentionally
+// left out (e.g. headers and comments) and that couldn't be parsed.
+type LineCounts struct {
+	Total, Parsed, Skipped, Failed int
+}
+
+// LineReport accounts for the lines of a single object as it is parsed, and
+// hands the ones which couldn't be parsed to the dead-letter sink, if any.
+// It also keeps track of how far into the object every line has been dealt
+// with, so that processing can be checkpointed and resumed. Its methods are
+// safe to call concurrently and on a nil *LineReport.
+type LineReport struct {
+	Object string
+	sink   DeadLetterSink
+
+	// resumeAfter is the number of lines which were sent before
+	// processing of the object was interrupted.
+	resumeAfter int
+	// identify is set if events are given IDs, which are derived from
+	// the lines they were parsed from if they have none of their own.
+	identify bool
+
+	mu     sync.Mutex
+	counts LineCounts
+	// Lines can be dealt with out of order, so those after the first line
+	// which hasn't been are held in pending until the gap is closed.
+	finished int
+	pending  map[int]bool
+	// sent is the highest offset known to have been handed to libhoney.
+	sent int
+}
+
+func NewLineReport(object string, sink DeadLetterSink) *LineReport {
+	return &LineReport{Object: object, sink: sink}
+}
+
+// finish marks a line as dealt with; r.mu must be held.
+func (r *LineReport) finish(number int) {
+	if number != r.finished+1 {
+		if r.pending == nil {
+			r.pending = make(map[int]bool)
+		}
+		r.pending[number] = true
+		return
+	}
+	r.finished = number
+	for r.pending[r.finished+1] {
+		delete(r.pending, r.finished+1)
+		r.finished++
+	}
+}
+
+// Parsed records a line, numbered from 1, which was turned into (at least)
+// one event. It must be called after the events have been sent on.
+func (r *LineReport) Parsed(number int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.counts.Total++
+	r.counts.Parsed++
+	r.finish(number)
+	r.mu.Unlock()
+}
+
+// Send sends an event parsed from a line, numbered from 1, on out and then
+// records the line as parsed. If events are being given IDs, the line goes
+// along with the event.
+func (r *LineReport) Send(out chan<- event.Event, ev event.Event, number int) {
+	if r != nil && r.identify {
+		if ev.Data == nil {
+			ev.Data = make(map[string]interface{})
+		}
+		ev.Data[lineField] = sourceLine{r.Object, number}
+	}
+	out <- ev
+	r.Parsed(number)
+}
+
+// Skipped records a line, numbered from 1, which was intentionally left out.
+func (r *LineReport) Skipped(number int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.counts.Total++
+	r.counts.Skipped++
+	r.finish(number)
+	r.mu.Unlock()
+}
+
+// Resumed reports whether the line, numbered from 1, was sent before
+// processing of the object was interrupted, in which case it is recorded as
+// skipped and must be left out.
+func (r *LineReport) Resumed(number int) bool {
+	if r == nil || number > r.resumeAfter {
+		return false
+	}
+	r.Skipped(number)
+	return true
+}
+
+// Failed records a line which couldn't be parsed, numbered from 1.
+func (r *LineReport) Failed(number int, raw string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.counts.Total++
+	r.counts.Failed++
+	r.finish(number)
+	r.mu.Unlock()
+
+	if r.sink == nil {
+		return
+	}
+	dl := DeadLetter{
+		Object: r.Object,
+		Line:   number,
+		Raw:    raw,
+		Error:  err.Error(),
+	}
+	if err := r.sink.WriteDeadLetter(dl); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"object": r.Object,
+			"error":  err,
+		}).Error("Couldn't write line to dead-letter sink")
+	}
+}
+
+// objectName is the object being reported on, for logging.
+func (r *LineReport) objectName() string {
+	if r == nil {
+		return ""
+	}
+	return r.Object
+}
+
+func (r *LineReport) Counts() LineCounts {
+	if r == nil {
+		return LineCounts{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts
+}
+
+// offset is the number of lines at the start of the object which have all
+// been dealt with.
+func (r *LineReport) offset() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.finished
+}
+
+// setSent records that the events of the first offset lines have been handed
+// to libhoney.
+func (r *LineReport) setSent(offset int) {
+	r.mu.Lock()
+	if offset > r.sent {
+		r.sent = offset
+	}
+	r.mu.Unlock()
+}
+
+func (r *LineReport) sentOffset() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent
+}
@@ -0,0 +1,289 @@
+package publisher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+type memoryDeadLetterSink struct {
+	mu          sync.Mutex
+	deadLetters []DeadLetter
+}
+
+func (s *memoryDeadLetterSink) WriteDeadLetter(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = append(s.deadLetters, dl)
+	return nil
+}
+
+func TestLineReportNginxFailures(t *testing.T) {
+	elbPublisher := NewELBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 10)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(`#Version: 1.0
+2017-07-31T20:30:57.975041Z spline_reticulation_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 -1 504 504 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2
+this is not an access log line
+
+`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	sink := &memoryDeadLetterSink{}
+	report := NewLineReport("foo", sink)
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := elbPublisher.ParseEvents(obj, outCh, report); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	if n := len(outCh); n != 1 {
+		t.Errorf("expected 1 event, got %d", n)
+	}
+
+	expected := LineCounts{Total: 4, Parsed: 1, Skipped: 2, Failed: 1}
+	if counts := report.Counts(); counts != expected {
+		t.Errorf("expected counts %+v, got %+v", expected, counts)
+	}
+
+	if len(sink.deadLetters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(sink.deadLetters))
+	}
+	dl := sink.deadLetters[0]
+	if dl.Object != "foo" || dl.Line != 3 || dl.Raw != "this is not an access log line" || dl.Error == "" {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+}
+
+func TestLineReportCloudTrailBadRecord(t *testing.T) {
+	ep := NewCloudTrailEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 10)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(`{"Records":[{"eventTime":"2019-01-01T00:00:00Z","eventName":"GetObject"},{"eventTime":"yesterday","eventName":"PutObject"}]}`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	sink := &memoryDeadLetterSink{}
+	report := NewLineReport("foo", sink)
+	if err := ep.ParseEvents(state.DownloadedObject{Object: "foo", Filename: tmpFile.Name()}, outCh, report); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	expected := LineCounts{Total: 2, Parsed: 1, Failed: 1}
+	if counts := report.Counts(); counts != expected {
+		t.Errorf("expected counts %+v, got %+v", expected, counts)
+	}
+	if len(sink.deadLetters) != 1 || sink.deadLetters[0].Line != 2 {
+		t.Errorf("unexpected dead letters %+v", sink.deadLetters)
+	}
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "dead-letters.json")
+	sink, err := NewFileDeadLetterSink(filename)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	written := []DeadLetter{
+		{Object: "foo", Line: 3, Raw: "bar", Error: "baz"},
+		{Object: "foo", Line: 7, Raw: "quux", Error: "baz"},
+	}
+	for _, dl := range written {
+		if err := sink.WriteDeadLetter(dl); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer f.Close()
+
+	var read []DeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		read = append(read, dl)
+	}
+	if !reflect.DeepEqual(read, written) {
+		t.Errorf("expected %+v, got %+v", written, read)
+	}
+}
+
+func TestLineReportResume(t *testing.T) {
+	elbPublisher := NewELBEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 10)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(`2017-07-31T20:30:57.975041Z first_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 -1 504 504 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2
+2017-07-31T20:30:58.975041Z second_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 -1 504 504 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2
+2017-07-31T20:30:59.975041Z third_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 -1 504 504 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2
+`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	report := NewLineReport("foo", nil)
+	report.resumeAfter = 2
+	if err := elbPublisher.ParseEvents(state.DownloadedObject{Object: "foo", Filename: tmpFile.Name()}, outCh, report); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	close(outCh)
+
+	if n := len(outCh); n != 1 {
+		t.Fatalf("expected 1 event, got %d", n)
+	}
+	if ev := <-outCh; ev.Data["elb"] != "third_lb" {
+		t.Errorf("expected the event of the third line, got %v", ev.Data)
+	}
+
+	expected := LineCounts{Total: 3, Parsed: 1, Skipped: 2}
+	if counts := report.Counts(); counts != expected {
+		t.Errorf("expected counts %+v, got %+v", expected, counts)
+	}
+	if offset := report.offset(); offset != 3 {
+		t.Errorf("expected offset 3, got %d", offset)
+	}
+}
+
+func TestLineReportOffset(t *testing.T) {
+	report := NewLineReport("foo", nil)
+
+	steps := []struct {
+		record   func()
+		expected int
+	}{
+		{func() { report.Parsed(2) }, 0},
+		{func() { report.Skipped(4) }, 0},
+		{func() { report.Parsed(1) }, 2},
+		{func() { report.Failed(3, "bar", errors.New("baz")) }, 4},
+		{func() { report.Parsed(5) }, 5},
+	}
+	for i, step := range steps {
+		step.record()
+		if offset := report.offset(); offset != step.expected {
+			t.Errorf("step %d: expected offset %d, got %d", i, step.expected, offset)
+		}
+	}
+}
+
+func TestStampCheckpoints(t *testing.T) {
+	report := NewLineReport("foo", nil)
+	in := make(chan event.Event)
+	out := make(chan event.Event, 2)
+	go func() {
+		stampCheckpoints(context.Background(), in, out, report)
+		close(out)
+	}()
+
+	in <- event.Event{Data: map[string]interface{}{}}
+	report.Parsed(1)
+	in <- event.Event{Data: map[string]interface{}{}}
+	close(in)
+
+	var offsets []int
+	for ev := range out {
+		offsets = append(offsets, ev.Data[checkpointField].(checkpoint).offset)
+	}
+	if !reflect.DeepEqual(offsets, []int{0, 1}) {
+		t.Errorf("expected offsets [0 1], got %v", offsets)
+	}
+}
+
+func TestStampCheckpointsDropsOnceCancelled(t *testing.T) {
+	report := NewLineReport("foo", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan event.Event)
+	out := make(chan event.Event, 2)
+	dropped := make(chan bool, 1)
+	go func() {
+		dropped <- stampCheckpoints(ctx, in, out, report)
+	}()
+
+	in <- event.Event{Data: map[string]interface{}{}}
+	cancel()
+	in <- event.Event{Data: map[string]interface{}{}}
+	close(in)
+
+	if !<-dropped {
+		t.Error("expected events to be dropped once cancelled")
+	}
+	if len(out) != 1 {
+		t.Errorf("expected only the event received before cancelling to be sent, got %d", len(out))
+	}
+}
+
+func TestTrackSamplingRecordsSampledOutCheckpoints(t *testing.T) {
+	report := NewLineReport("foo", nil)
+	in := make(chan event.Event)
+	tracked := make(chan event.Event)
+	sampledOut := &sampledOutCheckpoints{}
+	go func() {
+		trackSampling(in, tracked, sampledOut)
+		close(tracked)
+	}()
+	// a sampler which samples every event out
+	sampled := make(chan struct{})
+	go func() {
+		for range tracked {
+		}
+		close(sampled)
+	}()
+
+	for offset := 1; offset <= 3; offset++ {
+		in <- event.Event{Data: map[string]interface{}{checkpointField: checkpoint{report, offset}}}
+	}
+	close(in)
+	<-sampled
+
+	// the last event may still be being sampled
+	sampledOut.setSent()
+	if offset := report.sentOffset(); offset != 2 {
+		t.Errorf("expected the sampled out events to be recorded as sent up to 2, got %d", offset)
+	}
+}
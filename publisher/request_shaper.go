@@ -13,10 +13,13 @@ type requestShaper struct {
 }
 
 // Nicked directly from github.com/honeycombio/honeytail/leash.go
+//
+// Fields which aren't strings, e.g. a custom API Gateway access log field
+// called request whose value looks like a number, are left as they are.
 func (rs *requestShaper) Shape(field string, ev *event.Event) {
-	if val, ok := ev.Data[field]; ok {
+	if val, ok := ev.Data[field].(string); ok {
 		// start by splitting out method, uri, and version
-		parts := strings.Split(val.(string), " ")
+		parts := strings.Split(val, " ")
 		var path string
 		if len(parts) == 3 {
 			// treat it as METHOD /path HTTP/1.X
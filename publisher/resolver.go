@@ -0,0 +1,208 @@
+package publisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const resolverRcodeNoError = "NOERROR"
+
+type ResolverQueryLogAnswer struct {
+	Rdata string `json:"Rdata"`
+	Type  string `json:"Type"`
+	Class string `json:"Class"`
+}
+
+type ResolverQueryLogSrcIDs struct {
+	Instance                 string `json:"instance"`
+	ResolverEndpoint         string `json:"resolver_endpoint"`
+	ResolverNetworkInterface string `json:"resolver_network_interface"`
+}
+
+type ResolverQueryLogRecord struct {
+	Version              string                   `json:"version"`
+	AccountID            string                   `json:"account_id"`
+	Region               string                   `json:"region"`
+	VPCID                string                   `json:"vpc_id"`
+	QueryTimestamp       string                   `json:"query_timestamp"`
+	QueryName            string                   `json:"query_name"`
+	QueryType            string                   `json:"query_type"`
+	QueryClass           string                   `json:"query_class"`
+	Rcode                string                   `json:"rcode"`
+	Answers              []ResolverQueryLogAnswer `json:"answers"`
+	SrcAddr              string                   `json:"srcaddr"`
+	SrcPort              json.Number              `json:"srcport"`
+	Transport            string                   `json:"transport"`
+	SrcIDs               ResolverQueryLogSrcIDs   `json:"srcids"`
+	FirewallRuleAction   string                   `json:"firewall_rule_action"`
+	FirewallRuleGroupID  string                   `json:"firewall_rule_group_id"`
+	FirewallDomainListID string                   `json:"firewall_domain_list_id"`
+}
+
+// ResolverEventParser parses Route 53 Resolver query logs, JSON lines with one
+// record per DNS query made from a VPC.
+type ResolverEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewResolverEventParser(opt *options.Options) *ResolverEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &ResolverEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// Helper function for flattening Resolver query log records. The answers are
+// reduced to comma separated lists of their data and types, so that they can
+// be searched on.
+func flattenResolverQueryLogRecord(r *ResolverQueryLogRecord) map[string]interface{} {
+	p := make(map[string]interface{})
+
+	p["version"] = r.Version
+	p["account_id"] = r.AccountID
+	p["region"] = r.Region
+	p["vpc_id"] = r.VPCID
+	p["query_name"] = r.QueryName
+	p["query_type"] = r.QueryType
+	p["query_class"] = r.QueryClass
+	p["rcode"] = r.Rcode
+	p["srcaddr"] = r.SrcAddr
+	if port, err := r.SrcPort.Int64(); err == nil {
+		p["srcport"] = port
+	}
+	p["transport"] = r.Transport
+
+	if r.SrcIDs.Instance != "" {
+		p["srcids.instance"] = r.SrcIDs.Instance
+	}
+	if r.SrcIDs.ResolverEndpoint != "" {
+		p["srcids.resolver_endpoint"] = r.SrcIDs.ResolverEndpoint
+	}
+	if r.SrcIDs.ResolverNetworkInterface != "" {
+		p["srcids.resolver_network_interface"] = r.SrcIDs.ResolverNetworkInterface
+	}
+
+	if r.FirewallRuleAction != "" {
+		p["firewall_rule_action"] = r.FirewallRuleAction
+		p["firewall_rule_group_id"] = r.FirewallRuleGroupID
+		p["firewall_domain_list_id"] = r.FirewallDomainListID
+	}
+
+	p["answer_count"] = int64(len(r.Answers))
+	if len(r.Answers) > 0 {
+		rdata := make([]string, 0, len(r.Answers))
+		var types []string
+		seenTypes := make(map[string]bool)
+		for _, answer := range r.Answers {
+			rdata = append(rdata, answer.Rdata)
+			if !seenTypes[answer.Type] {
+				seenTypes[answer.Type] = true
+				types = append(types, answer.Type)
+			}
+		}
+		p["answers"] = strings.Join(rdata, ",")
+		p["answer_types"] = strings.Join(types, ",")
+	}
+
+	return p
+}
+
+func (ep *ResolverEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			report.Skipped(number)
+			continue
+		}
+
+		var record ResolverQueryLogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"error":  err,
+			}).Debug("Couldn't unmarshal Resolver query log record, skipping")
+			report.Failed(number, string(line), err)
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, record.QueryTimestamp)
+		if err != nil {
+			t = time.Now()
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: t,
+			Data:      flattenResolverQueryLogRecord(&record),
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *ResolverEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		rcode, _ := ev.Data["rcode"].(string)
+
+		// Failed lookups (NXDOMAIN, SERVFAIL, etc.) are what people
+		// look at DNS logs for, so keep every one of them.
+		if rcode != resolverRcodeNoError {
+			ev.SampleRate = 1
+			out <- ev
+			continue
+		}
+
+		key := rcode
+		if queryType, ok := ev.Data["query_type"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, queryType)
+		}
+
+		// Make sure sample rate is per-VPC
+		if vpcID, ok := ev.Data["vpc_id"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, vpcID)
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
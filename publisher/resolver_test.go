@@ -0,0 +1,102 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestResolverParseEvents(t *testing.T) {
+	resolverPublisher := NewResolverEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`{"version":"1.100000","account_id":"111122223333","region":"us-east-1","vpc_id":"vpc-0123456789abcdef0","query_timestamp":"2021-02-04T17:51:55Z","query_name":"www.example.com.","query_type":"A","query_class":"IN","rcode":"NOERROR","answers":[{"Rdata":"www.example.com.cdn.example.net.","Type":"CNAME","Class":"IN"},{"Rdata":"192.0.2.10","Type":"A","Class":"IN"},{"Rdata":"192.0.2.11","Type":"A","Class":"IN"}],"srcaddr":"10.0.1.23","srcport":"56067","transport":"UDP","srcids":{"instance":"i-0123456789abcdef0"}}
+`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := resolverPublisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	expected := map[string]interface{}{
+		"version":         "1.100000",
+		"account_id":      "111122223333",
+		"region":          "us-east-1",
+		"vpc_id":          "vpc-0123456789abcdef0",
+		"query_name":      "www.example.com.",
+		"query_type":      "A",
+		"query_class":     "IN",
+		"rcode":           "NOERROR",
+		"srcaddr":         "10.0.1.23",
+		"srcport":         int64(56067),
+		"transport":       "UDP",
+		"srcids.instance": "i-0123456789abcdef0",
+		"answer_count":    int64(3),
+		"answers":         "www.example.com.cdn.example.net.,192.0.2.10,192.0.2.11",
+		"answer_types":    "CNAME,A",
+	}
+	ev := <-outCh
+	close(outCh)
+
+	if !ev.Timestamp.Equal(time.Date(2021, time.February, 4, 17, 51, 55, 0, time.UTC)) {
+		t.Errorf("unexpected timestamp %v", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Error("Output did not match expected:")
+		for k, v := range ev.Data {
+			if reflect.DeepEqual(v, expected[k]) {
+				continue
+			}
+			log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+			log.Print("expected: ", k, "\t(", reflect.TypeOf(expected[k]), ") ", expected[k])
+		}
+		t.Fatal()
+	}
+}
+
+func TestResolverDynSampleKeepsFailures(t *testing.T) {
+	// a sampler that would drop (nearly) everything
+	resolverPublisher := NewResolverEventParser(&options.Options{SampleRate: 1000000, SamplerType: "simple", SamplerInterval: 300})
+	in := make(chan event.Event)
+	out := make(chan event.Event, 100)
+	go resolverPublisher.DynSample(in, out)
+
+	for i := 0; i < 100; i++ {
+		rcode := "NXDOMAIN"
+		if i%2 == 0 {
+			rcode = "SERVFAIL"
+		}
+		in <- event.Event{Data: map[string]interface{}{"rcode": rcode, "query_type": "A"}}
+	}
+	close(in)
+
+	for i := 0; i < 100; i++ {
+		ev := <-out
+		if ev.SampleRate != 1 {
+			t.Fatalf("expected %s to be kept with sample rate 1, got %d", ev.Data["rcode"], ev.SampleRate)
+		}
+	}
+}
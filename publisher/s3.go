@@ -0,0 +1,227 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const s3AccessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Fields of S3 server access logs, in the order they appear in each line.
+// Amazon appends new fields to the end from time to time, so older lines may
+// have fewer of them and newer lines may have fields we don't know about
+// yet.
+//
+// The request URI is named "request" so that it gets split up into method,
+// path, query etc. by the requestShaper like the load balancer requests.
+var s3AccessLogFields = []string{
+	"bucket_owner",
+	"bucket",
+	"timestamp",
+	"remote_ip",
+	"requester",
+	"request_id",
+	"operation",
+	"key",
+	"request",
+	"http_status",
+	"error_code",
+	"bytes_sent",
+	"object_size",
+	"total_time",
+	"turn_around_time",
+	"referer",
+	"user_agent",
+	"version_id",
+	"host_id",
+	"signature_version",
+	"cipher_suite",
+	"authentication_type",
+	"host_header",
+	"tls_version",
+	"access_point_arn",
+	"acl_required",
+}
+
+type S3EventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewS3EventParser(opt *options.Options) *S3EventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &S3EventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// splitS3AccessLogLine splits a line of an S3 server access log into its
+// fields. Fields are space delimited, except for the timestamp, which is
+// wrapped in brackets and contains a space, and the request URI, referer and
+// user agent, which are wrapped in quotes and may contain spaces.
+func splitS3AccessLogLine(line string) []string {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return fields
+		}
+
+		var end byte = ' '
+		switch line[0] {
+		case '"':
+			end = '"'
+		case '[':
+			end = ']'
+		}
+
+		if end == ' ' {
+			i := strings.IndexByte(line, ' ')
+			if i < 0 {
+				return append(fields, line)
+			}
+			fields = append(fields, line[:i])
+			line = line[i:]
+			continue
+		}
+
+		i := strings.IndexByte(line[1:], end)
+		if i < 0 {
+			// unterminated, take the rest of the line as is
+			return append(fields, line[1:])
+		}
+		fields = append(fields, line[1:i+1])
+		line = line[i+2:]
+	}
+}
+
+// Example S3 server access log line:
+// 79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be awsexamplebucket1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3 79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be 3E57427F3EXAMPLE REST.GET.VERSIONING - "GET /awsexamplebucket1?versioning HTTP/1.1" 200 - 113 - 7 - "-" "S3Console/0.4" - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234= SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader awsexamplebucket1.s3.us-west-1.amazonaws.com TLSV1.2 - -
+func (ep *S3EventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			report.Skipped(number)
+			continue
+		}
+
+		values := splitS3AccessLogLine(line)
+		if len(values) < 3 {
+			logrus.WithField("object", obj.Object).Debug("S3 access log line is too short, skipping")
+			report.Failed(number, line, fmt.Errorf("line has %d fields", len(values)))
+			continue
+		}
+
+		timestamp, err := time.Parse(s3AccessLogTimeFormat, values[2])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"error":  err,
+			}).Debug("Couldn't parse S3 access log timestamp, skipping")
+			report.Failed(number, line, err)
+			continue
+		}
+
+		data := make(map[string]interface{}, len(s3AccessLogFields))
+		for i, v := range values {
+			if i >= len(s3AccessLogFields) {
+				break
+			}
+			if i == 2 {
+				// already parsed into the event's timestamp
+				continue
+			}
+			// these look like numbers sometimes, but aren't
+			switch s3AccessLogFields[i] {
+			case "bucket", "key", "version_id", "request", "referer", "user_agent":
+				if v != "-" {
+					data[s3AccessLogFields[i]] = v
+				}
+				continue
+			}
+			if typed, ok := typeifyValue(v); ok {
+				data[s3AccessLogFields[i]] = typed
+			}
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: timestamp,
+			Data:      data,
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *S3EventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// use http_status and operation to set sample rate, keyed
+		// per-bucket
+		var key string
+		if httpStatus, ok := ev.Data["http_status"]; ok {
+			if hs, ok := httpStatus.(int64); ok {
+				key = fmt.Sprintf("%d", hs)
+			} else {
+				key = "0"
+				logrus.WithFields(logrus.Fields{
+					"field":       "http_status",
+					"intended":    "int64",
+					"actual_val":  httpStatus,
+					"actual_type": fmt.Sprintf("%T", httpStatus),
+				}).Error("Did not cast field from access log correctly")
+			}
+		}
+
+		if operation, ok := ev.Data["operation"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, operation)
+		}
+
+		// Make sure sample rate is per-bucket
+		if bucketName, ok := ev.Data["bucket"]; ok {
+			if name, ok := bucketName.(string); ok {
+				key = fmt.Sprintf("%s_%s", key, name)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
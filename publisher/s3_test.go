@@ -0,0 +1,109 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/urlshaper"
+)
+
+func TestSplitS3AccessLogLine(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected []string
+	}{
+		{
+			line:     `owner bucket [06/Feb/2019:00:00:38 +0000] 192.0.2.3 "GET /a%20b?c=d HTTP/1.1" 200 "-" "Mozilla/5.0 (X11; Linux)"`,
+			expected: []string{"owner", "bucket", "06/Feb/2019:00:00:38 +0000", "192.0.2.3", "GET /a%20b?c=d HTTP/1.1", "200", "-", "Mozilla/5.0 (X11; Linux)"},
+		},
+		{
+			// unterminated quote should not crash
+			line:     `owner "GET /`,
+			expected: []string{"owner", "GET /"},
+		},
+	}
+
+	for _, tc := range testCases {
+		actual := splitS3AccessLogLine(tc.line)
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("split did not match:\n(expected)\t%q\n(actual)\t%q", tc.expected, actual)
+		}
+	}
+}
+
+func TestS3ParseEvents(t *testing.T) {
+	s3Publisher := NewS3EventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(`79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be awsexamplebucket1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3 79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be 3E57427F3EXAMPLE REST.GET.OBJECT photos/2019/08/puppy.jpg "GET /awsexamplebucket1/photos/2019/08/puppy.jpg?x-foo=bar HTTP/1.1" 404 NoSuchKey 243 - 11 - "-" "S3Console/0.4" - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234= SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader awsexamplebucket1.s3.us-west-1.amazonaws.com TLSV1.2 - - some-future-field`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	go func() {
+		if err := s3Publisher.ParseEvents(obj, outCh, nil); err != nil {
+			t.Error("Shouldn't have err but did: ", err)
+		}
+	}()
+	expected := map[string]interface{}{
+		"bucket_owner":        "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be",
+		"bucket":              "awsexamplebucket1",
+		"remote_ip":           "192.0.2.3",
+		"requester":           "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be",
+		"request_id":          "3E57427F3EXAMPLE",
+		"operation":           "REST.GET.OBJECT",
+		"key":                 "photos/2019/08/puppy.jpg",
+		"request":             "GET /awsexamplebucket1/photos/2019/08/puppy.jpg?x-foo=bar HTTP/1.1",
+		"http_status":         int64(404),
+		"error_code":          "NoSuchKey",
+		"bytes_sent":          int64(243),
+		"total_time":          int64(11),
+		"user_agent":          "S3Console/0.4",
+		"host_id":             "s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234=",
+		"signature_version":   "SigV4",
+		"cipher_suite":        "ECDHE-RSA-AES128-GCM-SHA256",
+		"authentication_type": "AuthHeader",
+		"host_header":         "awsexamplebucket1.s3.us-west-1.amazonaws.com",
+		"tls_version":         "TLSV1.2",
+	}
+	ev := <-outCh
+
+	if !ev.Timestamp.Equal(time.Date(2019, time.February, 6, 0, 0, 38, 0, time.UTC)) {
+		t.Errorf("unexpected timestamp %v", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Error("Output did not match expected:")
+		for k, v := range ev.Data {
+			if reflect.DeepEqual(v, expected[k]) {
+				continue
+			}
+			log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+			log.Print("expected: ", k, "\t(", reflect.TypeOf(expected[k]), ") ", expected[k])
+		}
+		t.Fatal()
+	}
+
+	// the request URI goes through the same shaping as load balancer
+	// requests
+	shaper := requestShaper{&urlshaper.Parser{}}
+	shaper.Shape("request", &ev)
+	if ev.Data["request_path"] != "/awsexamplebucket1/photos/2019/08/puppy.jpg" || ev.Data["request_method"] != "GET" {
+		t.Errorf("request was not shaped as expected: %v", ev.Data)
+	}
+}
@@ -0,0 +1,181 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// IANA protocol numbers we can give a friendlier name to.
+var ipProtocolNames = map[int64]string{
+	1:  "icmp",
+	6:  "tcp",
+	17: "udp",
+	47: "gre",
+	50: "esp",
+	58: "icmpv6",
+}
+
+// The flow log fields which are counters, ports, timestamps etc. Everything
+// else, including IDs such as account_id which can have leading zeros, is
+// kept as a string.
+var vpcFlowLogNumericFields = map[string]bool{
+	"version":      true,
+	"srcport":      true,
+	"dstport":      true,
+	"protocol":     true,
+	"packets":      true,
+	"bytes":        true,
+	"start":        true,
+	"end":          true,
+	"tcp_flags":    true,
+	"traffic_path": true,
+}
+
+type VPCFlowLogEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewVPCFlowLogEventParser(opt *options.Options) *VPCFlowLogEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &VPCFlowLogEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// parseVPCFlowLogHeader turns the header line of a flow log object into
+// event field names, e.g. "pkt-srcaddr" becomes "pkt_srcaddr".
+func parseVPCFlowLogHeader(line string) []string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		fields[i] = strings.Replace(f, "-", "_", -1)
+	}
+	return fields
+}
+
+// VPC flow logs can be created with a custom set of fields (anything from
+// version 2 to 5), so we can't use a fixed log format like we do for the load
+// balancers. Fortunately each object starts with a header line naming the
+// fields in the order they appear.
+//
+// Example object contents (default format):
+// version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status
+// 2 123456789010 eni-1235b8ca123456789 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+func (ep *VPCFlowLogEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	var fieldNames []string
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if line == "" {
+			report.Skipped(number)
+			continue
+		}
+
+		// The header is needed even when resuming past it.
+		if fieldNames == nil {
+			fieldNames = parseVPCFlowLogHeader(line)
+			report.Skipped(number)
+			continue
+		}
+
+		if report.Resumed(number) {
+			continue
+		}
+
+		values := strings.Fields(line)
+		if len(values) != len(fieldNames) {
+			logrus.WithFields(logrus.Fields{
+				"object":   obj.Object,
+				"expected": len(fieldNames),
+				"actual":   len(values),
+			}).Debug("Flow log record does not match header, skipping")
+			report.Failed(number, line, fmt.Errorf("record has %d fields, header has %d", len(values), len(fieldNames)))
+			continue
+		}
+
+		data := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			if v == "-" {
+				continue
+			}
+			if vpcFlowLogNumericFields[fieldNames[i]] {
+				if typed, ok := typeifyValue(v); ok {
+					data[fieldNames[i]] = typed
+				}
+				continue
+			}
+			data[fieldNames[i]] = v
+		}
+
+		if protocol, ok := data["protocol"].(int64); ok {
+			if name, ok := ipProtocolNames[protocol]; ok {
+				data["protocol_name"] = name
+			}
+		}
+
+		// Records without a start time (e.g. NODATA) are timestamped
+		// when we read them.
+		timestamp := time.Now()
+		if start, ok := data["start"].(int64); ok {
+			timestamp = time.Unix(start, 0).UTC()
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: timestamp,
+			Data:      data,
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *VPCFlowLogEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		// action (ACCEPT/REJECT) and log_status are what we care the
+		// most about, so that rejected traffic and skipped records
+		// aren't drowned out by accepted traffic
+		var key string
+		for _, field := range []string{"action", "log_status", "protocol", "flow_direction"} {
+			if val, ok := ev.Data[field]; ok {
+				key = fmt.Sprintf("%s_%v", key, val)
+			}
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
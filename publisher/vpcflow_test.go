@@ -0,0 +1,111 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestVPCFlowLogParseEvents(t *testing.T) {
+	testCases := []struct {
+		contents  string
+		timestamp time.Time
+		expected  map[string]interface{}
+	}{
+		{
+			contents: `version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status
+2 012345678901 eni-1235b8ca123456789 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 REJECT OK
+`,
+			timestamp: time.Unix(1418530010, 0).UTC(),
+			expected: map[string]interface{}{
+				"version":       int64(2),
+				"account_id":    "012345678901",
+				"interface_id":  "eni-1235b8ca123456789",
+				"srcaddr":       "172.31.16.139",
+				"dstaddr":       "172.31.16.21",
+				"srcport":       int64(20641),
+				"dstport":       int64(22),
+				"protocol":      int64(6),
+				"protocol_name": "tcp",
+				"packets":       int64(20),
+				"bytes":         int64(4249),
+				"start":         int64(1418530010),
+				"end":           int64(1418530070),
+				"action":        "REJECT",
+				"log_status":    "OK",
+			},
+		},
+		{
+			// custom format with version 3-5 fields, "-" values are
+			// dropped
+			contents: `start srcaddr pkt-srcaddr vpc-id instance-id az-id tcp-flags flow-direction traffic-path action
+1418530010 10.0.0.5 - vpc-abcdefab012345678 i-01234567890123456 use1-az1 19 egress 8 ACCEPT
+`,
+			timestamp: time.Unix(1418530010, 0).UTC(),
+			expected: map[string]interface{}{
+				"start":          int64(1418530010),
+				"srcaddr":        "10.0.0.5",
+				"vpc_id":         "vpc-abcdefab012345678",
+				"instance_id":    "i-01234567890123456",
+				"az_id":          "use1-az1",
+				"tcp_flags":      int64(19),
+				"flow_direction": "egress",
+				"traffic_path":   int64(8),
+				"action":         "ACCEPT",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		ep := NewVPCFlowLogEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+		outCh := make(chan event.Event, 1)
+		tmpFile, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		zipper := gzip.NewWriter(tmpFile)
+		if _, err := zipper.Write([]byte(tc.contents)); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := zipper.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		if err := tmpFile.Close(); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		obj := state.DownloadedObject{
+			Object:   "foo",
+			Filename: tmpFile.Name(),
+		}
+		if err := ep.ParseEvents(obj, outCh, nil); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+		ev := <-outCh
+		close(outCh)
+
+		if !ev.Timestamp.Equal(tc.timestamp) {
+			t.Errorf("actual timestamp: %v, expected: %v", ev.Timestamp, tc.timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Error("Output did not match expected:")
+			for k, v := range ev.Data {
+				if reflect.DeepEqual(v, tc.expected[k]) {
+					continue
+				}
+				log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+				log.Print("expected: ", k, "\t(", reflect.TypeOf(tc.expected[k]), ") ", tc.expected[k])
+			}
+			t.Fatal()
+		}
+	}
+}
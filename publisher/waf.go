@@ -0,0 +1,245 @@
+package publisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dynsampler "github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/sampler"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+const wafActionBlock = "BLOCK"
+
+type WAFHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type WAFHTTPRequest struct {
+	ClientIP    string      `json:"clientIp"`
+	Country     string      `json:"country"`
+	Headers     []WAFHeader `json:"headers"`
+	URI         string      `json:"uri"`
+	Args        string      `json:"args"`
+	HTTPVersion string      `json:"httpVersion"`
+	HTTPMethod  string      `json:"httpMethod"`
+	RequestID   string      `json:"requestId"`
+}
+
+type WAFRuleMatch struct {
+	RuleID string `json:"ruleId"`
+	Action string `json:"action"`
+}
+
+type WAFRuleMatchDetail struct {
+	ConditionType    string   `json:"conditionType"`
+	SensitivityLevel string   `json:"sensitivityLevel"`
+	Location         string   `json:"location"`
+	MatchedData      []string `json:"matchedData"`
+}
+
+type WAFRuleGroup struct {
+	RuleGroupID                 string         `json:"ruleGroupId"`
+	TerminatingRule             *WAFRuleMatch  `json:"terminatingRule"`
+	NonTerminatingMatchingRules []WAFRuleMatch `json:"nonTerminatingMatchingRules"`
+}
+
+type WAFLabel struct {
+	Name string `json:"name"`
+}
+
+type WAFRecord struct {
+	Timestamp                   int64                `json:"timestamp"`
+	FormatVersion               int64                `json:"formatVersion"`
+	WebACLID                    string               `json:"webaclId"`
+	TerminatingRuleID           string               `json:"terminatingRuleId"`
+	TerminatingRuleType         string               `json:"terminatingRuleType"`
+	Action                      string               `json:"action"`
+	TerminatingRuleMatchDetails []WAFRuleMatchDetail `json:"terminatingRuleMatchDetails"`
+	HTTPSourceName              string               `json:"httpSourceName"`
+	HTTPSourceID                string               `json:"httpSourceId"`
+	RuleGroupList               []WAFRuleGroup       `json:"ruleGroupList"`
+	NonTerminatingMatchingRules []WAFRuleMatch       `json:"nonTerminatingMatchingRules"`
+	HTTPRequest                 WAFHTTPRequest       `json:"httpRequest"`
+	Labels                      []WAFLabel           `json:"labels"`
+}
+
+type WAFEventParser struct {
+	sampler dynsampler.Sampler
+}
+
+func NewWAFEventParser(opt *options.Options) *WAFEventParser {
+	s, err := sampler.NewSamplerFromOptions(opt)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("couldn't build sampler from arguments")
+	}
+
+	ep := &WAFEventParser{sampler: s}
+
+	if err := ep.sampler.Start(); err != nil {
+		logrus.WithField("err", err).Fatal("Couldn't start dynamic sampler")
+	}
+
+	return ep
+}
+
+// Helper function for flattening WAF records. The nested rule matches are
+// reduced to the rule that decided the action (and a count of the rest), and
+// each request header becomes its own field.
+func flattenWAFRecord(r *WAFRecord) map[string]interface{} {
+	p := make(map[string]interface{})
+
+	p["webacl_id"] = r.WebACLID
+	p["format_version"] = r.FormatVersion
+	p["action"] = r.Action
+	p["terminating_rule_id"] = r.TerminatingRuleID
+	p["terminating_rule_type"] = r.TerminatingRuleType
+	if r.HTTPSourceName != "" && r.HTTPSourceName != "-" {
+		p["http_source_name"] = r.HTTPSourceName
+	}
+	if r.HTTPSourceID != "" && r.HTTPSourceID != "-" {
+		p["http_source_id"] = r.HTTPSourceID
+	}
+
+	if len(r.TerminatingRuleMatchDetails) > 0 {
+		details := r.TerminatingRuleMatchDetails[0]
+		p["terminating_rule_match_condition_type"] = details.ConditionType
+		p["terminating_rule_match_location"] = details.Location
+		if details.SensitivityLevel != "" {
+			p["terminating_rule_match_sensitivity_level"] = details.SensitivityLevel
+		}
+		if len(details.MatchedData) > 0 {
+			p["terminating_rule_match_data"] = strings.Join(details.MatchedData, " ")
+		}
+	}
+
+	nonTerminating := len(r.NonTerminatingMatchingRules)
+	for _, group := range r.RuleGroupList {
+		nonTerminating += len(group.NonTerminatingMatchingRules)
+		// When a rule group terminated the request, terminatingRuleId
+		// is the group, so also record which rule inside it matched.
+		if group.TerminatingRule != nil {
+			p["terminating_rule_group_rule_id"] = group.TerminatingRule.RuleID
+			p["terminating_rule_group_rule_action"] = group.TerminatingRule.Action
+		}
+	}
+	p["non_terminating_match_count"] = int64(nonTerminating)
+
+	if len(r.Labels) > 0 {
+		labels := make([]string, 0, len(r.Labels))
+		for _, label := range r.Labels {
+			labels = append(labels, label.Name)
+		}
+		p["labels"] = strings.Join(labels, ",")
+	}
+
+	req := r.HTTPRequest
+	p["client_ip"] = req.ClientIP
+	p["country"] = req.Country
+	p["request_id"] = req.RequestID
+
+	// Put together a request line so that it is shaped like the load
+	// balancer requests (request_method, request_path, etc.).
+	uri := req.URI
+	if req.Args != "" {
+		uri += "?" + req.Args
+	}
+	p["request"] = fmt.Sprintf("%s %s %s", req.HTTPMethod, uri, req.HTTPVersion)
+
+	for _, header := range req.Headers {
+		name := "request.header." + strings.ToLower(header.Name)
+		if existing, ok := p[name].(string); ok {
+			p[name] = existing + ", " + header.Value
+		} else {
+			p[name] = header.Value
+		}
+	}
+
+	return p
+}
+
+// WAF logs are JSON lines, one record per request.
+func (ep *WAFEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event, report *LineReport) error {
+	r, err := openObject(obj.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	// headers can make for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		if report.Resumed(number) {
+			continue
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			report.Skipped(number)
+			continue
+		}
+
+		var record WAFRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"error":  err,
+			}).Debug("Couldn't unmarshal WAF log record, skipping")
+			report.Failed(number, string(line), err)
+			continue
+		}
+
+		report.Send(out, event.Event{
+			Timestamp: time.Unix(0, record.Timestamp*int64(time.Millisecond)).UTC(),
+			Data:      flattenWAFRecord(&record),
+		}, number)
+	}
+
+	return scanner.Err()
+}
+
+func (ep *WAFEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	for ev := range in {
+		action, _ := ev.Data["action"].(string)
+
+		// Blocked requests are what people look at WAF logs for, so
+		// keep every one of them.
+		if action == wafActionBlock {
+			ev.SampleRate = 1
+			out <- ev
+			continue
+		}
+
+		key := action
+		if ruleID, ok := ev.Data["terminating_rule_id"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, ruleID)
+		}
+
+		// Make sure sample rate is per-web ACL
+		if webACL, ok := ev.Data["webacl_id"].(string); ok {
+			key = fmt.Sprintf("%s_%s", key, webACL)
+		}
+
+		rate := ep.sampler.GetSampleRate(key)
+		if rate <= 0 {
+			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
+			rate = 1
+		}
+		if rand.Intn(rate) == 0 {
+			ev.SampleRate = rate
+			out <- ev
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestWAFParseEvents(t *testing.T) {
+	wafPublisher := NewWAFEventParser(&options.Options{SampleRate: 1, SamplerType: "simple"})
+	outCh := make(chan event.Event, 1)
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zipper := gzip.NewWriter(tmpFile)
+	if _, err := zipper.Write([]byte(`{"timestamp":1576280412771,"formatVersion":1,"webaclId":"arn:aws:wafv2:ap-southeast-2:111122223333:regional/webacl/STMTest/1EXAMPLE-2ARN-3ARN-4ARN-123456EXAMPLE","terminatingRuleId":"AWS-AWSManagedRulesSQLiRuleSet","terminatingRuleType":"MANAGED_RULE_GROUP","action":"BLOCK","terminatingRuleMatchDetails":[{"conditionType":"SQL_INJECTION","sensitivityLevel":"HIGH","location":"HEADER","matchedData":["10","AND","1"]}],"httpSourceName":"ALB","httpSourceId":"-","ruleGroupList":[{"ruleGroupId":"AWS#AWSManagedRulesSQLiRuleSet","terminatingRule":{"ruleId":"SQLi_HEADER","action":"BLOCK"},"nonTerminatingMatchingRules":[{"ruleId":"SQLi_BODY","action":"COUNT"}]}],"rateBasedRuleList":[],"nonTerminatingMatchingRules":[{"ruleId":"CountAll","action":"COUNT"}],"httpRequest":{"clientIp":"1.1.1.1","country":"AU","headers":[{"name":"Host","value":"localhost:1989"},{"name":"User-Agent","value":"curl/7.61.1"},{"name":"x-stm-test","value":"10 AND 1=1"},{"name":"X-STM-Test","value":"again"}],"uri":"/myUri","args":"a=1","httpVersion":"HTTP/1.1","httpMethod":"GET","requestId":"rid"},"labels":[{"name":"awswaf:managed:aws:sql-database:SQLi_Header"}]}
+`)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := zipper.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	obj := state.DownloadedObject{
+		Object:   "foo",
+		Filename: tmpFile.Name(),
+	}
+	if err := wafPublisher.ParseEvents(obj, outCh, nil); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	expected := map[string]interface{}{
+		"webacl_id":                                "arn:aws:wafv2:ap-southeast-2:111122223333:regional/webacl/STMTest/1EXAMPLE-2ARN-3ARN-4ARN-123456EXAMPLE",
+		"format_version":                           int64(1),
+		"action":                                   "BLOCK",
+		"terminating_rule_id":                      "AWS-AWSManagedRulesSQLiRuleSet",
+		"terminating_rule_type":                    "MANAGED_RULE_GROUP",
+		"terminating_rule_group_rule_id":           "SQLi_HEADER",
+		"terminating_rule_group_rule_action":       "BLOCK",
+		"terminating_rule_match_condition_type":    "SQL_INJECTION",
+		"terminating_rule_match_location":          "HEADER",
+		"terminating_rule_match_sensitivity_level": "HIGH",
+		"terminating_rule_match_data":              "10 AND 1",
+		"http_source_name":                         "ALB",
+		"non_terminating_match_count":              int64(2),
+		"labels":                                   "awswaf:managed:aws:sql-database:SQLi_Header",
+		"client_ip":                                "1.1.1.1",
+		"country":                                  "AU",
+		"request_id":                               "rid",
+		"request":                                  "GET /myUri?a=1 HTTP/1.1",
+		"request.header.host":                      "localhost:1989",
+		"request.header.user-agent":                "curl/7.61.1",
+		"request.header.x-stm-test":                "10 AND 1=1, again",
+	}
+	ev := <-outCh
+	close(outCh)
+
+	if !ev.Timestamp.Equal(time.Unix(1576280412, 771000000)) {
+		t.Errorf("unexpected timestamp %v", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Error("Output did not match expected:")
+		for k, v := range ev.Data {
+			if reflect.DeepEqual(v, expected[k]) {
+				continue
+			}
+			log.Print("actual: ", k, "\t(", reflect.TypeOf(v), ") ", v)
+			log.Print("expected: ", k, "\t(", reflect.TypeOf(expected[k]), ") ", expected[k])
+		}
+		t.Fatal()
+	}
+}
+
+func TestWAFDynSampleKeepsBlocks(t *testing.T) {
+	// a sampler that would drop (nearly) everything
+	wafPublisher := NewWAFEventParser(&options.Options{SampleRate: 1000000, SamplerType: "simple", SamplerInterval: 300})
+	in := make(chan event.Event)
+	out := make(chan event.Event, 100)
+	go wafPublisher.DynSample(in, out)
+
+	for i := 0; i < 100; i++ {
+		in <- event.Event{Data: map[string]interface{}{"action": "BLOCK"}}
+	}
+	close(in)
+
+	for i := 0; i < 100; i++ {
+		ev := <-out
+		if ev.SampleRate != 1 {
+			t.Fatalf("expected BLOCK to be kept with sample rate 1, got %d", ev.SampleRate)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package shutdown stops the ingest and serve subcommands gracefully on SIGINT
+// or SIGTERM: objects stop being listed, those in flight are finished, and
+// their events are flushed to Honeycomb before exiting, so that nothing the
+// state says was processed is lost.
+package shutdown
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/publisher"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Shutdown coordinates stopping the downloaders and publishers of a
+// subcommand.
+type Shutdown struct {
+	// Stopping is done once a signal has been received, after which no
+	// more objects are listed, but those already claimed are downloaded
+	// and published.
+	Stopping context.Context
+	// Aborting is done once Timeout has passed since Stopping, or a second
+	// signal has been received, after which objects still being published
+	// are abandoned, to be picked up from their offsets the next time.
+	Aborting context.Context
+	// Timeout is how long the objects in flight, and then flushing their
+	// events, are each given.
+	Timeout time.Duration
+
+	workers    sync.WaitGroup
+	publishing sync.WaitGroup
+	once       sync.Once
+	done       chan struct{}
+}
+
+// New starts waiting for SIGINT or SIGTERM, giving the objects in flight
+// --shutdown_timeout to finish.
+func New(opt *options.Options) *Shutdown {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return newShutdown(signals, time.Duration(opt.ShutdownTimeout)*time.Second)
+}
+
+func newShutdown(signals <-chan os.Signal, timeout time.Duration) *Shutdown {
+	aborting, abort := context.WithCancel(context.Background())
+	stopping, stop := context.WithCancel(aborting)
+	s := &Shutdown{
+		Stopping: stopping,
+		Aborting: aborting,
+		Timeout:  timeout,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig).Info("Shutting down, finishing the objects in flight")
+		stop()
+
+		select {
+		case sig = <-signals:
+			logrus.WithField("signal", sig).Warn("Shutting down straight away, abandoning the objects in flight")
+		case <-time.After(timeout):
+			logrus.WithField("timeout", timeout).Warn("Timed out shutting down, abandoning the objects in flight")
+		}
+		abort()
+	}()
+
+	return s
+}
+
+// Go runs fn in the background with Stopping, e.g. to download objects, and
+// holds Done back until it returns.
+func (s *Shutdown) Go(fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.Stopping)
+	}()
+}
+
+// Done returns a channel which is closed once Stopping is done and every
+// function run with Go has returned, after which nothing more is downloaded.
+func (s *Shutdown) Done() <-chan struct{} {
+	s.once.Do(func() {
+		go func() {
+			<-s.Stopping.Done()
+			s.workers.Wait()
+			close(s.done)
+		}()
+	})
+	return s.done
+}
+
+// Publish publishes the objects sent on downloads with p in the background,
+// one at a time, until Done.
+func (s *Shutdown) Publish(p publisher.Publisher, downloads <-chan state.DownloadedObject) {
+	s.publishing.Add(1)
+	go func() {
+		defer s.publishing.Done()
+		for {
+			select {
+			case download := <-downloads:
+				if err := p.Publish(s.Aborting, download); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"object": download,
+						"error":  err,
+					}).Error("Cannot properly publish downloaded object")
+				}
+			case <-s.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Wait blocks until Done, and every object downloaded has been published.
+func (s *Shutdown) Wait() {
+	<-s.Done()
+	s.publishing.Wait()
+}
+
+// Finish flushes the events of the publishers, then leaves the shard and
+// closes the state. Any of them may be nil. It must only be called once
+// nothing more is being published, e.g. after Wait.
+func (s *Shutdown) Finish(stater state.Stater, shard *state.Shard, publishers ...*publisher.HoneycombPublisher) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	for _, p := range publishers {
+		if p == nil {
+			continue
+		}
+		if err := p.Close(ctx); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	if shard != nil {
+		if err := shard.Close(); err != nil {
+			logrus.WithField("member", shard.Member).Error(err)
+		}
+	}
+	if closer, ok := stater.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.WithField("error", err).Error("Couldn't close state")
+		}
+	}
+
+	logrus.Info("Shut down cleanly")
+}
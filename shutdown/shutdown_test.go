@@ -0,0 +1,78 @@
+package shutdown
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/state"
+)
+
+type recordingPublisher struct {
+	sync.Mutex
+	objects []string
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, obj state.DownloadedObject) error {
+	p.Lock()
+	defer p.Unlock()
+	p.objects = append(p.objects, obj.Object)
+	return nil
+}
+
+func TestShutdownFinishesObjectsInFlight(t *testing.T) {
+	signals := make(chan os.Signal, 2)
+	s := newShutdown(signals, time.Minute)
+
+	downloads := make(chan state.DownloadedObject)
+	s.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		// An object downloaded while stopping is still published.
+		downloads <- state.DownloadedObject{Object: "foo"}
+	})
+	p := &recordingPublisher{}
+	s.Publish(p, downloads)
+
+	signals <- os.Interrupt
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expected shutting down to finish")
+	}
+
+	if len(p.objects) != 1 || p.objects[0] != "foo" {
+		t.Errorf("expected the object in flight to be published, got %v", p.objects)
+	}
+	if s.Aborting.Err() != nil {
+		t.Error("expected the objects in flight not to be abandoned")
+	}
+}
+
+func TestShutdownAborts(t *testing.T) {
+	signals := make(chan os.Signal, 2)
+	s := newShutdown(signals, time.Minute)
+
+	signals <- os.Interrupt
+	<-s.Stopping.Done()
+	signals <- os.Interrupt
+	select {
+	case <-s.Aborting.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected a second signal to abandon the objects in flight")
+	}
+
+	s = newShutdown(signals, 10*time.Millisecond)
+	signals <- os.Interrupt
+	select {
+	case <-s.Aborting.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the objects in flight to be abandoned after the timeout")
+	}
+}
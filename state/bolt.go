@@ -0,0 +1,365 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltFileFormat = "%s-state.db"
+	// migratedSuffix is appended to the JSON files of a FileStater once
+	// they've been imported, so that they're only imported once.
+	migratedSuffix = ".migrated"
+)
+
+var (
+	// processedBucket maps objects to the time they were processed.
+	processedBucket = []byte("processed")
+	// expiryBucket indexes processedBucket by time, with keys of the time
+	// (as big-endian Unix nanoseconds) followed by the object, so that
+	// reaping only has to look at the objects which are due.
+	expiryBucket = []byte("expiry")
+	// offsetsBucket maps objects in progress to their offsets.
+	offsetsBucket = []byte("offsets")
+
+	// boltOpenTimeout is how long opening a state database waits for
+	// another process to close it.
+	boltOpenTimeout = 5 * time.Second
+)
+
+// BoltStater is an implementation for indicating processing state using an
+// embedded, transactional bbolt database on the local filesystem. Unlike
+// FileStater, setting an object as processed only writes that object, and a
+// crash can't leave the state half written.
+type BoltStater struct {
+	DB               *bolt.DB
+	BackfillInterval time.Duration
+}
+
+// NewBoltStater opens (or creates) the state database of the service in
+// stateDir. The first time, the state files of a FileStater for the same
+// service are imported if there are any.
+func NewBoltStater(stateDir, service string, backfillHrs int) (*BoltStater, error) {
+	db, err := openBoltDB(filepath.Join(stateDir, fmt.Sprintf(boltFileFormat, service)), false)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BoltStater{
+		DB:               db,
+		BackfillInterval: time.Hour * time.Duration(backfillHrs),
+	}
+	if err := b.migrate(NewFileStater(stateDir, service, backfillHrs)); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// NewReadOnlyBoltStater opens the existing state database of the service in
+// stateDir to be read, e.g. by the state subcommand, without importing the
+// state files of a FileStater.
+func NewReadOnlyBoltStater(stateDir, service string, backfillHrs int) (*BoltStater, error) {
+	filename := filepath.Join(stateDir, fmt.Sprintf(boltFileFormat, service))
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("Error opening state database %s: %s", filename, err)
+	}
+	db, err := openBoltDB(filename, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStater{
+		DB:               db,
+		BackfillInterval: time.Hour * time.Duration(backfillHrs),
+	}, nil
+}
+
+// openBoltDB opens a state database. Only one process can have it open to
+// write, and none to read while it does, so this gives up with an explanation
+// rather than waiting for e.g. an ingest to exit.
+func openBoltDB(filename string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("State database %s is in use by another process, e.g. a running ingest, which must be stopped first", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening state database %s: %s", filename, err)
+	}
+	return db, nil
+}
+
+// expiryKey is the key of an object processed at t in expiryBucket.
+func expiryKey(t time.Time, object string) []byte {
+	k := make([]byte, 8+len(object))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	copy(k[8:], object)
+	return k
+}
+
+func putProcessed(tx *bolt.Tx, object string, t time.Time) error {
+	processed := tx.Bucket(processedBucket)
+	expiry := tx.Bucket(expiryBucket)
+
+	if v := processed.Get([]byte(object)); v != nil {
+		var prev time.Time
+		if err := prev.UnmarshalBinary(v); err == nil {
+			if err := expiry.Delete(expiryKey(prev, object)); err != nil {
+				return err
+			}
+		}
+	}
+
+	v, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := processed.Put([]byte(object), v); err != nil {
+		return err
+	}
+	return expiry.Put(expiryKey(t, object), nil)
+}
+
+func putOffset(tx *bolt.Tx, object string, offset int) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(offset))
+	return tx.Bucket(offsetsBucket).Put([]byte(object), v)
+}
+
+// migrate creates the buckets and, if they didn't exist yet, imports the
+// state files of f.
+func (b *BoltStater) migrate(f *FileStater) error {
+	var imported []string
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(processedBucket) != nil {
+			return nil
+		}
+		for _, name := range [][]byte{processedBucket, expiryBucket, offsetsBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		if _, err := os.Stat(f.stateFile()); err == nil {
+			data, err := ioutil.ReadFile(f.stateFile())
+			if err != nil {
+				return fmt.Errorf("Error reading object cursor file: %s", err)
+			}
+			var objs map[string]time.Time
+			if err := json.Unmarshal(data, &objs); err != nil {
+				return fmt.Errorf("Unmarshalling state file JSON failed: %s", err)
+			}
+			for object, t := range objs {
+				if err := putProcessed(tx, object, t); err != nil {
+					return err
+				}
+			}
+			imported = append(imported, f.stateFile())
+		}
+
+		if _, err := os.Stat(f.offsetsFile()); err == nil {
+			offsets, err := f.offsets()
+			if err != nil {
+				return err
+			}
+			for object, o := range offsets {
+				if err := putOffset(tx, object, o.Offset); err != nil {
+					return err
+				}
+			}
+			imported = append(imported, f.offsetsFile())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error migrating state: %s", err)
+	}
+
+	for _, filename := range imported {
+		logrus.WithField("file", filename).Info("Imported local state file")
+		if err := os.Rename(filename, filename+migratedSuffix); err != nil {
+			return fmt.Errorf("Error renaming migrated state file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *BoltStater) ProcessedObjects() (map[string]time.Time, error) {
+	objs := make(map[string]time.Time)
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(processedBucket).ForEach(func(k, v []byte) error {
+			var t time.Time
+			if err := t.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if time.Since(t) <= b.BackfillInterval {
+				objs[string(k)] = t
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error reading state database: %s", err)
+	}
+
+	return objs, nil
+}
+
+func (b *BoltStater) ProcessedObjectsWithPrefix(prefix string) (map[string]time.Time, error) {
+	objs := make(map[string]time.Time)
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(processedBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var t time.Time
+			if err := t.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if time.Since(t) <= b.BackfillInterval {
+				objs[string(k)] = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error reading state database: %s", err)
+	}
+
+	return objs, nil
+}
+
+func (b *BoltStater) SetProcessed(object string) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		// Reap old objects (outside of the "backfill interval"), which
+		// are at the start of the expiry index.
+		cutoff := expiryKey(time.Now().Add(-b.BackfillInterval), "")
+		c := tx.Bucket(expiryBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.First() {
+			expired := k[8:]
+			if err := tx.Bucket(processedBucket).Delete(expired); err != nil {
+				return err
+			}
+			if err := tx.Bucket(offsetsBucket).Delete(expired); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return putProcessed(tx, object, time.Now())
+	})
+	if err != nil {
+		return fmt.Errorf("Writing state database failed: %s", err)
+	}
+
+	return nil
+}
+
+// SetProcessedWithPrefix is SetProcessed, as objects are looked up by prefix
+// from an ordered bucket rather than kept by it.
+func (b *BoltStater) SetProcessedWithPrefix(prefix, object string) error {
+	return b.SetProcessed(object)
+}
+
+func (b *BoltStater) SetProcessedAt(object string, t time.Time) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return putProcessed(tx, object, t)
+	})
+	if err != nil {
+		return fmt.Errorf("Writing state database failed: %s", err)
+	}
+	return nil
+}
+
+func (b *BoltStater) Forget(object string) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		processed := tx.Bucket(processedBucket)
+		if v := processed.Get([]byte(object)); v != nil {
+			var t time.Time
+			if err := t.UnmarshalBinary(v); err == nil {
+				if err := tx.Bucket(expiryBucket).Delete(expiryKey(t, object)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := processed.Delete([]byte(object)); err != nil {
+			return err
+		}
+		return tx.Bucket(offsetsBucket).Delete([]byte(object))
+	})
+	if err != nil {
+		return fmt.Errorf("Writing state database failed: %s", err)
+	}
+	return nil
+}
+
+func (b *BoltStater) InProgressObjects() (map[string]Progress, error) {
+	objs := make(map[string]Progress)
+
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(offsetsBucket).ForEach(func(k, v []byte) error {
+			objs[string(k)] = Progress{Offset: int(binary.BigEndian.Uint64(v))}
+			return nil
+		})
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error reading state database: %s", err)
+	}
+
+	return objs, nil
+}
+
+func (b *BoltStater) Offset(object string) (int, error) {
+	var offset int
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(offsetsBucket).Get([]byte(object)); v != nil {
+			offset = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading state database: %s", err)
+	}
+	return offset, nil
+}
+
+func (b *BoltStater) SetOffset(object string, offset int) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return putOffset(tx, object, offset)
+	})
+	if err != nil {
+		return fmt.Errorf("Writing state database failed: %s", err)
+	}
+	return nil
+}
+
+func (b *BoltStater) ClearOffset(object string) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(offsetsBucket).Delete([]byte(object))
+	})
+	if err != nil {
+		return fmt.Errorf("Writing state database failed: %s", err)
+	}
+	return nil
+}
+
+// Close closes the database, releasing its lock so that another process can
+// open it.
+func (b *BoltStater) Close() error {
+	return b.DB.Close()
+}
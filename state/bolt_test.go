@@ -0,0 +1,126 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStaterMigratesFileState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFileStater(dir, "foo", 1)
+	if err := f.SetProcessed("bar"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := f.SetOffset("bar", 42); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	b, err := NewBoltStater(dir, "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer b.Close()
+
+	objs, err := b.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["bar"]; !ok || len(objs) != 1 {
+		t.Errorf("expected bar to be processed, got %v", objs)
+	}
+	if offset, err := b.Offset("bar"); err != nil || offset != 42 {
+		t.Errorf("expected offset 42, got %d (%v)", offset, err)
+	}
+
+	for _, filename := range []string{"foo-state.json", "foo-offsets.json"} {
+		if _, err := os.Stat(filepath.Join(dir, filename)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been moved aside, got %v", filename, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, filename+migratedSuffix)); err != nil {
+			t.Errorf("expected %s%s to exist, got %v", filename, migratedSuffix, err)
+		}
+	}
+}
+
+func TestBoltStaterReapsExpiredObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewBoltStater(dir, "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer b.Close()
+	b.BackfillInterval = 50 * time.Millisecond
+
+	if err := b.SetProcessed("old"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := b.SetOffset("old", 7); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := b.SetProcessed("new"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	// setting an object again moves it in the expiry index
+	if err := b.SetProcessed("new"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	objs, err := b.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["new"]; !ok || len(objs) != 1 {
+		t.Errorf("expected only new to be processed, got %v", objs)
+	}
+	inProgress, err := b.InProgressObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if len(inProgress) != 0 {
+		t.Errorf("expected the offset of old to be reaped, got %v", inProgress)
+	}
+}
+
+func TestBoltStaterProcessedObjectsWithPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewBoltStater(dir, "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer b.Close()
+
+	for _, object := range []string{"AWSLogs/2019/01/01/a", "AWSLogs/2019/01/02/b", "AWSLogs/2019/01/02/c", "AWSLogs/2019/01/03/d"} {
+		if err := b.SetProcessed(object); err != nil {
+			t.Fatal("Shouldn't have err but did: ", err)
+		}
+	}
+
+	objs, err := b.ProcessedObjectsWithPrefix("AWSLogs/2019/01/02/")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	_, okB := objs["AWSLogs/2019/01/02/b"]
+	_, okC := objs["AWSLogs/2019/01/02/c"]
+	if !okB || !okC || len(objs) != 2 {
+		t.Errorf("expected only the objects under the prefix, got %v", objs)
+	}
+}
@@ -0,0 +1,267 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ManagedStater is implemented by Staters whose state can be changed by an
+// operator with the state subcommand, e.g. to force objects to be processed
+// again.
+type ManagedStater interface {
+	Stater
+
+	// SetProcessedAt sets an object as processed at t, whether or not it
+	// has been processed already.
+	SetProcessedAt(object string, t time.Time) error
+
+	// Forget removes an object, and its offset if it's in progress, from
+	// the state so that it is processed again.
+	Forget(object string) error
+}
+
+const commandUsage = `Usage: state [ls [prefix]|show <object>|forget <object>|forget <prefix>*|forget <start>..<end>|export|import [file]]
+
+Objects are only listed, shown (and forgotten by prefix or time) if they were
+processed within --since hours. Times are RFC 3339, e.g.
+2019-01-02T15:04:05Z, and either end of a range may be left out.`
+
+// RunCommand runs a state subcommand, which lets operators see which objects
+// have been processed (ls and show), force objects to be processed again
+// (forget), and copy state between backends or deployments (export and
+// import). Exports are JSON objects of objects to the times they were
+// processed, the same as the state files of FileStater.
+func RunCommand(stater Stater, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", commandUsage)
+	}
+
+	switch args[0] {
+	case "ls", "list":
+		prefix := ""
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		return listState(stater, prefix, stdout)
+
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", commandUsage)
+		}
+		return showState(stater, args[1], stdout)
+
+	case "forget":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", commandUsage)
+		}
+		return forgetState(stater, args[1], stdout)
+
+	case "export":
+		objs, err := stater.ProcessedObjects()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(objs)
+
+	case "import":
+		in := stdin
+		if len(args) > 1 && args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		return importState(stater, in, stdout)
+	}
+
+	return fmt.Errorf("State subcommand %q not recognized\n\n%s", args[0], commandUsage)
+}
+
+// readOnlyCommand returns whether the state subcommand args only read the
+// state.
+func readOnlyCommand(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	switch args[0] {
+	case "ls", "list", "show", "export":
+		return true
+	}
+	return false
+}
+
+func managed(stater Stater) (ManagedStater, error) {
+	m, ok := stater.(ManagedStater)
+	if !ok {
+		return nil, fmt.Errorf("State of %T can't be changed", stater)
+	}
+	return m, nil
+}
+
+// inProgress returns the offsets of objects in progress, if the Stater has
+// them.
+func inProgress(stater Stater) (map[string]Progress, error) {
+	if offsetStater, ok := stater.(OffsetStater); ok {
+		return offsetStater.InProgressObjects()
+	}
+	return map[string]Progress{}, nil
+}
+
+func listState(stater Stater, prefix string, stdout io.Writer) error {
+	objs, err := stater.ProcessedObjects()
+	if err != nil {
+		return err
+	}
+	offsets, err := inProgress(stater)
+	if err != nil {
+		return err
+	}
+
+	var objects []string
+	for object := range objs {
+		if strings.HasPrefix(object, prefix) {
+			objects = append(objects, object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if !objs[objects[i]].Equal(objs[objects[j]]) {
+			return objs[objects[i]].Before(objs[objects[j]])
+		}
+		return objects[i] < objects[j]
+	})
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROCESSED\tOBJECT\tOFFSET")
+	for _, object := range objects {
+		offset := "-"
+		if o, ok := offsets[object]; ok {
+			offset = fmt.Sprint(o.Offset)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", objs[object].UTC().Format(time.RFC3339), object, offset)
+	}
+	return w.Flush()
+}
+
+func showState(stater Stater, object string, stdout io.Writer) error {
+	objs, err := stater.ProcessedObjects()
+	if err != nil {
+		return err
+	}
+	offsets, err := inProgress(stater)
+	if err != nil {
+		return err
+	}
+
+	t, processed := objs[object]
+	progress, started := offsets[object]
+	switch {
+	case processed && started && progress.Owner != "":
+		fmt.Fprintf(stdout, "%s: claimed at %s, in progress with %d lines sent by %s\n", object, t.UTC().Format(time.RFC3339), progress.Offset, progress.Owner)
+	case processed && started:
+		fmt.Fprintf(stdout, "%s: claimed at %s, in progress with %d lines sent\n", object, t.UTC().Format(time.RFC3339), progress.Offset)
+	case processed:
+		fmt.Fprintf(stdout, "%s: processed at %s\n", object, t.UTC().Format(time.RFC3339))
+	default:
+		fmt.Fprintf(stdout, "%s: not processed\n", object)
+	}
+	return nil
+}
+
+// matcher returns whether objects processed at a time match a forget
+// argument, and whether the argument is a single object.
+func matcher(arg string) (match func(object string, t time.Time) bool, single bool, err error) {
+	if strings.HasSuffix(arg, "*") {
+		prefix := strings.TrimSuffix(arg, "*")
+		return func(object string, t time.Time) bool {
+			return strings.HasPrefix(object, prefix)
+		}, false, nil
+	}
+
+	if parts := strings.SplitN(arg, "..", 2); len(parts) == 2 {
+		var start, end time.Time
+		if parts[0] != "" {
+			if start, err = time.Parse(time.RFC3339, parts[0]); err != nil {
+				return nil, false, fmt.Errorf("Error parsing start of range: %s", err)
+			}
+		}
+		if parts[1] != "" {
+			if end, err = time.Parse(time.RFC3339, parts[1]); err != nil {
+				return nil, false, fmt.Errorf("Error parsing end of range: %s", err)
+			}
+		}
+		return func(object string, t time.Time) bool {
+			return !t.Before(start) && (end.IsZero() || t.Before(end))
+		}, false, nil
+	}
+
+	return func(object string, t time.Time) bool {
+		return object == arg
+	}, true, nil
+}
+
+func forgetState(stater Stater, arg string, stdout io.Writer) error {
+	m, err := managed(stater)
+	if err != nil {
+		return err
+	}
+	match, single, err := matcher(arg)
+	if err != nil {
+		return err
+	}
+
+	// A single object is forgotten even if it's outside of the backfill
+	// interval.
+	if single {
+		if err := m.Forget(arg); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Forgot %s\n", arg)
+		return nil
+	}
+
+	objs, err := m.ProcessedObjects()
+	if err != nil {
+		return err
+	}
+	forgotten := 0
+	for object, t := range objs {
+		if !match(object, t) {
+			continue
+		}
+		if err := m.Forget(object); err != nil {
+			return err
+		}
+		forgotten++
+	}
+	fmt.Fprintf(stdout, "Forgot %d objects\n", forgotten)
+	return nil
+}
+
+func importState(stater Stater, in io.Reader, stdout io.Writer) error {
+	m, err := managed(stater)
+	if err != nil {
+		return err
+	}
+
+	var objs map[string]time.Time
+	if err := json.NewDecoder(in).Decode(&objs); err != nil {
+		return fmt.Errorf("Unmarshalling state JSON failed: %s", err)
+	}
+	for object, t := range objs {
+		if err := m.SetProcessedAt(object, t); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "Imported %d objects\n", len(objs))
+	return nil
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewBoltStater(dir, "foo", 24)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer b.Close()
+
+	run := func(stdin string, args ...string) string {
+		var out bytes.Buffer
+		if err := RunCommand(b, args, strings.NewReader(stdin), &out); err != nil {
+			t.Fatalf("state %v: shouldn't have err but did: %s", args, err)
+		}
+		return out.String()
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	run(`{
+		"AWSLogs/a.log.gz": "`+now.Add(-3*time.Hour).Format(time.RFC3339)+`",
+		"AWSLogs/b.log.gz": "`+now.Add(-2*time.Hour).Format(time.RFC3339)+`",
+		"Other/c.log.gz": "`+now.Add(-time.Hour).Format(time.RFC3339)+`"
+	}`, "import")
+	if err := b.SetOffset("AWSLogs/b.log.gz", 42); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	ls := run("", "ls", "AWSLogs/")
+	if lines := strings.Split(strings.TrimSpace(ls), "\n"); len(lines) != 3 ||
+		!strings.Contains(lines[1], "AWSLogs/a.log.gz") ||
+		!strings.Contains(lines[2], "AWSLogs/b.log.gz") || !strings.HasSuffix(lines[2], "42") {
+		t.Errorf("unexpected listing:\n%s", ls)
+	}
+
+	if show := run("", "show", "AWSLogs/b.log.gz"); !strings.Contains(show, "in progress with 42 lines sent") {
+		t.Errorf("unexpected show output: %s", show)
+	}
+
+	run("", "forget", "AWSLogs/*")
+	objs, err := b.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["Other/c.log.gz"]; !ok || len(objs) != 1 {
+		t.Errorf("expected only Other/c.log.gz to be left, got %v", objs)
+	}
+	if offset, err := b.Offset("AWSLogs/b.log.gz"); err != nil || offset != 0 {
+		t.Errorf("expected the offset to be forgotten, got %d (%v)", offset, err)
+	}
+
+	run("", "forget", now.Add(-90*time.Minute).Format(time.RFC3339)+"..")
+	if objs, err := b.ProcessedObjects(); err != nil || len(objs) != 0 {
+		t.Errorf("expected every object to be forgotten, got %v (%v)", objs, err)
+	}
+
+	if show := run("", "show", "Other/c.log.gz"); !strings.Contains(show, "not processed") {
+		t.Errorf("unexpected show output: %s", show)
+	}
+}
+
+func TestCommandStaterFromOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := &options.Options{StateBackend: BackendLocal, StateDir: dir, BackfillHr: 1, StateSinceHr: 24}
+	ingest, err := NewStaterFromOptions(opt, nil, "foo")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	b := ingest.(*BoltStater)
+	if err := b.SetProcessedAt("AWSLogs/a.log.gz", time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	// the database can't be read while an ingest has it open
+	defer func(timeout time.Duration) { boltOpenTimeout = timeout }(boltOpenTimeout)
+	boltOpenTimeout = 10 * time.Millisecond
+	if _, err := NewCommandStaterFromOptions(opt, nil, "foo", []string{"ls"}); err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("expected the database to be in use, got %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	// objects processed before --backfill but within --since are shown
+	stater, err := NewCommandStaterFromOptions(opt, nil, "foo", []string{"show", "AWSLogs/a.log.gz"})
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	defer stater.(*BoltStater).Close()
+	var out bytes.Buffer
+	if err := RunCommand(stater, []string{"show", "AWSLogs/a.log.gz"}, nil, &out); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if !strings.Contains(out.String(), "processed at") {
+		t.Errorf("unexpected show output: %s", out.String())
+	}
+	if err := stater.(*BoltStater).SetProcessed("AWSLogs/b.log.gz"); err == nil {
+		t.Error("expected the database to have been opened read-only")
+	}
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+)
+
+// Leaser is implemented by Staters which replicas can elect a leader with.
+// A lease is held by one holder at a time, until it's released or it expires
+// without being renewed.
+type Leaser interface {
+	// AcquireLease acquires or renews the lease called name for holder,
+	// returning whether holder holds it until ttl from now.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease gives up the lease called name if holder holds it.
+	ReleaseLease(name, holder string) error
+}
+
+// WorkQueue is implemented by Staters which the leader can hand work to the
+// other replicas through.
+type WorkQueue interface {
+	// Enqueue adds items to the end of the queue called name.
+	Enqueue(name string, items ...string) error
+
+	// Dequeue removes the item at the start of the queue called name,
+	// returning false if it's empty. Each item is only dequeued by one
+	// replica at a time.
+	Dequeue(name string) (string, bool, error)
+
+	// Ack acknowledges an item dequeued from the queue called name once
+	// the replica has taken it on. Backends may hand items which aren't
+	// acknowledged in time to another replica.
+	Ack(name, item string) error
+}
+
+// Election is how a replica takes part in electing the leaders of entities,
+// which are the only replicas to list their buckets, and hands the objects
+// found to the others.
+type Election struct {
+	Leaser
+	WorkQueue
+	// Holder identifies this replica.
+	Holder string
+	// TTL is how long a lease lasts without being renewed, and so how
+	// long it takes for another replica to take over from a leader which
+	// went away.
+	TTL time.Duration
+}
+
+// NewElectionFromOptions sets up leader election with the state backend if
+// --leader_election is set, returning nil if it isn't.
+func NewElectionFromOptions(opt *options.Options, stater Stater) (*Election, error) {
+	if !opt.LeaderElection {
+		return nil, nil
+	}
+
+	leaser, ok := stater.(Leaser)
+	if !ok {
+		return nil, fmt.Errorf("--leader_election requires --state_backend=%s or %s", BackendDynamoDB, BackendRedis)
+	}
+	queue, ok := stater.(WorkQueue)
+	if !ok {
+		return nil, fmt.Errorf("--leader_election requires --state_backend=%s or %s", BackendDynamoDB, BackendRedis)
+	}
+	if opt.LeaseTTL < 1 {
+		return nil, fmt.Errorf("--lease_ttl must be at least 1 second")
+	}
+
+	replica, err := ReplicaID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Election{
+		Leaser:    leaser,
+		WorkQueue: queue,
+		Holder:    replica,
+		TTL:       time.Second * time.Duration(opt.LeaseTTL),
+	}, nil
+}
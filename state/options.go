@@ -0,0 +1,100 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BackendLocal    = "local"
+	BackendDynamoDB = "dynamodb"
+	BackendRedis    = "redis"
+	BackendS3       = "s3"
+)
+
+// OffsetLease is how long an object in progress is left to the replica which
+// last recorded its offset before another replica may resume it.
+const OffsetLease = 10 * time.Minute
+
+var ErrUnknownBackend = fmt.Errorf("unknown state backend specified, supported backends are: %s, %s, %s, %s", BackendLocal, BackendDynamoDB, BackendRedis, BackendS3)
+
+// NewStaterFromOptions sets up state tracking for a service with the backend
+// chosen by --state_backend, or DynamoDB if --highavail is set.
+func NewStaterFromOptions(opt *options.Options, sess *session.Session, service string) (Stater, error) {
+	return newStater(opt, sess, service, opt.BackfillHr, false)
+}
+
+// NewCommandStaterFromOptions sets up state tracking for the state subcommand
+// args. Objects processed within --since hours are looked at, rather than
+// --backfill, and the local database is only opened to be written by the
+// subcommands which change the state.
+func NewCommandStaterFromOptions(opt *options.Options, sess *session.Session, service string, args []string) (Stater, error) {
+	return newStater(opt, sess, service, opt.StateSinceHr, readOnlyCommand(args))
+}
+
+func newStater(opt *options.Options, sess *session.Session, service string, backfillHrs int, readOnly bool) (Stater, error) {
+	backend := opt.StateBackend
+	if opt.HighAvail {
+		backend = BackendDynamoDB
+	}
+
+	switch backend {
+	case BackendLocal:
+		newBoltStater := NewBoltStater
+		if readOnly {
+			newBoltStater = NewReadOnlyBoltStater
+		}
+		stater, err := newBoltStater(opt.StateDir, service, backfillHrs)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Info("State tracking enabled - using local file system.")
+		return stater, nil
+	case BackendDynamoDB:
+		stater, err := NewDynamoDBStater(sess, DynamoDBConfig{
+			TableName:   opt.DynamoTable,
+			Namespace:   opt.DynamoNamespace,
+			TTL:         time.Hour * time.Duration(opt.DynamoTTLHr),
+			CreateTable: opt.DynamoCreateTable,
+		}, service, backfillHrs)
+		if err != nil {
+			return nil, fmt.Errorf("--highavail requires an existing DynamoDB table named %s (or --dynamodb_create_table), please refer to the README: %s", opt.DynamoTable, err)
+		}
+		logrus.Info("State tracking with high availability enabled - using DynamoDB")
+		return stater, nil
+	case BackendRedis:
+		stater, err := NewRedisStater(opt.RedisURL, service, backfillHrs)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Info("State tracking with high availability enabled - using Redis")
+		return stater, nil
+	case BackendS3:
+		if opt.StateBucket == "" {
+			return nil, fmt.Errorf("--state_backend=%s requires --state_bucket", BackendS3)
+		}
+		stater, err := NewS3Stater(sess, opt.StateBucket, opt.StatePrefix, service, backfillHrs)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Info("State tracking with high availability enabled - using S3")
+		return stater, nil
+	default:
+		return nil, ErrUnknownBackend
+	}
+}
+
+// ReplicaID identifies this replica, by its hostname and process ID, to the
+// others sharing the state backend.
+func ReplicaID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Error getting hostname to identify replica: %s", err)
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid()), nil
+}
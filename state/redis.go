@@ -0,0 +1,407 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix = "honeyaws:"
+
+	// queueAckTimeout is how long an item dequeued from a work queue can go
+	// without being acknowledged before it's put back on the queue, e.g.
+	// because the replica which dequeued it went away.
+	queueAckTimeout = time.Minute
+)
+
+// RedisStater is an implementation for indicating processing state using
+// Redis, for deployments which share state between replicas without DynamoDB.
+// Each processed object is claimed with SET NX and expires after TTLDefault,
+// like the conditional put of DynamoDBStater, and is also indexed by time in a
+// sorted set so that ProcessedObjects doesn't have to scan the keyspace. The
+// offsets of objects in progress expire after TTLDefault too, in case the
+// objects are never finished.
+type RedisStater struct {
+	Client           *redis.Client
+	Service          string
+	BackfillInterval time.Duration
+	// Owner identifies this replica in the offsets it records.
+	Owner string
+	// AckTimeout is how long an item dequeued from a work queue can go
+	// without being acknowledged before it's put back on the queue.
+	AckTimeout time.Duration
+}
+
+// NewRedisStater connects to the Redis server at url, e.g.
+// redis://:password@localhost:6379/0, and checks that it is reachable.
+func NewRedisStater(url, service string, backfillHrs int) (*RedisStater, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing Redis URL: %s", err)
+	}
+
+	owner, err := ReplicaID()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RedisStater{
+		Client:           redis.NewClient(opts),
+		Service:          service,
+		BackfillInterval: time.Hour * time.Duration(backfillHrs),
+		Owner:            owner,
+		AckTimeout:       queueAckTimeout,
+	}
+	if err := r.Client.Ping(context.Background()).Err(); err != nil {
+		r.Client.Close()
+		return nil, fmt.Errorf("Error connecting to Redis: %s", err)
+	}
+
+	return r, nil
+}
+
+var (
+	// acquireLeaseScript renews the lease in KEYS[1] if ARGV[1] holds it,
+	// or acquires it if nobody does, for ARGV[2] milliseconds.
+	acquireLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+	// dequeueScript puts the items of the sorted set KEYS[2] which were
+	// dequeued before ARGV[2] back at the start of the list KEYS[1], in
+	// order, then moves the first item of KEYS[1] to KEYS[2] scored by
+	// ARGV[1], the time it was dequeued in Unix milliseconds.
+	dequeueScript = redis.NewScript(`
+local unacked = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[2])
+for i = #unacked, 1, -1 do
+	redis.call("LPUSH", KEYS[1], unacked[i])
+	redis.call("ZREM", KEYS[2], unacked[i])
+end
+local item = redis.call("LPOP", KEYS[1])
+if not item then
+	return false
+end
+redis.call("ZADD", KEYS[2], ARGV[1], item)
+return item
+`)
+
+	// releaseLeaseScript deletes the lease in KEYS[1] if ARGV[1] holds it.
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+)
+
+// objectKey is the key claimed for a processed object.
+func (r *RedisStater) objectKey(object string) string {
+	return redisKeyPrefix + r.Service + ":object:" + object
+}
+
+// indexKey is the sorted set of processed objects, scored by Unix time.
+func (r *RedisStater) indexKey() string {
+	return redisKeyPrefix + r.Service + ":processed"
+}
+
+// offsetKey holds the progress (as JSON) of an object in progress until it
+// expires.
+func (r *RedisStater) offsetKey(object string) string {
+	return redisKeyPrefix + r.Service + ":offset:" + object
+}
+
+// inProgressKey is the sorted set of objects in progress, scored by when
+// their offsets expire in Unix time.
+func (r *RedisStater) inProgressKey() string {
+	return redisKeyPrefix + r.Service + ":in_progress"
+}
+
+// leaseKey holds the holder of a lease until it expires.
+func (r *RedisStater) leaseKey(name string) string {
+	return redisKeyPrefix + r.Service + ":lease:" + name
+}
+
+// queueKey is the list of items in a work queue.
+func (r *RedisStater) queueKey(name string) string {
+	return redisKeyPrefix + r.Service + ":queue:" + name
+}
+
+// unackedKey is the sorted set of items dequeued from a work queue which
+// haven't been acknowledged, scored by when they were dequeued in Unix
+// milliseconds.
+func (r *RedisStater) unackedKey(name string) string {
+	return redisKeyPrefix + r.Service + ":unacked:" + name
+}
+
+// membersKey is the sorted set of members, scored by when their heartbeats
+// expire in Unix milliseconds.
+func (r *RedisStater) membersKey() string {
+	return redisKeyPrefix + r.Service + ":members"
+}
+
+func (r *RedisStater) ProcessedObjects() (map[string]time.Time, error) {
+	objs := make(map[string]time.Time)
+
+	cutoff := time.Now().Add(-r.BackfillInterval).Unix()
+	members, err := r.Client.ZRangeByScoreWithScores(context.Background(), r.indexKey(), &redis.ZRangeBy{
+		Min: strconv.FormatInt(cutoff, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return objs, fmt.Errorf("Error reading processed objects from Redis: %s", err)
+	}
+
+	for _, m := range members {
+		objs[m.Member.(string)] = time.Unix(int64(m.Score), 0)
+	}
+
+	return objs, nil
+}
+
+func (r *RedisStater) SetProcessed(object string) error {
+	ctx := context.Background()
+	now := time.Now()
+
+	// only one replica gets to claim the object
+	claimed, err := r.Client.SetNX(ctx, r.objectKey(object), now.Format(time.RFC3339Nano), TTLDefault).Result()
+	if err != nil {
+		return fmt.Errorf("SET failed: %s", err)
+	}
+	if !claimed {
+		return fmt.Errorf("Object exists in Redis: %s", object)
+	}
+
+	// Objects which have expired are dropped from the index at the same
+	// time.
+	expiry := strconv.FormatInt(now.Add(-TTLDefault).Unix(), 10)
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, r.indexKey(), redis.Z{Score: float64(now.Unix()), Member: object})
+		pipe.ZRemRangeByScore(ctx, r.indexKey(), "-inf", "("+expiry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error indexing processed object in Redis: %s", err)
+	}
+
+	return nil
+}
+
+func (r *RedisStater) SetProcessedAt(object string, t time.Time) error {
+	ctx := context.Background()
+
+	// Objects which would already have expired aren't worth setting.
+	ttl := TTLDefault - time.Since(t)
+	if ttl <= 0 {
+		return nil
+	}
+
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.objectKey(object), t.Format(time.RFC3339Nano), ttl)
+		pipe.ZAdd(ctx, r.indexKey(), redis.Z{Score: float64(t.Unix()), Member: object})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting processed object in Redis: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) Forget(object string) error {
+	ctx := context.Background()
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.objectKey(object))
+		pipe.ZRem(ctx, r.indexKey(), object)
+		pipe.Del(ctx, r.offsetKey(object))
+		pipe.ZRem(ctx, r.inProgressKey(), object)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error forgetting object in Redis: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) InProgressObjects() (map[string]Progress, error) {
+	ctx := context.Background()
+	objs := make(map[string]Progress)
+
+	// Objects whose offsets have expired are dropped at the same time.
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var members *redis.StringSliceCmd
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, r.inProgressKey(), "-inf", "("+now)
+		members = pipe.ZRange(ctx, r.inProgressKey(), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error reading objects in progress from Redis: %s", err)
+	}
+	if len(members.Val()) == 0 {
+		return objs, nil
+	}
+
+	keys := make([]string, len(members.Val()))
+	for i, object := range members.Val() {
+		keys[i] = r.offsetKey(object)
+	}
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return objs, fmt.Errorf("Error reading offsets from Redis: %s", err)
+	}
+	for i, v := range values {
+		// the offset may have been cleared since
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var p Progress
+		if err := json.Unmarshal([]byte(s), &p); err != nil {
+			return objs, fmt.Errorf("Progress of %s in Redis is malformed: %q", members.Val()[i], s)
+		}
+		objs[members.Val()[i]] = p
+	}
+
+	return objs, nil
+}
+
+func (r *RedisStater) Offset(object string) (int, error) {
+	v, err := r.Client.Get(context.Background(), r.offsetKey(object)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error reading offset from Redis: %s", err)
+	}
+	var p Progress
+	if err := json.Unmarshal([]byte(v), &p); err != nil {
+		return 0, fmt.Errorf("Progress of %s in Redis is malformed: %q", object, v)
+	}
+	return p.Offset, nil
+}
+
+// SetOffset records the offset of an object, which expires after TTLDefault
+// like the object itself, in case the object is never finished.
+func (r *RedisStater) SetOffset(object string, offset int) error {
+	ctx := context.Background()
+	now := time.Now()
+
+	v, err := json.Marshal(Progress{Offset: offset, Owner: r.Owner, Heartbeat: now})
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.offsetKey(object), v, TTLDefault)
+		pipe.ZAdd(ctx, r.inProgressKey(), redis.Z{Score: float64(now.Add(TTLDefault).Unix()), Member: object})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting offset in Redis: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) ClearOffset(object string) error {
+	ctx := context.Background()
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.offsetKey(object))
+		pipe.ZRem(ctx, r.inProgressKey(), object)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error clearing offset in Redis: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	acquired, err := acquireLeaseScript.Run(context.Background(), r.Client, []string{r.leaseKey(name)}, holder, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("Error acquiring lease in Redis: %s", err)
+	}
+	return acquired == 1, nil
+}
+
+func (r *RedisStater) ReleaseLease(name, holder string) error {
+	if err := releaseLeaseScript.Run(context.Background(), r.Client, []string{r.leaseKey(name)}, holder).Err(); err != nil {
+		return fmt.Errorf("Error releasing lease in Redis: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) Enqueue(name string, items ...string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		values[i] = item
+	}
+	if err := r.Client.RPush(context.Background(), r.queueKey(name), values...).Err(); err != nil {
+		return fmt.Errorf("RPUSH failed: %s", err)
+	}
+	return nil
+}
+
+// Dequeue moves the first item of the queue to the items which haven't been
+// acknowledged, first putting back those which weren't acknowledged within
+// AckTimeout.
+func (r *RedisStater) Dequeue(name string) (string, bool, error) {
+	now := time.Now()
+	item, err := dequeueScript.Run(context.Background(), r.Client, []string{r.queueKey(name), r.unackedKey(name)},
+		now.UnixNano()/int64(time.Millisecond), now.Add(-r.AckTimeout).UnixNano()/int64(time.Millisecond)).Text()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("Error dequeuing from Redis: %s", err)
+	}
+	return item, true, nil
+}
+
+func (r *RedisStater) Ack(name, item string) error {
+	if err := r.Client.ZRem(context.Background(), r.unackedKey(name), item).Err(); err != nil {
+		return fmt.Errorf("ZREM failed: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) Heartbeat(member string, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	if err := r.Client.ZAdd(context.Background(), r.membersKey(), redis.Z{Score: float64(expires), Member: member}).Err(); err != nil {
+		return fmt.Errorf("ZADD failed: %s", err)
+	}
+	return nil
+}
+
+func (r *RedisStater) Members() ([]string, error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+
+	// Members whose heartbeats expired are dropped at the same time.
+	var members *redis.StringSliceCmd
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, r.membersKey(), "-inf", "("+now)
+		members = pipe.ZRange(ctx, r.membersKey(), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading members from Redis: %s", err)
+	}
+	return members.Val(), nil
+}
+
+func (r *RedisStater) Leave(member string) error {
+	if err := r.Client.ZRem(context.Background(), r.membersKey(), member).Err(); err != nil {
+		return fmt.Errorf("ZREM failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisStater(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedisStater("redis://"+s.Addr(), "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	other, err := NewRedisStater("redis://"+s.Addr(), "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	if err := r.SetProcessed("bar"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	// another replica can't claim the same object
+	if err := other.SetProcessed("bar"); err == nil {
+		t.Error("expected an error claiming an object twice")
+	}
+	if ttl := s.TTL(r.objectKey("bar")); ttl != TTLDefault {
+		t.Errorf("expected TTL %v, got %v", TTLDefault, ttl)
+	}
+
+	objs, err := other.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["bar"]; !ok || len(objs) != 1 {
+		t.Errorf("expected bar to be processed, got %v", objs)
+	}
+
+	if err := r.SetOffset("bar", 42); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if offset, err := other.Offset("bar"); err != nil || offset != 42 {
+		t.Errorf("expected offset 42, got %d (%v)", offset, err)
+	}
+	if ttl := s.TTL(r.offsetKey("bar")); ttl != TTLDefault {
+		t.Errorf("expected offset TTL %v, got %v", TTLDefault, ttl)
+	}
+	inProgress, err := other.InProgressObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if p := inProgress["bar"]; p.Offset != 42 || p.Owner != r.Owner || time.Since(p.Heartbeat) > time.Minute {
+		t.Errorf("expected bar to be in progress at 42 by %s, got %v", r.Owner, inProgress)
+	}
+	if err := r.ClearOffset("bar"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	inProgress, err = other.InProgressObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if len(inProgress) != 0 {
+		t.Errorf("expected no objects in progress, got %v", inProgress)
+	}
+
+	// once its key has expired, an object can be claimed again
+	s.FastForward(TTLDefault + time.Second)
+	if err := other.SetProcessed("bar"); err != nil {
+		t.Error("Shouldn't have err but did: ", err)
+	}
+}
+
+func TestRedisStaterLeases(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedisStater("redis://"+s.Addr(), "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	if ok, err := r.AcquireLease("lb", "a", 30*time.Second); err != nil || !ok {
+		t.Fatalf("expected a to acquire the lease, got %v (%v)", ok, err)
+	}
+	if ok, err := r.AcquireLease("lb", "b", 30*time.Second); err != nil || ok {
+		t.Fatalf("expected b not to acquire a held lease, got %v (%v)", ok, err)
+	}
+	// the holder can renew it
+	s.FastForward(20 * time.Second)
+	if ok, err := r.AcquireLease("lb", "a", 30*time.Second); err != nil || !ok {
+		t.Fatalf("expected a to renew the lease, got %v (%v)", ok, err)
+	}
+	s.FastForward(20 * time.Second)
+	if ok, err := r.AcquireLease("lb", "b", 30*time.Second); err != nil || ok {
+		t.Fatalf("expected b not to acquire a renewed lease, got %v (%v)", ok, err)
+	}
+
+	// another holder takes over once it expires
+	s.FastForward(31 * time.Second)
+	if ok, err := r.AcquireLease("lb", "b", 30*time.Second); err != nil || !ok {
+		t.Fatalf("expected b to acquire the expired lease, got %v (%v)", ok, err)
+	}
+	// only the holder can release it
+	if err := r.ReleaseLease("lb", "a"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if !s.Exists(r.leaseKey("lb")) {
+		t.Error("expected the lease of b not to be released by a")
+	}
+	if err := r.ReleaseLease("lb", "b"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if ok, err := r.AcquireLease("lb", "a", 30*time.Second); err != nil || !ok {
+		t.Fatalf("expected a to acquire the released lease, got %v (%v)", ok, err)
+	}
+}
+
+func TestRedisStaterQueue(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedisStater("redis://"+s.Addr(), "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	if err := r.Enqueue("lb", "bar", "baz"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	for _, expected := range []string{"bar", "baz"} {
+		if item, ok, err := r.Dequeue("lb"); err != nil || !ok || item != expected {
+			t.Errorf("expected to dequeue %s, got %q %v (%v)", expected, item, ok, err)
+		}
+	}
+	if item, ok, err := r.Dequeue("lb"); err != nil || ok {
+		t.Errorf("expected the queue to be empty, got %q (%v)", item, err)
+	}
+	if err := r.Ack("lb", "bar"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	// baz wasn't acknowledged, e.g. because the replica which dequeued
+	// it went away, so it's handed out again
+	r.AckTimeout = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if item, ok, err := r.Dequeue("lb"); err != nil || !ok || item != "baz" {
+		t.Errorf("expected to dequeue baz again, got %q %v (%v)", item, ok, err)
+	}
+	if err := r.Ack("lb", "baz"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if item, ok, err := r.Dequeue("lb"); err != nil || ok {
+		t.Errorf("expected the queue to be empty, got %q (%v)", item, err)
+	}
+}
@@ -0,0 +1,245 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Stater is an implementation for indicating processing state using marker
+// objects in an S3 bucket, for small deployments which share state between
+// replicas without provisioning DynamoDB. Markers are claimed with
+// conditional writes, so only one replica processes each object. Their last
+// modified time is when the object was processed, so that a lifecycle rule
+// on the prefix can expire them.
+//
+// Markers are kept under <prefix>/<service>/processed/ and the offsets of
+// objects in progress under <prefix>/<service>/offsets/, with the replica
+// which recorded them in their Owner metadata.
+type S3Stater struct {
+	Session          *session.Session
+	Bucket, Prefix   string
+	Service          string
+	BackfillInterval time.Duration
+	// Owner identifies this replica in the offsets it records.
+	Owner string
+}
+
+func NewS3Stater(sess *session.Session, bucket, prefix, service string, backfillHrs int) (*S3Stater, error) {
+	stater := &S3Stater{
+		Session:          sess,
+		Bucket:           bucket,
+		Prefix:           strings.Trim(prefix, "/"),
+		Service:          service,
+		BackfillInterval: time.Hour * time.Duration(backfillHrs),
+	}
+	owner, err := ReplicaID()
+	if err != nil {
+		return stater, err
+	}
+	stater.Owner = owner
+
+	svc := s3.New(sess)
+	if _, err := svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return stater, fmt.Errorf("Error accessing state bucket %s: %s", bucket, err)
+	}
+
+	return stater, nil
+}
+
+func (s *S3Stater) keyPrefix(kind string) string {
+	if s.Prefix == "" {
+		return s.Service + "/" + kind + "/"
+	}
+	return s.Prefix + "/" + s.Service + "/" + kind + "/"
+}
+
+// listMarkers calls fn for every marker of a kind whose object is under
+// objectPrefix.
+func (s *S3Stater) listMarkers(kind, objectPrefix string, fn func(object string, marker *s3.Object)) error {
+	prefix := s.keyPrefix(kind)
+	svc := s3.New(s.Session)
+	return svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix + objectPrefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, marker := range page.Contents {
+			fn(strings.TrimPrefix(*marker.Key, prefix), marker)
+		}
+		return true
+	})
+}
+
+func (s *S3Stater) ProcessedObjects() (map[string]time.Time, error) {
+	return s.ProcessedObjectsWithPrefix("")
+}
+
+func (s *S3Stater) ProcessedObjectsWithPrefix(prefix string) (map[string]time.Time, error) {
+	objs := make(map[string]time.Time)
+
+	err := s.listMarkers("processed", prefix, func(object string, marker *s3.Object) {
+		if time.Since(*marker.LastModified) <= s.BackfillInterval {
+			objs[object] = *marker.LastModified
+		}
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error listing state bucket: %s", err)
+	}
+
+	return objs, nil
+}
+
+func (s *S3Stater) SetProcessed(object string) error {
+	svc := s3.New(s.Session)
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.keyPrefix("processed") + object),
+		Body:   bytes.NewReader(nil),
+	})
+	// The put fails if the marker already exists, so only one replica
+	// gets to claim the object. The SDK's PutObjectInput predates
+	// conditional writes, so the header is set directly.
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+
+	if err := req.Send(); err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok {
+			// Conflicts are concurrent claims, one of which wins.
+			if awsErr.StatusCode() == http.StatusPreconditionFailed || awsErr.StatusCode() == http.StatusConflict {
+				return fmt.Errorf("Object exists in S3: %s", err)
+			}
+		}
+		return fmt.Errorf("PutObject failed: %s", err)
+	}
+
+	return nil
+}
+
+// SetProcessedWithPrefix is SetProcessed, as markers are listed by the prefix
+// of their objects anyway.
+func (s *S3Stater) SetProcessedWithPrefix(prefix, object string) error {
+	return s.SetProcessed(object)
+}
+
+// SetProcessedAt writes the marker of an object. Markers are dated by when
+// they were last modified, which can't be set, so the object is recorded as
+// processed now rather than at t.
+func (s *S3Stater) SetProcessedAt(object string, t time.Time) error {
+	svc := s3.New(s.Session)
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.keyPrefix("processed") + object),
+		Body:   bytes.NewReader(nil),
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject failed: %s", err)
+	}
+	return nil
+}
+
+func (s *S3Stater) Forget(object string) error {
+	svc := s3.New(s.Session)
+	for _, kind := range []string{"processed", "offsets"} {
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.keyPrefix(kind) + object),
+		})
+		if err != nil {
+			return fmt.Errorf("DeleteObject failed: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *S3Stater) InProgressObjects() (map[string]Progress, error) {
+	objs := make(map[string]Progress)
+
+	var objects []string
+	err := s.listMarkers("offsets", "", func(object string, marker *s3.Object) {
+		if time.Since(*marker.LastModified) <= s.BackfillInterval {
+			objects = append(objects, object)
+		}
+	})
+	if err != nil {
+		return objs, fmt.Errorf("Error listing state bucket: %s", err)
+	}
+
+	for _, object := range objects {
+		p, err := s.progress(object)
+		if err != nil {
+			return objs, err
+		}
+		objs[object] = p
+	}
+
+	return objs, nil
+}
+
+// progress reads the offset of an object, which is 0 if there isn't one, along
+// with who recorded it and when.
+func (s *S3Stater) progress(object string) (Progress, error) {
+	var p Progress
+
+	svc := s3.New(s.Session)
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.keyPrefix("offsets") + object),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return p, nil
+		}
+		return p, fmt.Errorf("GetObject failed: %s", err)
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return p, fmt.Errorf("Error reading offset: %s", err)
+	}
+	if p.Offset, err = strconv.Atoi(string(data)); err != nil {
+		return p, fmt.Errorf("Offset of %s in S3 is not a number: %q", object, data)
+	}
+	p.Owner = aws.StringValue(out.Metadata["Owner"])
+	p.Heartbeat = aws.TimeValue(out.LastModified)
+	return p, nil
+}
+
+func (s *S3Stater) Offset(object string) (int, error) {
+	p, err := s.progress(object)
+	return p.Offset, err
+}
+
+func (s *S3Stater) SetOffset(object string, offset int) error {
+	svc := s3.New(s.Session)
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(s.keyPrefix("offsets") + object),
+		Body:     strings.NewReader(strconv.Itoa(offset)),
+		Metadata: map[string]*string{"Owner": aws.String(s.Owner)},
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject failed: %s", err)
+	}
+	return nil
+}
+
+func (s *S3Stater) ClearOffset(object string) error {
+	svc := s3.New(s.Session)
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.keyPrefix("offsets") + object),
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteObject failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// conditionalWrites adds If-None-Match support for puts to a fake S3 server,
+// which gofakes3 doesn't have.
+func conditionalWrites(backend gofakes3.Backend, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("If-None-Match") != "*" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if _, err := backend.HeadObject(parts[0], parts[1]); err == nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestS3Stater(t *testing.T) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("state-bucket"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	server := httptest.NewServer(conditionalWrites(backend, gofakes3.New(backend).Server()))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("foo", "bar", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+
+	s, err := NewS3Stater(sess, "state-bucket", "/honeyaws/", "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	other, err := NewS3Stater(sess, "state-bucket", "honeyaws", "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+
+	if err := s.SetProcessed("AWSLogs/bar.log.gz"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	// another replica can't claim the same object
+	if err := other.SetProcessed("AWSLogs/bar.log.gz"); err == nil {
+		t.Error("expected an error claiming an object twice")
+	}
+	if _, err := backend.HeadObject("state-bucket", "honeyaws/foo/processed/AWSLogs/bar.log.gz"); err != nil {
+		t.Error("expected the marker to exist: ", err)
+	}
+
+	objs, err := other.ProcessedObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["AWSLogs/bar.log.gz"]; !ok || len(objs) != 1 {
+		t.Errorf("expected AWSLogs/bar.log.gz to be processed, got %v", objs)
+	}
+
+	if err := s.SetProcessed("Other/baz.log.gz"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	objs, err = other.ProcessedObjectsWithPrefix("AWSLogs/")
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if _, ok := objs["AWSLogs/bar.log.gz"]; !ok || len(objs) != 1 {
+		t.Errorf("expected only AWSLogs/bar.log.gz under the prefix, got %v", objs)
+	}
+
+	if err := s.SetOffset("AWSLogs/bar.log.gz", 42); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	inProgress, err := other.InProgressObjects()
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if p := inProgress["AWSLogs/bar.log.gz"]; p.Offset != 42 || p.Owner != s.Owner || len(inProgress) != 1 {
+		t.Errorf("expected AWSLogs/bar.log.gz to be in progress at 42 by %s, got %v", s.Owner, inProgress)
+	}
+	if err := s.ClearOffset("AWSLogs/bar.log.gz"); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if offset, err := other.Offset("AWSLogs/bar.log.gz"); err != nil || offset != 0 {
+		t.Errorf("expected offset 0, got %d (%v)", offset, err)
+	}
+}
@@ -0,0 +1,197 @@
+package state
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/sirupsen/logrus"
+)
+
+// Membership is implemented by Staters which can keep track of which replicas
+// of a service are running, with heartbeats which expire.
+type Membership interface {
+	// Heartbeat records that member is running until ttl from now.
+	Heartbeat(member string, ttl time.Duration) error
+
+	// Members returns the members whose heartbeats haven't expired.
+	Members() ([]string, error)
+
+	// Leave removes member straight away, rather than once its heartbeat
+	// expires.
+	Leave(member string) error
+}
+
+// Shard splits entities between the replicas of a service, so that each is
+// only listed by one of them, with consistent (rendezvous) hashing over the
+// members kept in the state backend. When replicas join or leave, only the
+// entities of the replicas which left, or a fair share of entities for the
+// replicas which joined, move.
+type Shard struct {
+	Membership
+	// Member identifies this replica.
+	Member string
+	// TTL is how long a heartbeat lasts, and so how long it takes for the
+	// entities of a replica which went away to be taken over.
+	TTL time.Duration
+
+	mu       sync.RWMutex
+	members  []string
+	watchers []chan struct{}
+	done     chan struct{}
+}
+
+// NewShardFromOptions joins the replicas of the service if --shard is set, and
+// keeps heartbeating and watching the other members until Close is called. It
+// returns nil if --shard isn't set.
+func NewShardFromOptions(opt *options.Options, stater Stater) (*Shard, error) {
+	if !opt.Shard {
+		return nil, nil
+	}
+	if opt.LeaderElection {
+		return nil, fmt.Errorf("--shard and --leader_election can't be used together")
+	}
+
+	membership, ok := stater.(Membership)
+	if !ok {
+		return nil, fmt.Errorf("--shard requires --state_backend=%s or %s", BackendDynamoDB, BackendRedis)
+	}
+	if opt.LeaseTTL < 1 {
+		return nil, fmt.Errorf("--lease_ttl must be at least 1 second")
+	}
+
+	replica, err := ReplicaID()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Shard{
+		Membership: membership,
+		Member:     replica,
+		TTL:        time.Second * time.Duration(opt.LeaseTTL),
+		done:       make(chan struct{}),
+	}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// refresh heartbeats and reloads the members, telling the watchers if they've
+// changed.
+func (s *Shard) refresh() error {
+	if err := s.Heartbeat(s.Member, s.TTL); err != nil {
+		return err
+	}
+	members, err := s.Members()
+	if err != nil {
+		return err
+	}
+	sort.Strings(members)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(members, s.members) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"members": members,
+		"member":  s.Member,
+	}).Info("Replicas changed, rebalancing entities")
+	s.members = members
+	for _, w := range s.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *Shard) run() {
+	ticker := time.NewTicker(s.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.refresh(); err != nil {
+			logrus.WithField("member", s.Member).Error(err)
+		}
+	}
+}
+
+// Close stops heartbeating and leaves, so that the other replicas take over
+// the entities of this one straight away.
+func (s *Shard) Close() error {
+	close(s.done)
+	return s.Leave(s.Member)
+}
+
+// Watch returns a channel which is signalled when the members change.
+func (s *Shard) Watch() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := make(chan struct{}, 1)
+	s.watchers = append(s.watchers, w)
+	return w
+}
+
+// Owns returns whether this replica should list the bucket of entity.
+func (s *Shard) Owns(entity string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// This replica is always a member as far as it's concerned, even if
+	// its heartbeat couldn't be recorded, so that every entity is listed
+	// by someone.
+	members := s.members
+	found := false
+	for _, m := range members {
+		if m == s.Member {
+			found = true
+			break
+		}
+	}
+	if !found {
+		members = append([]string{s.Member}, members...)
+	}
+
+	return owner(entity, members) == s.Member
+}
+
+// owner is the member with the highest hash of itself and the entity.
+func owner(entity string, members []string) string {
+	var best string
+	var bestScore uint64
+	for _, m := range members {
+		h := fnv.New64a()
+		h.Write([]byte(m))
+		h.Write([]byte{0})
+		h.Write([]byte(entity))
+		if score := mix(h.Sum64()); best == "" || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// mix is the finalizer of SplitMix64, which spreads out the FNV hashes of
+// similar strings (e.g. member names which only differ by a digit) so that
+// they're not all highest for the same entities.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
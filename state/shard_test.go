@@ -0,0 +1,100 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestOwnerRebalancesFewEntities(t *testing.T) {
+	var entities []string
+	for i := 0; i < 1000; i++ {
+		entities = append(entities, fmt.Sprintf("lb-%d", i))
+	}
+	members := []string{"host-1", "host-2", "host-3"}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for _, e := range entities {
+		owners[e] = owner(e, members)
+		counts[owners[e]]++
+	}
+	for _, m := range members {
+		// each member should have roughly a third
+		if counts[m] < 250 || counts[m] > 420 {
+			t.Errorf("expected %s to own about a third of the entities, got %d", m, counts[m])
+		}
+	}
+
+	// when a member joins, entities only move to it
+	joined := append(members, "host-4")
+	moved := 0
+	for _, e := range entities {
+		if o := owner(e, joined); o != owners[e] {
+			if o != "host-4" {
+				t.Errorf("expected %s to move to host-4 or stay on %s, got %s", e, owners[e], o)
+			}
+			moved++
+		}
+	}
+	if moved < 150 || moved > 350 {
+		t.Errorf("expected about a quarter of the entities to move, got %d", moved)
+	}
+
+	// when a member leaves, only its entities move
+	left := []string{"host-1", "host-3"}
+	for _, e := range entities {
+		if o := owner(e, left); o != owners[e] && owners[e] != "host-2" {
+			t.Errorf("expected %s to stay on %s, got %s", e, owners[e], o)
+		}
+	}
+}
+
+func TestShardMembership(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedisStater("redis://"+s.Addr(), "foo", 1)
+	if err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	a := &Shard{Membership: r, Member: "a", TTL: 30 * time.Second}
+	b := &Shard{Membership: r, Member: "b", TTL: 50 * time.Millisecond}
+	if err := a.refresh(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	watch := a.Watch()
+	if err := b.refresh(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if err := a.refresh(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	select {
+	case <-watch:
+	default:
+		t.Error("expected the watcher to be told b joined")
+	}
+
+	for i := 0; i < 10; i++ {
+		entity := fmt.Sprintf("lb-%d", i)
+		if a.Owns(entity) == b.Owns(entity) {
+			t.Errorf("expected exactly one of a and b to own %s", entity)
+		}
+	}
+
+	// once the heartbeat of b expires, a owns everything
+	time.Sleep(100 * time.Millisecond)
+	if err := a.refresh(); err != nil {
+		t.Fatal("Shouldn't have err but did: ", err)
+	}
+	if members, err := r.Members(); err != nil || len(members) != 1 {
+		t.Errorf("expected only a to be a member, got %v (%v)", members, err)
+	}
+	for i := 0; i < 10; i++ {
+		if entity := fmt.Sprintf("lb-%d", i); !a.Owns(entity) {
+			t.Errorf("expected a to own %s", entity)
+		}
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,9 +22,18 @@ import (
 )
 
 const (
-	stateFileFormat = "%s-state.json"
-	DynamoTableName = "HoneyAWSAccessLogBuckets"
-	TTLDefault      = time.Hour * 24 * 7
+	stateFileFormat   = "%s-state.json"
+	offsetsFileFormat = "%s-offsets.json"
+	DynamoTableName   = "HoneyAWSIngestState"
+	// LegacyDynamoTableName is the table, keyed only by S3Object, which
+	// was used before DynamoTableName.
+	LegacyDynamoTableName = "HoneyAWSAccessLogBuckets"
+	TTLDefault            = time.Hour * 24 * 7
+
+	dynamoBatchWriteLimit = 25
+	// dynamoIndexRefresh is how often the index entry of a partition
+	// which is still being written to is refreshed.
+	dynamoIndexRefresh = time.Hour
 )
 
 // Stater lets us gain insight into the current state of object processing. It
@@ -36,95 +49,409 @@ type Stater interface {
 	SetProcessed(object string) error
 }
 
+// OffsetStater is implemented by Staters which can also record how far into an
+// object processing has got, so that a large object which was interrupted
+// (e.g. by a crash) can be resumed rather than sent again from the start.
+// Offsets are numbers of lines (or records) from the start of the object.
+type OffsetStater interface {
+	Stater
+
+	// InProgressObjects returns the objects which have been started but
+	// not finished, along with how far into them processing has got.
+	InProgressObjects() (map[string]Progress, error)
+
+	// Offset returns the offset of an object, which is 0 if processing of
+	// it hasn't been started or has been finished.
+	Offset(object string) (int, error)
+
+	// SetOffset indicates that the events of the first offset lines of
+	// the object have been sent to Honeycomb, and that the object is in
+	// progress until ClearOffset is called.
+	SetOffset(object string, offset int) error
+
+	// ClearOffset indicates that the object has been finished.
+	ClearOffset(object string) error
+}
+
+// Progress is how far into an object processing has got, and by which replica.
+type Progress struct {
+	Offset int
+	// Owner is the replica which recorded the offset. It's empty for
+	// Staters which aren't shared between replicas.
+	Owner string
+	// Heartbeat is when the offset was last recorded.
+	Heartbeat time.Time
+}
+
+// Abandoned returns whether an object in progress can be resumed by owner
+// when it starts: either owner was processing it, or it has Lapsed.
+func (p Progress) Abandoned(owner string, lease time.Duration) bool {
+	return p.Owner == "" || p.Owner == owner || p.Lapsed(owner, lease)
+}
+
+// Lapsed returns whether another replica than owner was processing an object
+// and hasn't recorded an offset within lease, and so has presumably gone away.
+func (p Progress) Lapsed(owner string, lease time.Duration) bool {
+	return p.Owner != "" && p.Owner != owner && time.Since(p.Heartbeat) > lease
+}
+
+// PrefixStater is implemented by Staters which can look up the processed
+// objects under a prefix without going through all of them.
+type PrefixStater interface {
+	Stater
+
+	// ProcessedObjectsWithPrefix returns the objects under prefix which
+	// have been processed already.
+	ProcessedObjectsWithPrefix(prefix string) (map[string]time.Time, error)
+
+	// SetProcessedWithPrefix is SetProcessed for an object which was
+	// listed under prefix, which is always the same for the object, e.g.
+	// the prefix of the day of an entity's logs.
+	SetProcessedWithPrefix(prefix, object string) error
+}
+
 // Used to communicate between the various pieces which are relying on state
 // information.
 type DownloadedObject struct {
 	Object, Filename string
 }
 
+// DynamoDBConfig is the table a DynamoDBStater keeps state in and how.
+type DynamoDBConfig struct {
+	// TableName is DynamoTableName if it's empty.
+	TableName string
+	// Namespace, e.g. an environment, is prefixed to the partitions of
+	// each service so that several deployments can share a table.
+	Namespace string
+	// TTL is how long processed objects are kept, TTLDefault if it's 0.
+	TTL time.Duration
+	// CreateTable creates the table, with TTL enabled, if it doesn't
+	// exist yet.
+	CreateTable bool
+}
+
+// DynamoDBStater keeps state in a DynamoDB table, in which the objects
+// processed by a service are partitioned by the prefix they were listed under
+// (which is per entity and day, e.g. the logs of a load balancer on a day) and
+// sorted by object. Since the partition of an object only depends on the
+// object, claiming it is conditional on it not being in the table at all. The
+// partitions written to recently are indexed, so that the recently processed
+// objects, or those under a prefix, can be queried for rather than scanning
+// the whole table.
 type DynamoDBStater struct {
 	Session          *session.Session
+	TableName        string
+	Namespace        string
+	TTL              time.Duration
+	Service          string
 	BackfillInterval time.Duration
+	// Owner identifies this replica in the offsets it records.
+	Owner string
+	// AckTimeout is how long an item dequeued from a work queue is hidden
+	// from other replicas without being acknowledged.
+	AckTimeout time.Duration
+
+	// indexed holds when the index entry of each partition was last
+	// written by this replica.
+	indexed   map[string]time.Time
+	indexedMu sync.Mutex
 }
 
-func NewDynamoDBStater(session *session.Session, backfillHrs int) (*DynamoDBStater, error) {
+func NewDynamoDBStater(session *session.Session, config DynamoDBConfig, service string, backfillHrs int) (*DynamoDBStater, error) {
 	stater := &DynamoDBStater{
 		Session:          session,
+		TableName:        config.TableName,
+		Namespace:        config.Namespace,
+		TTL:              config.TTL,
+		Service:          service,
 		BackfillInterval: time.Hour * time.Duration(backfillHrs),
+		AckTimeout:       queueAckTimeout,
+	}
+	owner, err := ReplicaID()
+	if err != nil {
+		return stater, err
+	}
+	stater.Owner = owner
+	if stater.TableName == "" {
+		stater.TableName = DynamoTableName
+	}
+	if stater.TTL == 0 {
+		stater.TTL = TTLDefault
 	}
 
 	svc := dynamodb.New(session)
 	input := &dynamodb.DescribeTableInput{
-		TableName: aws.String(DynamoTableName),
+		TableName: aws.String(stater.TableName),
+	}
+	_, err = svc.DescribeTable(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException && config.CreateTable {
+		err = stater.createTable()
 	}
-	_, err := svc.DescribeTable(input)
 	if err != nil {
 		// For some reason, we cannot write to
 		// the table or access it
 		return stater, err
 	}
 
+	if err := stater.migrateLegacyTable(); err != nil {
+		return stater, err
+	}
+
 	return stater, nil
 }
 
+// createTable creates the table and enables TTL on it. Other replicas may be
+// doing the same at once, so a table which is already being created is waited
+// for rather than treated as an error.
+func (d *DynamoDBStater) createTable() error {
+	svc := dynamodb.New(d.Session)
+	_, err := svc.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(d.TableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("Partition"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("S3Object"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Partition"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("S3Object"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceInUseException {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating DynamoDB table %s: %s", d.TableName, err)
+	}
+
+	if err := svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(d.TableName),
+	}); err != nil {
+		return fmt.Errorf("Error waiting for DynamoDB table %s: %s", d.TableName, err)
+	}
+
+	ttl, err := svc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(d.TableName),
+	})
+	if err != nil {
+		return fmt.Errorf("Error describing TTL of DynamoDB table %s: %s", d.TableName, err)
+	}
+	switch aws.StringValue(ttl.TimeToLiveDescription.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+	default:
+		if _, err := svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(d.TableName),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: aws.String("TTL"),
+				Enabled:       aws.Bool(true),
+			},
+		}); err != nil {
+			return fmt.Errorf("Error enabling TTL of DynamoDB table %s: %s", d.TableName, err)
+		}
+	}
+
+	logrus.WithField("table", d.TableName).Info("Created DynamoDB table")
+	return nil
+}
+
 // Used for unmarshaling and adding objects to DynamoDB
 type Record struct {
-	S3Object string
-	Time     time.Time
-	TTL      int64 //future date formatted as unix seconds-since-epoch
+	Partition string
+	S3Object  string
+	Time      time.Time
+	TTL       int64 //future date formatted as unix seconds-since-epoch
+	// Offset and Owner are only set on the items of objects in progress,
+	// whose Time is when the offset was last recorded.
+	Offset int    `dynamodbav:",omitempty"`
+	Owner  string `dynamodbav:",omitempty"`
 }
 
-// list of processed objects
-func (d *DynamoDBStater) ProcessedObjects() (map[string]time.Time, error) {
-	objs := make(map[string]time.Time)
+// servicePrefix starts the partitions of the service.
+func (d *DynamoDBStater) servicePrefix() string {
+	if d.Namespace == "" {
+		return d.Service
+	}
+	return d.Namespace + "/" + d.Service
+}
 
-	var records []Record
+// partitionKey is the partition of the objects listed under prefix.
+func (d *DynamoDBStater) partitionKey(prefix string) string {
+	return d.servicePrefix() + "#prefix#" + prefix
+}
+
+// objectPrefix is the prefix an object is partitioned by when it's set as
+// processed without the prefix it was listed under, e.g. by state import.
+// It's the object's directory, which the prefixes it could be listed under
+// start with.
+func objectPrefix(object string) string {
+	if dir := path.Dir(object); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// indexPartitionKey is the partition which indexes the partitions of the
+// service by when they were last written to.
+func (d *DynamoDBStater) indexPartitionKey() string {
+	return d.servicePrefix() + "#partitions"
+}
+
+// index records that partition is being written to, at most every
+// dynamoIndexRefresh.
+func (d *DynamoDBStater) index(partition string, now time.Time) error {
+	d.indexedMu.Lock()
+	defer d.indexedMu.Unlock()
+	if now.Sub(d.indexed[partition]) < dynamoIndexRefresh {
+		return nil
+	}
 
+	obj, err := dynamodbattribute.MarshalMap(Record{
+		Partition: d.indexPartitionKey(),
+		S3Object:  partition,
+		Time:      now,
+		TTL:       now.Add(d.TTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("Marshalling DynamoDB object failed: %s", err)
+	}
 	svc := dynamodb.New(d.Session)
-	err := svc.ScanPages(&dynamodb.ScanInput{
-		TableName: aws.String(DynamoTableName),
-	}, func(logs *dynamodb.ScanOutput, last bool) bool {
-		recs := []Record{}
+	if _, err := svc.PutItem(&dynamodb.PutItemInput{
+		Item:      obj,
+		TableName: aws.String(d.TableName),
+	}); err != nil {
+		return fmt.Errorf("PutItem failed: %s", err)
+	}
 
-		err := dynamodbattribute.UnmarshalListOfMaps(logs.Items, &recs)
+	if d.indexed == nil {
+		d.indexed = make(map[string]time.Time)
+	}
+	d.indexed[partition] = now
+	return nil
+}
 
-		// break out of function
-		if err != nil {
-			logrus.WithField("error", err).Debug("Failed to unmarshal DynamoDB Scan Items")
-			return false
+// partitionsWithPrefix returns the partitions written to since cutoff which
+// can hold objects under prefix, along with the prefix to query each for
+// (which is empty for partitions wholly under prefix).
+func (d *DynamoDBStater) partitionsWithPrefix(prefix string, cutoff time.Time) (map[string]string, error) {
+	// Index entries are refreshed at most every dynamoIndexRefresh, so
+	// they can be that much older than the partition's objects.
+	records, err := d.query(d.indexPartitionKey(), "", cutoff.Add(-dynamoIndexRefresh))
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[string]string)
+	for _, record := range records {
+		partitionPrefix := strings.TrimPrefix(record.S3Object, d.partitionKey(""))
+		switch {
+		case strings.HasPrefix(partitionPrefix, prefix):
+			partitions[record.S3Object] = ""
+		case strings.HasPrefix(prefix, partitionPrefix):
+			partitions[record.S3Object] = prefix
 		}
+	}
+	return partitions, nil
+}
 
-		records = append(records, recs...)
-		for _, rec := range records {
-			// break out of the scan, we've reached the end of our
-			// backfill interval
-			if time.Since(rec.Time) > d.BackfillInterval {
-				return false
+// offsetsPartitionKey is the partition of the objects in progress.
+func (d *DynamoDBStater) offsetsPartitionKey() string {
+	return d.servicePrefix() + "#offsets"
+}
+
+func (d *DynamoDBStater) key(partition, s3object string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Partition": {S: aws.String(partition)},
+		"S3Object":  {S: aws.String(s3object)},
+	}
+}
+
+// query returns the objects of a partition processed since cutoff, only those
+// under prefix if it isn't empty.
+func (d *DynamoDBStater) query(partition, prefix string, cutoff time.Time) ([]Record, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.TableName),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		ExpressionAttributeNames: map[string]*string{
+			"#partition": aws.String("Partition"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(partition)},
+		},
+	}
+	if prefix != "" {
+		input.KeyConditionExpression = aws.String("#partition = :partition AND begins_with(S3Object, :prefix)")
+		input.ExpressionAttributeValues[":prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	}
+
+	var records []Record
+	var unmarshalErr error
+	svc := dynamodb.New(d.Session)
+	err := svc.QueryPages(input, func(page *dynamodb.QueryOutput, last bool) bool {
+		recs := []Record{}
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &recs); unmarshalErr != nil {
+			return false
+		}
+		for _, rec := range recs {
+			if rec.Time.After(cutoff) {
+				records = append(records, rec)
 			}
 		}
-
 		return true
 	})
-
+	if err == nil {
+		err = unmarshalErr
+	}
 	if err != nil {
-		return objs, fmt.Errorf("Error scanning DynamoDB, %v", err)
+		return nil, fmt.Errorf("Error querying DynamoDB, %v", err)
 	}
 
-	for _, record := range records {
-		objs[record.S3Object] = record.Time
+	return records, nil
+}
+
+func (d *DynamoDBStater) processedObjects(prefix string) (map[string]time.Time, error) {
+	objs := make(map[string]time.Time)
+
+	cutoff := time.Now().Add(-d.BackfillInterval)
+	partitions, err := d.partitionsWithPrefix(prefix, cutoff)
+	if err != nil {
+		return objs, err
+	}
+	for partition, queryPrefix := range partitions {
+		records, err := d.query(partition, queryPrefix, cutoff)
+		if err != nil {
+			return objs, err
+		}
+		for _, record := range records {
+			objs[record.S3Object] = record.Time
+		}
 	}
 
 	return objs, nil
 }
 
+// list of processed objects
+func (d *DynamoDBStater) ProcessedObjects() (map[string]time.Time, error) {
+	return d.processedObjects("")
+}
+
+func (d *DynamoDBStater) ProcessedObjectsWithPrefix(prefix string) (map[string]time.Time, error) {
+	return d.processedObjects(prefix)
+}
+
 func (d *DynamoDBStater) SetProcessed(s3object string) error {
+	return d.SetProcessedWithPrefix(objectPrefix(s3object), s3object)
+}
+
+func (d *DynamoDBStater) SetProcessedWithPrefix(prefix, s3object string) error {
 
 	svc := dynamodb.New(d.Session)
 
+	now := time.Now()
 	objMap := Record{
-		S3Object: s3object,
-		Time:     time.Now(),
-		TTL:      time.Now().Add(TTLDefault).Unix(), //
+		Partition: d.partitionKey(prefix),
+		S3Object:  s3object,
+		Time:      now,
+		TTL:       now.Add(d.TTL).Unix(),
 	}
 
 	obj, err := dynamodbattribute.MarshalMap(objMap)
@@ -133,11 +460,17 @@ func (d *DynamoDBStater) SetProcessed(s3object string) error {
 		return fmt.Errorf("Marshalling DynamoDB object failed: %s", err)
 	}
 
+	// The partition is indexed first, so that the object can't be
+	// claimed without it being found by ProcessedObjects.
+	if err := d.index(objMap.Partition, now); err != nil {
+		return err
+	}
+
 	// add object to dynamodb using conditional
 	// if the object exists, no write happens
 	input := &dynamodb.PutItemInput{
 		Item:                obj,
-		TableName:           aws.String(DynamoTableName),
+		TableName:           aws.String(d.TableName),
 		ConditionExpression: aws.String("attribute_not_exists(S3Object)"),
 	}
 
@@ -160,6 +493,513 @@ func (d *DynamoDBStater) SetProcessed(s3object string) error {
 	return nil
 }
 
+func (d *DynamoDBStater) SetProcessedAt(s3object string, t time.Time) error {
+	partition := d.partitionKey(objectPrefix(s3object))
+	obj, err := dynamodbattribute.MarshalMap(Record{
+		Partition: partition,
+		S3Object:  s3object,
+		Time:      t,
+		TTL:       t.Add(d.TTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("Marshalling DynamoDB object failed: %s", err)
+	}
+	if err := d.index(partition, time.Now()); err != nil {
+		return err
+	}
+
+	svc := dynamodb.New(d.Session)
+	if _, err := svc.PutItem(&dynamodb.PutItemInput{
+		Item:      obj,
+		TableName: aws.String(d.TableName),
+	}); err != nil {
+		return fmt.Errorf("PutItem failed: %s", err)
+	}
+	return nil
+}
+
+// Forget deletes the object from every partition it can still be in, as which
+// prefix it was listed under isn't known.
+func (d *DynamoDBStater) Forget(s3object string) error {
+	partitions, err := d.partitionsWithPrefix(s3object, time.Now().Add(-d.TTL))
+	if err != nil {
+		return err
+	}
+
+	svc := dynamodb.New(d.Session)
+	for _, partition := range append(keys(partitions), d.offsetsPartitionKey()) {
+		if _, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(d.TableName),
+			Key:       d.key(partition, s3object),
+		}); err != nil {
+			return fmt.Errorf("DeleteItem failed: %s", err)
+		}
+	}
+	return nil
+}
+
+func keys(m map[string]string) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func (d *DynamoDBStater) InProgressObjects() (map[string]Progress, error) {
+	objs := make(map[string]Progress)
+
+	records, err := d.query(d.offsetsPartitionKey(), "", time.Now().Add(-d.BackfillInterval))
+	if err != nil {
+		return objs, err
+	}
+	for _, record := range records {
+		objs[record.S3Object] = Progress{
+			Offset:    record.Offset,
+			Owner:     record.Owner,
+			Heartbeat: record.Time,
+		}
+	}
+
+	return objs, nil
+}
+
+func (d *DynamoDBStater) Offset(s3object string) (int, error) {
+	svc := dynamodb.New(d.Session)
+	out, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.TableName),
+		Key:            d.key(d.offsetsPartitionKey(), s3object),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("GetItem failed: %s", err)
+	}
+
+	var rec Record
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &rec); err != nil {
+		return 0, fmt.Errorf("Unmarshalling DynamoDB object failed: %s", err)
+	}
+	return rec.Offset, nil
+}
+
+func (d *DynamoDBStater) SetOffset(s3object string, offset int) error {
+	now := time.Now()
+	obj, err := dynamodbattribute.MarshalMap(Record{
+		Partition: d.offsetsPartitionKey(),
+		S3Object:  s3object,
+		Time:      now,
+		TTL:       now.Add(d.TTL).Unix(),
+		Offset:    offset,
+		Owner:     d.Owner,
+	})
+	if err != nil {
+		return fmt.Errorf("Marshalling DynamoDB object failed: %s", err)
+	}
+
+	svc := dynamodb.New(d.Session)
+	if _, err := svc.PutItem(&dynamodb.PutItemInput{
+		Item:      obj,
+		TableName: aws.String(d.TableName),
+	}); err != nil {
+		return fmt.Errorf("PutItem failed: %s", err)
+	}
+	return nil
+}
+
+func (d *DynamoDBStater) ClearOffset(s3object string) error {
+	svc := dynamodb.New(d.Session)
+	if _, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.TableName),
+		Key:       d.key(d.offsetsPartitionKey(), s3object),
+	}); err != nil {
+		return fmt.Errorf("DeleteItem failed: %s", err)
+	}
+	return nil
+}
+
+// leasesPartitionKey is the partition of the leases of the service, which are
+// items of the holder and when the lease expires (in Unix milliseconds).
+func (d *DynamoDBStater) leasesPartitionKey() string {
+	return d.servicePrefix() + "#leases"
+}
+
+// queuePartitionKey is the partition of a work queue, whose items are sorted
+// by when they were enqueued. Dequeued items have the time until which they're
+// hidden from other replicas (in Unix milliseconds) until they're acknowledged.
+func (d *DynamoDBStater) queuePartitionKey(name string) string {
+	return d.servicePrefix() + "#queue#" + name
+}
+
+func (d *DynamoDBStater) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	item := d.key(d.leasesPartitionKey(), name)
+	item["Holder"] = &dynamodb.AttributeValue{S: aws.String(holder)}
+	item["Expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(ttl).UnixNano()/int64(time.Millisecond), 10))}
+	item["TTL"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(d.TTL).Unix(), 10))}
+
+	// The lease is ours if nobody holds it, we already do, or it expired.
+	svc := dynamodb.New(d.Session)
+	_, err := svc.PutItem(&dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(d.TableName),
+		ConditionExpression: aws.String("attribute_not_exists(S3Object) OR Holder = :holder OR Expires < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {S: aws.String(holder)},
+			":now":    {N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, fmt.Errorf("PutItem failed: %s", err)
+	}
+	return true, nil
+}
+
+func (d *DynamoDBStater) ReleaseLease(name, holder string) error {
+	svc := dynamodb.New(d.Session)
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.TableName),
+		Key:                 d.key(d.leasesPartitionKey(), name),
+		ConditionExpression: aws.String("Holder = :holder"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {S: aws.String(holder)},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return fmt.Errorf("DeleteItem failed: %s", err)
+	}
+	return nil
+}
+
+func (d *DynamoDBStater) Enqueue(name string, items ...string) error {
+	svc := dynamodb.New(d.Session)
+	for i, v := range items {
+		now := time.Now()
+		// The sort key orders items by when they were enqueued, and
+		// keeps items enqueued at the same time apart.
+		item := d.key(d.queuePartitionKey(name), fmt.Sprintf("%s#%04d", now.UTC().Format(time.RFC3339Nano), i))
+		item["Item"] = &dynamodb.AttributeValue{S: aws.String(v)}
+		item["TTL"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(d.TTL).Unix(), 10))}
+
+		if _, err := svc.PutItem(&dynamodb.PutItemInput{
+			Item:      item,
+			TableName: aws.String(d.TableName),
+		}); err != nil {
+			return fmt.Errorf("PutItem failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// Dequeue takes the first item of the queue which is visible, hiding it from
+// other replicas for AckTimeout. The item is only deleted once it's
+// acknowledged, so that it's dequeued again if the replica goes away first.
+func (d *DynamoDBStater) Dequeue(name string) (string, bool, error) {
+	svc := dynamodb.New(d.Session)
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	visible := strconv.FormatInt(time.Now().Add(d.AckTimeout).UnixNano()/int64(time.Millisecond), 10)
+
+	var (
+		dequeued  string
+		found     bool
+		updateErr error
+	)
+	err := svc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(d.TableName),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		FilterExpression:       aws.String("attribute_not_exists(Visible) OR Visible < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#partition": aws.String("Partition"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(d.queuePartitionKey(name))},
+			":now":       {N: aws.String(now)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(out *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range out.Items {
+			// Another replica may be dequeuing the same items.
+			_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+				TableName:           aws.String(d.TableName),
+				Key:                 d.key(*item["Partition"].S, *item["S3Object"].S),
+				UpdateExpression:    aws.String("SET Visible = :visible"),
+				ConditionExpression: aws.String("attribute_exists(S3Object) AND (attribute_not_exists(Visible) OR Visible < :now)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":visible": {N: aws.String(visible)},
+					":now":     {N: aws.String(now)},
+				},
+			})
+			if err != nil {
+				if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+					continue
+				}
+				updateErr = fmt.Errorf("UpdateItem failed: %s", err)
+				return false
+			}
+			if v, ok := item["Item"]; ok && v.S != nil {
+				dequeued, found = *v.S, true
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("Error querying DynamoDB, %v", err)
+	}
+	if updateErr != nil {
+		return "", false, updateErr
+	}
+	return dequeued, found, nil
+}
+
+// Ack deletes a dequeued item from the queue.
+func (d *DynamoDBStater) Ack(name, item string) error {
+	svc := dynamodb.New(d.Session)
+	var keys []map[string]*dynamodb.AttributeValue
+	err := svc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(d.TableName),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		FilterExpression:       aws.String("#item = :item"),
+		ExpressionAttributeNames: map[string]*string{
+			"#partition": aws.String("Partition"),
+			"#item":      aws.String("Item"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(d.queuePartitionKey(name))},
+			":item":      {S: aws.String(item)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(out *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, v := range out.Items {
+			keys = append(keys, d.key(*v["Partition"].S, *v["S3Object"].S))
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Error querying DynamoDB, %v", err)
+	}
+
+	for _, key := range keys {
+		if _, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(d.TableName),
+			Key:       key,
+		}); err != nil {
+			return fmt.Errorf("DeleteItem failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// membersPartitionKey is the partition of the members of the service, which
+// are items of when their heartbeats expire (in Unix milliseconds).
+func (d *DynamoDBStater) membersPartitionKey() string {
+	return d.servicePrefix() + "#members"
+}
+
+func (d *DynamoDBStater) Heartbeat(member string, ttl time.Duration) error {
+	now := time.Now()
+	item := d.key(d.membersPartitionKey(), member)
+	item["Expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(ttl).UnixNano()/int64(time.Millisecond), 10))}
+	item["TTL"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(d.TTL).Unix(), 10))}
+
+	svc := dynamodb.New(d.Session)
+	if _, err := svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(d.TableName),
+	}); err != nil {
+		return fmt.Errorf("PutItem failed: %s", err)
+	}
+	return nil
+}
+
+func (d *DynamoDBStater) Members() ([]string, error) {
+	var members []string
+	svc := dynamodb.New(d.Session)
+	err := svc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(d.TableName),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		FilterExpression:       aws.String("Expires >= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#partition": aws.String("Partition"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(d.membersPartitionKey())},
+			":now":       {N: aws.String(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, last bool) bool {
+		for _, item := range page.Items {
+			members = append(members, *item["S3Object"].S)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error querying DynamoDB, %v", err)
+	}
+	return members, nil
+}
+
+func (d *DynamoDBStater) Leave(member string) error {
+	svc := dynamodb.New(d.Session)
+	if _, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.TableName),
+		Key:       d.key(d.membersPartitionKey(), member),
+	}); err != nil {
+		return fmt.Errorf("DeleteItem failed: %s", err)
+	}
+	return nil
+}
+
+// legacyObjectRegexps match the names of the objects of each service which
+// used LegacyDynamoTableName. The legacy table is keyed only by object, and
+// the prefixes of buckets aren't known, so objects are told apart by the
+// parts of their names which AWS chooses.
+var legacyObjectRegexps = map[string]*regexp.Regexp{
+	// e.g. AWSLogs/123/elasticloadbalancing/us-east-1/2019/01/02/123_elasticloadbalancing_us-east-1_my-lb_20190102T0000Z_192.0.2.1_abc.log
+	"elasticloadbalancing": regexp.MustCompile(`/elasticloadbalancing/[^/]+/\d{4}/\d{2}/\d{2}/[^/]*_elasticloadbalancing_[^_/]+_[^_/.]+_[^/]*$`),
+	// e.g. .../123_elasticloadbalancing_us-east-1_app.my-alb.0123456789abcdef_20190102T0000Z_192.0.2.1_abc.log.gz
+	"elasticloadbalancingv2": regexp.MustCompile(`/elasticloadbalancing/[^/]+/\d{4}/\d{2}/\d{2}/[^/]*_elasticloadbalancing_[^_/]+_(app|net)\.[^/]*$`),
+	// e.g. AWSLogs/123/CloudTrail/us-east-1/2019/01/02/123_CloudTrail_us-east-1_20190102T0000Z_abc.json.gz
+	"cloudtrail": regexp.MustCompile(`/CloudTrail/[^/]+/\d{4}/\d{2}/\d{2}/[^/]*_CloudTrail_[^/]*$`),
+	// e.g. E2EXAMPLE.2019-01-02-15.abcdef12.gz
+	"cloudfront": regexp.MustCompile(`(^|/)[A-Z0-9]+\.\d{4}-\d{2}-\d{2}-\d{2}\.[0-9a-f]+(\.gz)?$`),
+}
+
+// migrateLegacyTable copies the objects of the service in
+// LegacyDynamoTableName, if it exists, the first time the service uses the
+// table. Services which didn't exist before the table have nothing to copy.
+// Objects are copied with puts of the same items, so a migration which was
+// interrupted is simply done again.
+func (d *DynamoDBStater) migrateLegacyTable() error {
+	svc := dynamodb.New(d.Session)
+	marker := d.key(d.servicePrefix()+"#migrated", LegacyDynamoTableName)
+
+	out, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.TableName),
+		Key:            marker,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("GetItem failed: %s", err)
+	}
+	if len(out.Item) > 0 {
+		return nil
+	}
+
+	migrated := 0
+	if objectRegexp, ok := legacyObjectRegexps[d.Service]; ok {
+		if migrated, err = d.copyLegacyObjects(objectRegexp); err != nil {
+			return err
+		}
+	}
+
+	if _, err := svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"Partition": marker["Partition"],
+			"S3Object":  marker["S3Object"],
+			"Time":      {S: aws.String(time.Now().Format(time.RFC3339Nano))},
+		},
+	}); err != nil {
+		return fmt.Errorf("PutItem failed: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"objects": migrated,
+		"from":    LegacyDynamoTableName,
+		"to":      d.TableName,
+	}).Info("Migrated state from legacy DynamoDB table")
+
+	return nil
+}
+
+// copyLegacyObjects copies the objects in LegacyDynamoTableName matching
+// objectRegexp which haven't expired, returning how many were copied.
+func (d *DynamoDBStater) copyLegacyObjects(objectRegexp *regexp.Regexp) (int, error) {
+	svc := dynamodb.New(d.Session)
+	migrated := 0
+
+	_, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(LegacyDynamoTableName),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		// nothing to migrate
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error describing legacy DynamoDB table: %s", err)
+	}
+
+	now := time.Now()
+	var writes []*dynamodb.WriteRequest
+	var marshalErr error
+	err = svc.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(LegacyDynamoTableName),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		recs := []Record{}
+		if marshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &recs); marshalErr != nil {
+			return false
+		}
+		for _, rec := range recs {
+			if time.Since(rec.Time) > d.TTL || !objectRegexp.MatchString(rec.S3Object) {
+				continue
+			}
+			partition := d.partitionKey(objectPrefix(rec.S3Object))
+			if marshalErr = d.index(partition, now); marshalErr != nil {
+				return false
+			}
+			item, err := dynamodbattribute.MarshalMap(Record{
+				Partition: partition,
+				S3Object:  rec.S3Object,
+				Time:      rec.Time,
+				TTL:       rec.TTL,
+			})
+			if err != nil {
+				marshalErr = err
+				return false
+			}
+			writes = append(writes, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: item},
+			})
+		}
+		return true
+	})
+	if err == nil {
+		err = marshalErr
+	}
+	if err != nil {
+		return migrated, fmt.Errorf("Error scanning legacy DynamoDB table: %s", err)
+	}
+
+	for len(writes) > 0 {
+		n := len(writes)
+		if n > dynamoBatchWriteLimit {
+			n = dynamoBatchWriteLimit
+		}
+		batch := writes[:n]
+		writes = writes[n:]
+
+		out, err := svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				d.TableName: batch,
+			},
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("BatchWriteItem failed: %s", err)
+		}
+		// Writes which were throttled are tried again.
+		unprocessed := out.UnprocessedItems[d.TableName]
+		writes = append(writes, unprocessed...)
+		migrated += n - len(unprocessed)
+	}
+
+	return migrated, nil
+}
+
 // FileStater is an implementation for indicating processing state using the
 // local filesystem for backing storage.
 type FileStater struct {
@@ -231,6 +1071,10 @@ func (f *FileStater) SetProcessed(object string) error {
 
 	processedObjects[object] = time.Now()
 
+	return f.writeProcessedObjects(processedObjects)
+}
+
+func (f *FileStater) writeProcessedObjects(processedObjects map[string]time.Time) error {
 	processedData, err := json.Marshal(processedObjects)
 	if err != nil {
 		return fmt.Errorf("Marshalling JSON failed: %s", err)
@@ -242,3 +1086,149 @@ func (f *FileStater) SetProcessed(object string) error {
 
 	return nil
 }
+
+func (f *FileStater) SetProcessedAt(object string, t time.Time) error {
+	f.Lock()
+	defer f.Unlock()
+
+	processedObjects, err := f.processedObjects()
+	if err != nil {
+		return err
+	}
+	processedObjects[object] = t
+	return f.writeProcessedObjects(processedObjects)
+}
+
+func (f *FileStater) Forget(object string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	processedObjects, err := f.processedObjects()
+	if err != nil {
+		return err
+	}
+	delete(processedObjects, object)
+	if err := f.writeProcessedObjects(processedObjects); err != nil {
+		return err
+	}
+
+	offsets, err := f.offsets()
+	if err != nil {
+		return err
+	}
+	if _, ok := offsets[object]; !ok {
+		return nil
+	}
+	delete(offsets, object)
+	return f.writeOffsets(offsets)
+}
+
+// fileOffset is an entry of the offsets file.
+type fileOffset struct {
+	Offset int
+	Time   time.Time
+}
+
+func (f *FileStater) offsetsFile() string {
+	return filepath.Join(f.StateDir, fmt.Sprintf(offsetsFileFormat, f.Service))
+}
+
+func (f *FileStater) offsets() (map[string]fileOffset, error) {
+	offsets := make(map[string]fileOffset)
+
+	data, err := ioutil.ReadFile(f.offsetsFile())
+	if os.IsNotExist(err) {
+		return offsets, nil
+	} else if err != nil {
+		return offsets, fmt.Errorf("Error reading offsets file: %s", err)
+	}
+
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return offsets, fmt.Errorf("Unmarshalling offsets file JSON failed: %s", err)
+	}
+
+	return offsets, nil
+}
+
+func (f *FileStater) writeOffsets(offsets map[string]fileOffset) error {
+	// Reap objects which were never finished, e.g. because they couldn't
+	// be downloaded, once they're outside of the backfill interval.
+	for k, v := range offsets {
+		if time.Since(v.Time) > f.BackfillInterval {
+			delete(offsets, k)
+		}
+	}
+
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	// Write then rename so that a crash part way through writing doesn't
+	// lose all of the offsets.
+	tmp := f.offsetsFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Writing file failed: %s", err)
+	}
+	if err := os.Rename(tmp, f.offsetsFile()); err != nil {
+		return fmt.Errorf("Writing file failed: %s", err)
+	}
+
+	return nil
+}
+
+func (f *FileStater) InProgressObjects() (map[string]Progress, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	offsets, err := f.offsets()
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make(map[string]Progress, len(offsets))
+	for k, v := range offsets {
+		if time.Since(v.Time) <= f.BackfillInterval {
+			objs[k] = Progress{Offset: v.Offset, Heartbeat: v.Time}
+		}
+	}
+	return objs, nil
+}
+
+func (f *FileStater) Offset(object string) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	offsets, err := f.offsets()
+	if err != nil {
+		return 0, err
+	}
+	return offsets[object].Offset, nil
+}
+
+func (f *FileStater) SetOffset(object string, offset int) error {
+	f.Lock()
+	defer f.Unlock()
+
+	offsets, err := f.offsets()
+	if err != nil {
+		return err
+	}
+	offsets[object] = fileOffset{Offset: offset, Time: time.Now()}
+	return f.writeOffsets(offsets)
+}
+
+func (f *FileStater) ClearOffset(object string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	offsets, err := f.offsets()
+	if err != nil {
+		return err
+	}
+	if _, ok := offsets[object]; !ok {
+		return nil
+	}
+	delete(offsets, object)
+	return f.writeOffsets(offsets)
+}
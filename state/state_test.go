@@ -0,0 +1,52 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestDynamoDBStaterPartitionKeys(t *testing.T) {
+	d := &DynamoDBStater{Service: "elb"}
+
+	// objects are partitioned by the prefix they were listed under,
+	// which is per entity and day
+	prefix := "AWSLogs/123/elasticloadbalancing/us-east-1/2019/01/03/123_elasticloadbalancing_us-east-1_my-lb"
+	if key := d.partitionKey(prefix); key != "elb#prefix#"+prefix {
+		t.Errorf("expected partition elb#prefix#%s, got %s", prefix, key)
+	}
+
+	// without one, by their directory, which the prefixes they could be
+	// listed under start with
+	if p := objectPrefix(prefix + "_20190103T0000Z_192.0.2.1_abc.log"); p != "AWSLogs/123/elasticloadbalancing/us-east-1/2019/01/03" {
+		t.Errorf("unexpected object prefix %s", p)
+	}
+	if p := objectPrefix("E2EXAMPLE.2019-01-03-15.abcdef12.gz"); p != "" {
+		t.Errorf("expected an object at the top of the bucket to have no prefix, got %s", p)
+	}
+
+	// a namespace keeps deployments sharing a table apart
+	d.Namespace = "staging"
+	if key := d.partitionKey(prefix); key != "staging/elb#prefix#"+prefix {
+		t.Errorf("expected partition staging/elb#prefix#%s, got %s", prefix, key)
+	}
+	if key := d.offsetsPartitionKey(); key != "staging/elb#offsets" {
+		t.Errorf("expected partition staging/elb#offsets, got %s", key)
+	}
+}
+
+func TestLegacyObjectRegexps(t *testing.T) {
+	objects := map[string]string{
+		"logs/AWSLogs/123/elasticloadbalancing/us-east-1/2019/01/02/123_elasticloadbalancing_us-east-1_my-lb_20190102T0000Z_192.0.2.1_abc.log":                     "elasticloadbalancing",
+		"AWSLogs/123/elasticloadbalancing/us-east-1/2019/01/02/123_elasticloadbalancing_us-east-1_app.my-alb.0123456789abcdef_20190102T0000Z_192.0.2.1_abc.log.gz": "elasticloadbalancingv2",
+		"AWSLogs/123/CloudTrail/us-east-1/2019/01/02/123_CloudTrail_us-east-1_20190102T0000Z_abc.json.gz":                                                          "cloudtrail",
+		"cf/E2EXAMPLE.2019-01-02-15.abcdef12.gz": "cloudfront",
+	}
+
+	// each object is only migrated for its own service
+	for object, service := range objects {
+		for s, re := range legacyObjectRegexps {
+			if matched := re.MatchString(object); matched != (s == service) {
+				t.Errorf("expected %s to match %s only, but %s matched: %v", object, service, s, matched)
+			}
+		}
+	}
+}
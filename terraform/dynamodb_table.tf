@@ -1,7 +1,13 @@
-resource "aws_dynamodb_table" "honey_aws_access_log_bucket" {
-  name = "HoneyAWSAccessLogBuckets"
+resource "aws_dynamodb_table" "honey_aws_ingest_state" {
+  name = "HoneyAWSIngestState"
 
-  hash_key  = "S3Object"
+  hash_key  = "Partition"
+  range_key = "S3Object"
+
+  attribute {
+    name = "Partition"
+    type = "S"
+  }
 
   attribute {
     name = "S3Object"